@@ -0,0 +1,610 @@
+// Package amqp provides micro broker on top of RabbitMQ (AMQP 0-9-1).
+// Messages are published to topic exchange with topic as routing key, every subscriber group
+// gets own queue bound to the exchange, so each group receives its copy of message.
+// Lost connection is reestablished with backoff and subscribers consume again from their queues.
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/logger"
+	"go.unistack.org/micro/v3/metadata"
+)
+
+var (
+	DefaultExchange     = "micro"
+	DefaultExchangeType = "topic"
+	// delay before first reconnect attempt, it doubles up to DefaultReconnectBackoffMax
+	DefaultReconnectBackoff    = 500 * time.Millisecond
+	DefaultReconnectBackoffMax = 30 * time.Second
+)
+
+type (
+	exchangeKey struct{}
+	durableKey  struct{}
+	prefetchKey struct{}
+	requeueKey  struct{}
+	authKey     struct{}
+)
+
+func setOption(k, v interface{}) broker.Option {
+	return func(o *broker.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, k, v)
+	}
+}
+
+type exchange struct {
+	name, kind string
+}
+
+// Exchange sets exchange messages are published to, it is declared on connect
+func Exchange(name, kind string) broker.Option {
+	return setOption(exchangeKey{}, exchange{name: name, kind: kind})
+}
+
+// Durable makes exchange, group queues and messages survive broker restart
+func Durable(b bool) broker.Option {
+	return setOption(durableKey{}, b)
+}
+
+// PrefetchCount limits unacked messages delivered to single subscriber
+func PrefetchCount(n int) broker.Option {
+	return setOption(prefetchKey{}, n)
+}
+
+// Requeue returns unacked messages to queue instead of dropping them (or moving to dead letter exchange)
+func Requeue(b bool) broker.Option {
+	return setOption(requeueKey{}, b)
+}
+
+type auth struct {
+	username, password string
+}
+
+// Auth sets credentials, otherwise they are taken from address url
+func Auth(username, password string) broker.Option {
+	return setOption(authKey{}, auth{username: username, password: password})
+}
+
+type amqpBroker struct {
+	mu   sync.RWMutex
+	opts broker.Options
+	conn *amqp.Connection
+	// publishing channel in confirm mode
+	pub   *amqp.Channel
+	pubMu sync.Mutex
+
+	exchange exchange
+	durable  bool
+	prefetch int
+	requeue  bool
+
+	// closed by Disconnect, stops reconnecting and subscribers
+	stop chan struct{}
+	subs map[*subscriber]struct{}
+}
+
+func NewBroker(opts ...broker.Option) broker.Broker {
+	b := &amqpBroker{opts: broker.NewOptions(opts...), subs: make(map[*subscriber]struct{})}
+	b.init()
+	return b
+}
+
+func (b *amqpBroker) init() {
+	b.exchange = exchange{name: DefaultExchange, kind: DefaultExchangeType}
+	if b.opts.Context == nil {
+		return
+	}
+	if v, ok := b.opts.Context.Value(exchangeKey{}).(exchange); ok {
+		if v.name != "" {
+			b.exchange.name = v.name
+		}
+		if v.kind != "" {
+			b.exchange.kind = v.kind
+		}
+	}
+	b.durable, _ = b.opts.Context.Value(durableKey{}).(bool)
+	b.prefetch, _ = b.opts.Context.Value(prefetchKey{}).(int)
+	b.requeue, _ = b.opts.Context.Value(requeueKey{}).(bool)
+}
+
+func (b *amqpBroker) Name() string {
+	return b.opts.Name
+}
+
+func (b *amqpBroker) Init(opts ...broker.Option) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, o := range opts {
+		o(&b.opts)
+	}
+	b.init()
+	return nil
+}
+
+func (b *amqpBroker) Options() broker.Options {
+	return b.opts
+}
+
+func (b *amqpBroker) Address() string {
+	return strings.Join(b.opts.Addrs, ",")
+}
+
+// Connect dials addresses in order until one succeeds and declares exchange
+func (b *amqpBroker) Connect(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn != nil && !b.conn.IsClosed() {
+		return nil
+	}
+	if len(b.opts.Addrs) == 0 {
+		return fmt.Errorf("amqp: address required")
+	}
+	if err := b.connect(); err != nil {
+		return err
+	}
+	b.stop = make(chan struct{})
+	go b.watch(b.conn, b.stop)
+
+	return nil
+}
+
+// connect dials server and opens publishing channel, b.mu must be held
+func (b *amqpBroker) connect() error {
+	cfg := amqp.Config{TLSClientConfig: b.opts.TLSConfig}
+	if b.opts.Context != nil {
+		if v, ok := b.opts.Context.Value(authKey{}).(auth); ok && v.username != "" {
+			cfg.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: v.username, Password: v.password}}
+		}
+	}
+
+	var conn *amqp.Connection
+	var err error
+	for _, addr := range b.opts.Addrs {
+		if conn, err = amqp.DialConfig(addr, cfg); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("amqp: connect: %w", err)
+	}
+
+	pub, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if err = pub.ExchangeDeclare(b.exchange.name, b.exchange.kind, b.durable, false, false, false, nil); err != nil {
+		conn.Close()
+		return fmt.Errorf("amqp: declare exchange %s: %w", b.exchange.name, err)
+	}
+	if err = pub.Confirm(false); err != nil {
+		conn.Close()
+		return err
+	}
+
+	b.conn, b.pub = conn, pub
+
+	return nil
+}
+
+// watch reconnects with backoff when connection is closed by server or network failure
+func (b *amqpBroker) watch(conn *amqp.Connection, stop chan struct{}) {
+	cerr, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+	if !ok {
+		// closed by Disconnect
+		return
+	}
+	logger.Errorf(context.Background(), "amqp: connection closed: %v, reconnecting", cerr)
+
+	b.mu.Lock()
+	if b.conn == conn {
+		b.conn, b.pub = nil, nil
+	}
+	b.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		timer := time.NewTimer(reconnectBackoff(attempt))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		b.mu.Lock()
+		select {
+		case <-stop:
+			b.mu.Unlock()
+			return
+		default:
+		}
+		err := b.connect()
+		if err == nil {
+			go b.watch(b.conn, stop)
+		}
+		b.mu.Unlock()
+
+		if err == nil {
+			logger.Infof(context.Background(), "amqp: reconnected")
+			return
+		}
+		logger.Errorf(context.Background(), "amqp: reconnect: %v", err)
+	}
+}
+
+func reconnectBackoff(attempt int) time.Duration {
+	d := DefaultReconnectBackoff
+	for i := 0; i < attempt && d < DefaultReconnectBackoffMax; i++ {
+		d *= 2
+	}
+	if d > DefaultReconnectBackoffMax {
+		d = DefaultReconnectBackoffMax
+	}
+	return d
+}
+
+// Disconnect stops subscribers and closes connection, unacked messages are returned to queues by server
+func (b *amqpBroker) Disconnect(ctx context.Context) error {
+	b.mu.Lock()
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+	subs := make([]*subscriber, 0, len(b.subs))
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		if err := sub.Unsubscribe(ctx); err != nil {
+			logger.Errorf(ctx, "amqp: unsubscribe %s: %v", sub.topic, err)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn, b.pub = nil, nil
+	if errors.Is(err, amqp.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (b *amqpBroker) Publish(ctx context.Context, topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	b.mu.RLock()
+	pub := b.pub
+	b.mu.RUnlock()
+	if pub == nil {
+		return broker.ErrNotConnected
+	}
+	options := broker.NewPublishOptions(opts...)
+
+	pmsg := amqp.Publishing{ContentType: "application/octet-stream"}
+	if b.durable {
+		pmsg.DeliveryMode = amqp.Persistent
+	}
+	if options.BodyOnly {
+		pmsg.Body = msg.Body
+		pmsg.Headers = make(amqp.Table, len(msg.Header))
+		for k, v := range msg.Header {
+			pmsg.Headers[k] = v
+		}
+		if v, ok := msg.Header.Get("Content-Type"); ok {
+			pmsg.ContentType = v
+		}
+	} else {
+		body, err := b.opts.Codec.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		pmsg.Body = body
+	}
+	if v, ok := msg.Header.Get("Message-Id"); ok {
+		pmsg.MessageId = v
+	}
+
+	b.pubMu.Lock()
+	confirm, err := pub.PublishWithDeferredConfirmWithContext(ctx, b.exchange.name, topic, false, false, pmsg)
+	b.pubMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if !confirm.Wait() {
+		return fmt.Errorf("amqp: message to %s not confirmed by server", topic)
+	}
+
+	return nil
+}
+
+// BatchPublish publishes messages one by one, topic is taken from Micro-Topic header
+func (b *amqpBroker) BatchPublish(ctx context.Context, msgs []*broker.Message, opts ...broker.PublishOption) error {
+	for _, msg := range msgs {
+		topic, ok := msg.Header.Get("Micro-Topic")
+		if !ok {
+			return fmt.Errorf("amqp: message without Micro-Topic header")
+		}
+		if err := b.Publish(ctx, topic, msg, opts...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subscribe declares queue for group and binds it to topic. Subscriber without group gets
+// exclusive queue removed on unsubscribe or connection loss, so messages published meanwhile are lost.
+func (b *amqpBroker) Subscribe(ctx context.Context, topic string, h broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	options := broker.NewSubscribeOptions(opts...)
+	if options.ErrorHandler == nil {
+		options.ErrorHandler = b.opts.ErrorHandler
+	}
+
+	sub := &subscriber{b: b, topic: topic, opts: options, tag: uuid.New().String(), stop: make(chan struct{}), done: make(chan struct{})}
+	deliveries, err := sub.consume()
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	go sub.run(h, deliveries)
+
+	return sub, nil
+}
+
+// consume opens channel of current connection, declares and binds queue and starts consuming
+func (s *subscriber) consume() (<-chan amqp.Delivery, error) {
+	b := s.b
+	b.mu.RLock()
+	conn := b.conn
+	b.mu.RUnlock()
+	if conn == nil {
+		return nil, broker.ErrNotConnected
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if b.prefetch > 0 {
+		if err = ch.Qos(b.prefetch, 0, false); err != nil {
+			ch.Close()
+			return nil, err
+		}
+	}
+
+	var queue amqp.Queue
+	if s.opts.Group != "" {
+		queue, err = ch.QueueDeclare(s.opts.Group+"."+s.topic, b.durable, false, false, false, nil)
+	} else {
+		queue, err = ch.QueueDeclare("", false, true, true, false, nil)
+	}
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("amqp: declare queue for %s: %w", s.topic, err)
+	}
+	if err = ch.QueueBind(queue.Name, s.topic, b.exchange.name, false, nil); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("amqp: bind queue %s: %w", queue.Name, err)
+	}
+
+	deliveries, err := ch.Consume(queue.Name, s.tag, false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.ch = ch
+	s.mu.Unlock()
+
+	select {
+	case <-s.stop:
+		// unsubscribed meanwhile, closed channel ends deliveries
+		ch.Close()
+	default:
+	}
+
+	return deliveries, nil
+}
+
+// run processes deliveries, when they stop because of closed channel or connection
+// it consumes again with backoff until unsubscribed
+func (s *subscriber) run(h broker.Handler, deliveries <-chan amqp.Delivery) {
+	defer close(s.done)
+
+	for {
+		for d := range deliveries {
+			s.b.process(s.opts, h, d)
+		}
+
+		for attempt := 0; ; attempt++ {
+			if attempt == 0 {
+				select {
+				case <-s.stop:
+					return
+				default:
+				}
+				logger.Errorf(context.Background(), "amqp: %s deliveries stopped, consuming again", s.topic)
+			}
+
+			timer := time.NewTimer(reconnectBackoff(attempt))
+			select {
+			case <-s.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			var err error
+			if deliveries, err = s.consume(); err == nil {
+				break
+			}
+			logger.Errorf(context.Background(), "amqp: consume %s: %v", s.topic, err)
+		}
+	}
+}
+
+func (b *amqpBroker) process(options broker.SubscribeOptions, h broker.Handler, d amqp.Delivery) {
+	evt := b.newEvent(options, d)
+	err := evt.err
+	if err == nil {
+		err = h(evt)
+		if err == nil && options.AutoAck {
+			evt.ack = true
+		}
+	}
+	if err != nil {
+		evt.SetError(err)
+		if options.ErrorHandler != nil {
+			if eerr := options.ErrorHandler(evt); eerr != nil {
+				logger.Errorf(evt.ctx, "amqp: error handler %s: %v", evt.topic, eerr)
+			}
+		}
+	}
+
+	if evt.ack {
+		err = d.Ack(false)
+	} else {
+		err = d.Nack(false, b.requeue)
+	}
+	if err != nil {
+		logger.Errorf(evt.ctx, "amqp: ack %s: %v", evt.topic, err)
+	}
+}
+
+func (b *amqpBroker) newEvent(options broker.SubscribeOptions, d amqp.Delivery) *event {
+	evt := &event{ctx: options.Context, topic: d.RoutingKey, msg: &broker.Message{}}
+	if evt.ctx == nil {
+		evt.ctx = context.Background()
+	}
+
+	if options.BodyOnly {
+		evt.msg.Body = d.Body
+	} else if err := b.opts.Codec.Unmarshal(d.Body, evt.msg); err != nil {
+		evt.err = err
+		evt.msg.Body = d.Body
+	}
+	if evt.msg.Header == nil {
+		evt.msg.Header = metadata.New(len(d.Headers))
+	}
+	for k, v := range d.Headers {
+		if _, ok := evt.msg.Header.Get(k); !ok {
+			evt.msg.Header.Set(k, fmt.Sprint(v))
+		}
+	}
+
+	return evt
+}
+
+func (b *amqpBroker) BatchSubscribe(ctx context.Context, topic string, h broker.BatchHandler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	return nil, errors.New("amqp: batch subscribe not supported")
+}
+
+func (b *amqpBroker) String() string {
+	return "amqp"
+}
+
+type subscriber struct {
+	b     *amqpBroker
+	topic string
+	opts  broker.SubscribeOptions
+	tag   string
+	// closed by Unsubscribe
+	stop     chan struct{}
+	stopOnce sync.Once
+	// closed when deliveries are processed after stop
+	done chan struct{}
+
+	mu sync.Mutex
+	ch *amqp.Channel
+}
+
+func (s *subscriber) Options() broker.SubscribeOptions {
+	return s.opts
+}
+
+func (s *subscriber) Topic() string {
+	return s.topic
+}
+
+// Unsubscribe stops deliveries and waits for messages already delivered to be processed
+func (s *subscriber) Unsubscribe(ctx context.Context) error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.b.mu.Lock()
+		delete(s.b.subs, s)
+		s.b.mu.Unlock()
+	})
+
+	s.mu.Lock()
+	ch := s.ch
+	s.mu.Unlock()
+
+	if err := ch.Cancel(s.tag, false); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return err
+	}
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := ch.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+type event struct {
+	ctx   context.Context
+	topic string
+	msg   *broker.Message
+	err   error
+	ack   bool
+}
+
+func (e *event) Context() context.Context {
+	return e.ctx
+}
+
+func (e *event) Topic() string {
+	return e.topic
+}
+
+func (e *event) Message() *broker.Message {
+	return e.msg
+}
+
+func (e *event) Ack() error {
+	e.ack = true
+	return nil
+}
+
+func (e *event) Error() error {
+	return e.err
+}
+
+func (e *event) SetError(err error) {
+	e.err = err
+}
@@ -0,0 +1,287 @@
+// Package nats provides micro broker on top of NATS core publish/subscribe.
+// Delivery is at most once: NATS core has no acknowledgements, so unacked messages are not redelivered.
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/logger"
+	"go.unistack.org/micro/v3/metadata"
+)
+
+type optionsKey struct{}
+
+// Options passes nats connection options to broker
+func Options(opts ...nats.Option) broker.Option {
+	return func(o *broker.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		nopts, _ := o.Context.Value(optionsKey{}).([]nats.Option)
+		o.Context = context.WithValue(o.Context, optionsKey{}, append(nopts, opts...))
+	}
+}
+
+type natsBroker struct {
+	mu   sync.RWMutex
+	opts broker.Options
+	conn *nats.Conn
+}
+
+func NewBroker(opts ...broker.Option) broker.Broker {
+	return &natsBroker{opts: broker.NewOptions(opts...)}
+}
+
+func (b *natsBroker) Name() string {
+	return b.opts.Name
+}
+
+func (b *natsBroker) Init(opts ...broker.Option) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, o := range opts {
+		o(&b.opts)
+	}
+	return nil
+}
+
+func (b *natsBroker) Options() broker.Options {
+	return b.opts
+}
+
+func (b *natsBroker) Address() string {
+	return strings.Join(b.opts.Addrs, ",")
+}
+
+func (b *natsBroker) Connect(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn != nil && !b.conn.IsClosed() {
+		return nil
+	}
+
+	var nopts []nats.Option
+	if b.opts.Context != nil {
+		nopts, _ = b.opts.Context.Value(optionsKey{}).([]nats.Option)
+	}
+	if b.opts.TLSConfig != nil {
+		nopts = append(nopts, nats.Secure(b.opts.TLSConfig))
+	}
+
+	conn, err := nats.Connect(b.Address(), nopts...)
+	if err != nil {
+		return fmt.Errorf("nats: connect %s: %w", b.Address(), err)
+	}
+	b.conn = conn
+
+	return nil
+}
+
+// Disconnect drains connection, so messages being processed by subscribers are finished
+func (b *natsBroker) Disconnect(ctx context.Context) error {
+	b.mu.Lock()
+	conn := b.conn
+	b.conn = nil
+	b.mu.Unlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil
+	}
+	if err := conn.Drain(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !conn.IsClosed() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+func (b *natsBroker) connection() (*nats.Conn, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.conn == nil {
+		return nil, broker.ErrNotConnected
+	}
+	return b.conn, nil
+}
+
+func (b *natsBroker) Publish(ctx context.Context, topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	conn, err := b.connection()
+	if err != nil {
+		return err
+	}
+	options := broker.NewPublishOptions(opts...)
+
+	nmsg := &nats.Msg{Subject: topic}
+	if options.BodyOnly {
+		nmsg.Data = msg.Body
+		nmsg.Header = make(nats.Header, len(msg.Header))
+		for k, v := range msg.Header {
+			nmsg.Header.Set(k, v)
+		}
+	} else if nmsg.Data, err = b.opts.Codec.Marshal(msg); err != nil {
+		return err
+	}
+
+	return conn.PublishMsg(nmsg)
+}
+
+// BatchPublish publishes messages one by one, topic is taken from Micro-Topic header
+func (b *natsBroker) BatchPublish(ctx context.Context, msgs []*broker.Message, opts ...broker.PublishOption) error {
+	for _, msg := range msgs {
+		topic, ok := msg.Header.Get("Micro-Topic")
+		if !ok {
+			return fmt.Errorf("nats: message without Micro-Topic header")
+		}
+		if err := b.Publish(ctx, topic, msg, opts...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *natsBroker) Subscribe(ctx context.Context, topic string, h broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	conn, err := b.connection()
+	if err != nil {
+		return nil, err
+	}
+	options := broker.NewSubscribeOptions(opts...)
+	if options.ErrorHandler == nil {
+		options.ErrorHandler = b.opts.ErrorHandler
+	}
+
+	cb := func(m *nats.Msg) {
+		b.process(options, h, m)
+	}
+
+	var sub *nats.Subscription
+	if options.Group != "" {
+		sub, err = conn.QueueSubscribe(topic, options.Group, cb)
+	} else {
+		sub, err = conn.Subscribe(topic, cb)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &subscriber{topic: topic, opts: options, sub: sub}, nil
+}
+
+func (b *natsBroker) BatchSubscribe(ctx context.Context, topic string, h broker.BatchHandler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	return nil, errors.New("nats: batch subscribe not supported")
+}
+
+func (b *natsBroker) String() string {
+	return "nats"
+}
+
+func (b *natsBroker) process(options broker.SubscribeOptions, h broker.Handler, m *nats.Msg) {
+	evt := b.newEvent(options, m)
+	err := evt.err
+	if err == nil {
+		err = h(evt)
+	}
+	if err != nil {
+		evt.SetError(err)
+		if options.ErrorHandler != nil {
+			err = options.ErrorHandler(evt)
+		}
+	}
+	if err != nil {
+		logger.Errorf(evt.ctx, "nats: message from %s lost: %v", m.Subject, err)
+	}
+}
+
+func (b *natsBroker) newEvent(options broker.SubscribeOptions, m *nats.Msg) *event {
+	evt := &event{ctx: options.Context, topic: m.Subject, msg: &broker.Message{}}
+	if evt.ctx == nil {
+		evt.ctx = context.Background()
+	}
+
+	if options.BodyOnly {
+		evt.msg.Body = m.Data
+	} else if err := b.opts.Codec.Unmarshal(m.Data, evt.msg); err != nil {
+		evt.err = err
+		evt.msg.Body = m.Data
+	}
+	if evt.msg.Header == nil {
+		evt.msg.Header = metadata.New(len(m.Header))
+	}
+	for k := range m.Header {
+		if _, ok := evt.msg.Header.Get(k); !ok {
+			evt.msg.Header.Set(k, m.Header.Get(k))
+		}
+	}
+
+	return evt
+}
+
+type subscriber struct {
+	topic string
+	opts  broker.SubscribeOptions
+	sub   *nats.Subscription
+}
+
+func (s *subscriber) Options() broker.SubscribeOptions {
+	return s.opts
+}
+
+func (s *subscriber) Topic() string {
+	return s.topic
+}
+
+func (s *subscriber) Unsubscribe(ctx context.Context) error {
+	return s.sub.Drain()
+}
+
+type event struct {
+	ctx   context.Context
+	topic string
+	msg   *broker.Message
+	err   error
+}
+
+func (e *event) Context() context.Context {
+	return e.ctx
+}
+
+func (e *event) Topic() string {
+	return e.topic
+}
+
+func (e *event) Message() *broker.Message {
+	return e.msg
+}
+
+// Ack does nothing, NATS core does not redeliver messages
+func (e *event) Ack() error {
+	return nil
+}
+
+func (e *event) Error() error {
+	return e.err
+}
+
+func (e *event) SetError(err error) {
+	e.err = err
+}
@@ -0,0 +1,83 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/metadata"
+)
+
+func TestProcess(t *testing.T) {
+	b := NewBroker().(*natsBroker)
+	options := broker.NewSubscribeOptions(broker.SubscribeBodyOnly(true))
+	m := &nats.Msg{Subject: "orders", Data: []byte(`{}`), Header: nats.Header{"Message-Id": []string{"1"}}}
+
+	var got broker.Event
+	b.process(options, func(evt broker.Event) error {
+		got = evt
+		return nil
+	}, m)
+	if got == nil || got.Topic() != "orders" || string(got.Message().Body) != `{}` {
+		t.Fatalf("unexpected event %v", got)
+	}
+	if v, _ := got.Message().Header.Get("Message-Id"); v != "1" {
+		t.Fatalf("header not mapped: %v", got.Message().Header)
+	}
+
+	var handled error
+	options.ErrorHandler = func(evt broker.Event) error {
+		handled = evt.Error()
+		return nil
+	}
+	errHandler := errors.New("handler failed")
+	b.process(options, func(evt broker.Event) error { return errHandler }, m)
+	if !errors.Is(handled, errHandler) {
+		t.Fatalf("error handler got %v", handled)
+	}
+}
+
+// TestBroker requires NATS server, e.g. NATS_ADDR=nats://127.0.0.1:4222
+func TestBroker(t *testing.T) {
+	addr := os.Getenv("NATS_ADDR")
+	if addr == "" {
+		t.Skip("NATS_ADDR not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	b := NewBroker(broker.Addrs(addr))
+	if err := b.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect(ctx)
+
+	received := make(chan *broker.Message, 1)
+	sub, err := b.Subscribe(ctx, "test.nats", func(evt broker.Event) error {
+		received <- evt.Message()
+		return evt.Ack()
+	}, broker.SubscribeGroup("test"), broker.SubscribeBodyOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe(ctx)
+
+	msg := &broker.Message{Header: metadata.New(1), Body: []byte(`{"id":1}`)}
+	msg.Header.Set("Message-Id", "1")
+	if err = b.Publish(ctx, "test.nats", msg, broker.PublishBodyOnly(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-received:
+		if string(m.Body) != `{"id":1}` {
+			t.Fatalf("unexpected body %s", m.Body)
+		}
+	case <-ctx.Done():
+		t.Fatal("message not received")
+	}
+}
@@ -0,0 +1,125 @@
+// Command dlq-replay republishes messages from error topic to their source topic.
+//
+//	dlq-replay -brokers 127.0.0.1:9092 -topic orders.errors -app orders -error timeout -dry-run
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/dlq"
+	"github.com/presnalex/go-micro/v3/service"
+)
+
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprintf("%v", map[string]string(h))
+}
+
+func (h headerFlags) Set(v string) error {
+	idx := strings.Index(v, "=")
+	if idx < 1 {
+		return fmt.Errorf("header must be in key=value form")
+	}
+	h[v[:idx]] = v[idx+1:]
+	return nil
+}
+
+func main() {
+	var (
+		configFile  = flag.String("config", "", "json file with broker config, the same as service broker section")
+		brokers     = flag.String("brokers", "", "comma separated kafka addresses, overrides config")
+		topic       = flag.String("topic", "", "error topic to replay")
+		target      = flag.String("target", "", "destination topic, by default message source topic")
+		app         = flag.String("app", "", "replay only messages with Micro-Appname")
+		errContains = flag.String("error", "", "replay only messages with Micro-Error containing substring")
+		from        = flag.String("from", "", "replay messages written at or after time, RFC3339")
+		to          = flag.String("to", "", "replay messages written before time, RFC3339")
+		replaceOld  = flag.String("replace-old", "", "replace substring in message body")
+		replaceNew  = flag.String("replace-new", "", "replacement for -replace-old")
+		dryRun      = flag.Bool("dry-run", false, "read and filter messages without publishing")
+		idle        = flag.Duration("idle", dlq.DefaultIdleTimeout, "stop if nothing fetched during this period")
+		headers     = headerFlags{}
+	)
+	flag.Var(headers, "header", "replay only messages with header key=value, can be repeated")
+	flag.Parse()
+
+	cfg := &service.BrokerConfig{}
+	if *configFile != "" {
+		buf, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			exit(err)
+		}
+		if err = json.Unmarshal(buf, cfg); err != nil {
+			exit(fmt.Errorf("parse %s: %w", *configFile, err))
+		}
+	}
+	if *brokers != "" {
+		cfg.Addr = strings.Split(*brokers, ",")
+	}
+	if len(cfg.Addr) == 0 {
+		exit(fmt.Errorf("kafka addresses required"))
+	}
+
+	filter := dlq.Filter{AppName: *app, ErrorContains: *errContains, Headers: headers}
+	var err error
+	if *from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			exit(fmt.Errorf("invalid -from: %w", err))
+		}
+	}
+	if *to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			exit(fmt.Errorf("invalid -to: %w", err))
+		}
+	}
+
+	kopts, err := service.NewKafkaClientOptions(cfg)
+	if err != nil {
+		exit(err)
+	}
+
+	opts := []dlq.Option{
+		dlq.Topic(*topic),
+		dlq.Target(*target),
+		dlq.WithFilter(filter),
+		dlq.DryRun(*dryRun),
+		dlq.IdleTimeout(*idle),
+		dlq.Progress(func(r dlq.Report) {
+			fmt.Fprintf(os.Stderr, "progress: %s\n", r)
+		}),
+	}
+	if *replaceOld != "" {
+		opts = append(opts, dlq.Rewrite(func(m *dlq.Message) error {
+			m.Body = []byte(strings.ReplaceAll(string(m.Body), *replaceOld, *replaceNew))
+			return nil
+		}))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	report, err := dlq.NewReplayer(kopts, opts...).Run(ctx)
+	if *dryRun {
+		fmt.Printf("dry run: %s\n", report)
+	} else {
+		fmt.Printf("done: %s\n", report)
+	}
+	if err != nil {
+		exit(err)
+	}
+}
+
+func exit(err error) {
+	fmt.Fprintf(os.Stderr, "dlq-replay: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,73 @@
+// Command kafka-topics creates topics declared in broker config and reports drift of existing ones.
+// In validate only mode nothing is created and it fails on missing or drifted topics, so it can run in CI.
+//
+//	kafka-topics -config broker.json -validate-only
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/service"
+)
+
+func main() {
+	var (
+		configFile   = flag.String("config", "", "json file with broker config, the same as service broker section")
+		brokers      = flag.String("brokers", "", "comma separated kafka addresses, overrides config")
+		validateOnly = flag.Bool("validate-only", false, "validate create requests on broker without creating topics, fail on missing or drifted topics")
+		timeout      = flag.Duration("timeout", 30*time.Second, "timeout of admin requests")
+	)
+	flag.Parse()
+
+	if *configFile == "" {
+		exit(fmt.Errorf("-config required"))
+	}
+	buf, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		exit(err)
+	}
+	cfg := &service.BrokerConfig{}
+	if err = json.Unmarshal(buf, cfg); err != nil {
+		exit(fmt.Errorf("parse %s: %w", *configFile, err))
+	}
+	if *brokers != "" {
+		cfg.Addr = strings.Split(*brokers, ",")
+	}
+	if len(cfg.Addr) == 0 {
+		exit(fmt.Errorf("kafka addresses required"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	report, err := service.EnsureKafkaTopics(ctx, cfg, *validateOnly)
+	if err != nil {
+		exit(err)
+	}
+	for _, topic := range report.Created {
+		fmt.Printf("created: %s\n", topic)
+	}
+	for _, topic := range report.Missing {
+		fmt.Printf("missing: %s\n", topic)
+	}
+	for _, d := range report.Drift {
+		fmt.Printf("drift: %s\n", d)
+	}
+	if *validateOnly {
+		if err = report.Err(); err != nil {
+			exit(err)
+		}
+	}
+}
+
+func exit(err error) {
+	fmt.Fprintf(os.Stderr, "kafka-topics: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,320 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// avroSchema converts json representation of go values to goavro native values and back.
+// Textual avro requires unions written as {"type": value}, which go structs don't produce,
+// so values are converted by walking the schema instead.
+type avroSchema struct {
+	root interface{}
+	// named types by full and short name, names of definitions are replaced by full names
+	named map[string]map[string]interface{}
+}
+
+func newAvroSchema(schema string) (*avroSchema, error) {
+	s := &avroSchema{named: make(map[string]map[string]interface{})}
+	if err := json.Unmarshal([]byte(schema), &s.root); err != nil {
+		return nil, err
+	}
+	s.collect(s.root, "")
+	return s, nil
+}
+
+func (s *avroSchema) collect(t interface{}, ns string) {
+	switch t := t.(type) {
+	case []interface{}:
+		for _, b := range t {
+			s.collect(b, ns)
+		}
+	case map[string]interface{}:
+		switch t["type"] {
+		case "record", "error", "enum", "fixed":
+			name, _ := t["name"].(string)
+			if v, ok := t["namespace"].(string); ok && v != "" {
+				ns = v
+			}
+			if idx := strings.LastIndex(name, "."); idx >= 0 {
+				ns = name[:idx]
+			} else if ns != "" {
+				name = ns + "." + name
+			}
+			t["name"] = name
+			s.named[name] = t
+			s.named[name[strings.LastIndex(name, ".")+1:]] = t
+			fields, _ := t["fields"].([]interface{})
+			for _, f := range fields {
+				if fm, ok := f.(map[string]interface{}); ok {
+					s.collect(fm["type"], ns)
+				}
+			}
+		case "array":
+			s.collect(t["items"], ns)
+		case "map":
+			s.collect(t["values"], ns)
+		default:
+			s.collect(t["type"], ns)
+		}
+	}
+}
+
+// native converts v decoded from json with json.Number numbers to goavro native value of type t
+func (s *avroSchema) native(t interface{}, v interface{}) (interface{}, error) {
+	switch t := t.(type) {
+	case string:
+		if def, ok := s.named[t]; ok {
+			return s.native(def, v)
+		}
+		return avroPrimitive(t, "", v)
+	case []interface{}:
+		for _, b := range t {
+			if b == "null" {
+				if v == nil {
+					return nil, nil
+				}
+				continue
+			}
+			if n, err := s.native(b, v); err == nil {
+				return goavro.Union(s.unionName(b), n), nil
+			}
+		}
+		return nil, fmt.Errorf("value %v matches no type of union", v)
+	case map[string]interface{}:
+		switch t["type"] {
+		case "record", "error":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("record %v expected to be object, not %T", t["name"], v)
+			}
+			fields, _ := t["fields"].([]interface{})
+			out := make(map[string]interface{}, len(fields))
+			for _, f := range fields {
+				fm, _ := f.(map[string]interface{})
+				name, _ := fm["name"].(string)
+				fv, ok := m[name]
+				if _, hasDefault := fm["default"]; !ok && hasDefault {
+					// goavro writes default of missing field
+					continue
+				}
+				n, err := s.native(fm["type"], fv)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", name, err)
+				}
+				out[name] = n
+			}
+			return out, nil
+		case "enum":
+			if _, ok := v.(string); !ok {
+				return nil, fmt.Errorf("enum %v expected to be string, not %T", t["name"], v)
+			}
+			return v, nil
+		case "fixed":
+			return avroPrimitive("bytes", "", v)
+		case "array":
+			items, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("array expected, not %T", v)
+			}
+			out := make([]interface{}, len(items))
+			for i, item := range items {
+				n, err := s.native(t["items"], item)
+				if err != nil {
+					return nil, fmt.Errorf("%d: %w", i, err)
+				}
+				out[i] = n
+			}
+			return out, nil
+		case "map":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("map expected, not %T", v)
+			}
+			out := make(map[string]interface{}, len(m))
+			for k, item := range m {
+				n, err := s.native(t["values"], item)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", k, err)
+				}
+				out[k] = n
+			}
+			return out, nil
+		default:
+			if typ, ok := t["type"].(string); ok {
+				logical, _ := t["logicalType"].(string)
+				if _, named := s.named[typ]; !named {
+					return avroPrimitive(typ, logical, v)
+				}
+			}
+			return s.native(t["type"], v)
+		}
+	}
+	return nil, fmt.Errorf("invalid avro type %v", t)
+}
+
+// plain converts goavro native value of type t to value marshaled to json like go value
+func (s *avroSchema) plain(t interface{}, v interface{}) (interface{}, error) {
+	switch t := t.(type) {
+	case string:
+		if def, ok := s.named[t]; ok {
+			return s.plain(def, v)
+		}
+		return v, nil
+	case []interface{}:
+		if v == nil {
+			return nil, nil
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok || len(m) != 1 {
+			return nil, fmt.Errorf("union value expected, not %T", v)
+		}
+		for _, b := range t {
+			if n, ok := m[s.unionName(b)]; ok {
+				return s.plain(b, n)
+			}
+		}
+		return nil, fmt.Errorf("union value %v matches no type of union", v)
+	case map[string]interface{}:
+		switch t["type"] {
+		case "record", "error":
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("record %v expected, not %T", t["name"], v)
+			}
+			fields, _ := t["fields"].([]interface{})
+			out := make(map[string]interface{}, len(fields))
+			for _, f := range fields {
+				fm, _ := f.(map[string]interface{})
+				name, _ := fm["name"].(string)
+				n, err := s.plain(fm["type"], m[name])
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", name, err)
+				}
+				out[name] = n
+			}
+			return out, nil
+		case "array":
+			items, _ := v.([]interface{})
+			out := make([]interface{}, len(items))
+			for i, item := range items {
+				n, err := s.plain(t["items"], item)
+				if err != nil {
+					return nil, fmt.Errorf("%d: %w", i, err)
+				}
+				out[i] = n
+			}
+			return out, nil
+		case "map":
+			m, _ := v.(map[string]interface{})
+			out := make(map[string]interface{}, len(m))
+			for k, item := range m {
+				n, err := s.plain(t["values"], item)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", k, err)
+				}
+				out[k] = n
+			}
+			return out, nil
+		case "enum", "fixed":
+			return v, nil
+		default:
+			return s.plain(t["type"], v)
+		}
+	}
+	return v, nil
+}
+
+// unionName returns name goavro uses for type of union
+func (s *avroSchema) unionName(t interface{}) string {
+	switch t := t.(type) {
+	case string:
+		if def, ok := s.named[t]; ok {
+			name, _ := def["name"].(string)
+			return name
+		}
+		return t
+	case map[string]interface{}:
+		typ, _ := t["type"].(string)
+		switch typ {
+		case "record", "error", "enum", "fixed":
+			name, _ := t["name"].(string)
+			return name
+		}
+		if logical, ok := t["logicalType"].(string); ok {
+			return typ + "." + logical
+		}
+		if typ == "" {
+			return s.unionName(t["type"])
+		}
+		return typ
+	}
+	return ""
+}
+
+// avroPrimitive converts json value to goavro native value of primitive type
+func avroPrimitive(typ string, logical string, v interface{}) (interface{}, error) {
+	switch typ {
+	case "null":
+		if v != nil {
+			return nil, fmt.Errorf("null expected, not %T", v)
+		}
+		return nil, nil
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return nil, fmt.Errorf("boolean expected, not %T", v)
+		}
+		return v, nil
+	case "string":
+		if _, ok := v.(string); !ok {
+			return nil, fmt.Errorf("string expected, not %T", v)
+		}
+		return v, nil
+	case "bytes":
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("bytes expected, not %T", v)
+		}
+		// []byte of go value is marshaled to base64
+		if b, err := base64.StdEncoding.DecodeString(str); err == nil {
+			return b, nil
+		}
+		return []byte(str), nil
+	case "int", "long":
+		if str, ok := v.(string); ok && logical != "" {
+			// time.Time of go value is marshaled to RFC 3339
+			return time.Parse(time.RFC3339Nano, str)
+		}
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("%s expected, not %T", typ, v)
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return nil, err
+		}
+		if typ == "int" {
+			return int32(i), nil
+		}
+		return i, nil
+	case "float", "double":
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("%s expected, not %T", typ, v)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, err
+		}
+		if typ == "float" {
+			return float32(f), nil
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown avro type %s", typ)
+}
@@ -0,0 +1,271 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SchemaAvro     = "AVRO"
+	SchemaProtobuf = "PROTOBUF"
+	SchemaJSON     = "JSON"
+)
+
+var (
+	DefaultTimeout = 10 * time.Second
+	// how long latest schema version of subject is cached
+	DefaultLatestTTL = time.Minute
+
+	// ErrNotFound is returned when subject or schema is not registered
+	ErrNotFound = errors.New("schema registry: not found")
+)
+
+const contentType = "application/vnd.schemaregistry.v1+json"
+
+type Schema struct {
+	ID      int    `json:"id"`
+	Subject string `json:"subject,omitempty"`
+	Version int    `json:"version,omitempty"`
+	// AVRO if empty
+	Type   string `json:"schemaType,omitempty"`
+	Schema string `json:"schema"`
+}
+
+type ClientOptions struct {
+	Username   string
+	Password   string
+	HTTPClient *http.Client
+	LatestTTL  time.Duration
+}
+
+type ClientOption func(*ClientOptions)
+
+func BasicAuth(username, password string) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.Username, opts.Password = username, password
+	}
+}
+
+func HTTPClient(c *http.Client) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.HTTPClient = c
+	}
+}
+
+func LatestTTL(td time.Duration) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.LatestTTL = td
+	}
+}
+
+// Client talks to confluent compatible schema registry, schemas are cached,
+// registered schema never changes, so only latest versions expire.
+type Client struct {
+	url     string
+	options ClientOptions
+
+	mu     sync.RWMutex
+	ids    map[int]*Schema
+	lookup map[string]int
+	latest map[string]latestSchema
+}
+
+type latestSchema struct {
+	schema  *Schema
+	expires time.Time
+}
+
+func NewClient(addr string, opts ...ClientOption) *Client {
+	options := ClientOptions{
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		LatestTTL:  DefaultLatestTTL,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &Client{
+		url:     strings.TrimSuffix(addr, "/"),
+		options: options,
+		ids:     make(map[int]*Schema),
+		lookup:  make(map[string]int),
+		latest:  make(map[string]latestSchema),
+	}
+}
+
+// SchemaByID returns schema registered with id
+func (c *Client) SchemaByID(ctx context.Context, id int) (*Schema, error) {
+	c.mu.RLock()
+	s, ok := c.ids[id]
+	c.mu.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	s = &Schema{}
+	if err := c.do(ctx, http.MethodGet, "/schemas/ids/"+strconv.Itoa(id), nil, s); err != nil {
+		return nil, err
+	}
+	s.ID = id
+	if s.Type == "" {
+		s.Type = SchemaAvro
+	}
+
+	c.mu.Lock()
+	c.ids[id] = s
+	c.mu.Unlock()
+
+	return s, nil
+}
+
+// Latest returns latest schema version registered under subject
+func (c *Client) Latest(ctx context.Context, subject string) (*Schema, error) {
+	c.mu.RLock()
+	l, ok := c.latest[subject]
+	c.mu.RUnlock()
+	if ok && time.Now().Before(l.expires) {
+		return l.schema, nil
+	}
+
+	s := &Schema{}
+	if err := c.do(ctx, http.MethodGet, "/subjects/"+url.PathEscape(subject)+"/versions/latest", nil, s); err != nil {
+		return nil, err
+	}
+	if s.Type == "" {
+		s.Type = SchemaAvro
+	}
+
+	c.mu.Lock()
+	c.latest[subject] = latestSchema{schema: s, expires: time.Now().Add(c.options.LatestTTL)}
+	c.ids[s.ID] = s
+	c.mu.Unlock()
+
+	return s, nil
+}
+
+// Lookup returns id of schema already registered under subject, ErrNotFound if it is not registered
+func (c *Client) Lookup(ctx context.Context, subject string, schemaType string, schema string) (int, error) {
+	key := subject + "\x00" + schema
+	c.mu.RLock()
+	id, ok := c.lookup[key]
+	c.mu.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	s := &Schema{}
+	if err := c.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject), request(schemaType, schema), s); err != nil {
+		return 0, err
+	}
+
+	c.cache(key, s.ID, schemaType, schema)
+	return s.ID, nil
+}
+
+// Register registers schema under subject and returns its id, registry returns
+// the same id if schema is already registered
+func (c *Client) Register(ctx context.Context, subject string, schemaType string, schema string) (int, error) {
+	var rsp struct {
+		ID int `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", request(schemaType, schema), &rsp); err != nil {
+		return 0, err
+	}
+
+	c.cache(subject+"\x00"+schema, rsp.ID, schemaType, schema)
+	return rsp.ID, nil
+}
+
+// Compatible checks schema against latest version of subject using subject compatibility level,
+// schema of subject without versions is always compatible
+func (c *Client) Compatible(ctx context.Context, subject string, schemaType string, schema string) (bool, error) {
+	var rsp struct {
+		IsCompatible bool `json:"is_compatible"`
+	}
+	err := c.do(ctx, http.MethodPost, "/compatibility/subjects/"+url.PathEscape(subject)+"/versions/latest", request(schemaType, schema), &rsp)
+	if errors.Is(err, ErrNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return rsp.IsCompatible, nil
+}
+
+func (c *Client) cache(key string, id int, schemaType string, schema string) {
+	if schemaType == "" {
+		schemaType = SchemaAvro
+	}
+	c.mu.Lock()
+	c.lookup[key] = id
+	if _, ok := c.ids[id]; !ok {
+		c.ids[id] = &Schema{ID: id, Type: schemaType, Schema: schema}
+	}
+	c.mu.Unlock()
+}
+
+func request(schemaType string, schema string) interface{} {
+	req := &Schema{Schema: schema}
+	if schemaType != SchemaAvro {
+		// avro is default and older registries do not know schemaType
+		req.Type = schemaType
+	}
+	return req
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.options.Username != "" {
+		req.SetBasicAuth(c.options.Username, c.options.Password)
+	}
+
+	rsp, err := c.options.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("schema registry: %s %s: %w", method, path, err)
+	}
+	defer rsp.Body.Close()
+
+	buf, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return fmt.Errorf("schema registry: %s %s: %w", method, path, err)
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		var rerr struct {
+			Code    int    `json:"error_code"`
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(buf, &rerr)
+		if rsp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: %s %s: %s", ErrNotFound, method, path, rerr.Message)
+		}
+		return fmt.Errorf("schema registry: %s %s: status %d, code %d: %s", method, path, rsp.StatusCode, rerr.Code, rerr.Message)
+	}
+
+	return json.Unmarshal(buf, out)
+}
@@ -0,0 +1,382 @@
+// Package registry provides codec using confluent schema registry wire format:
+// magic byte 0, 4 byte big endian schema id and avro, protobuf or json payload.
+//
+// Broker messages are not wrapped into envelope, body is sent as is and headers must be passed
+// as kafka record headers, so message body must be encoded by the codec before publishing:
+// the codec is registered in client and server for ContentType and messages are published with it.
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/linkedin/goavro/v2"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/codec"
+	"go.unistack.org/micro/v3/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const magicByte = 0
+
+// ContentType of messages in wire format, broker message without content type gets it on receive
+// if its body is in wire format
+const ContentType = "application/x-schema-registry"
+
+// AvroRecord is encoded with avro schema, value is converted to avro through its json representation,
+// optional fields are unions with null, like ["null","string"]
+type AvroRecord interface {
+	AvroSchema() string
+}
+
+// JSONRecord is encoded with json schema
+type JSONRecord interface {
+	JSONSchema() string
+}
+
+type Options struct {
+	// Subject returns subject of value, default is record name strategy:
+	// avro record full name, protobuf message full name or json schema title
+	Subject func(v interface{}) (string, error)
+	// register schema if it is not registered yet, protobuf schemas must be registered in advance
+	AutoRegister bool
+	// check compatibility with latest version before registering
+	CheckCompatibility bool
+	// context of registry requests
+	Context context.Context
+}
+
+type Option func(*Options)
+
+func Subject(fn func(v interface{}) (string, error)) Option {
+	return func(opts *Options) {
+		opts.Subject = fn
+	}
+}
+
+func AutoRegister(b bool) Option {
+	return func(opts *Options) {
+		opts.AutoRegister = b
+	}
+}
+
+func CheckCompatibility(b bool) Option {
+	return func(opts *Options) {
+		opts.CheckCompatibility = b
+	}
+}
+
+func Context(ctx context.Context) Option {
+	return func(opts *Options) {
+		opts.Context = ctx
+	}
+}
+
+type Codec struct {
+	client  *Client
+	options Options
+
+	mu   sync.RWMutex
+	avro map[int]*avroCodec
+}
+
+type avroCodec struct {
+	codec  *goavro.Codec
+	schema *avroSchema
+}
+
+var _ codec.Codec = (*Codec)(nil)
+
+func NewCodec(client *Client, opts ...Option) *Codec {
+	options := Options{
+		Subject: RecordNameSubject,
+		Context: context.Background(),
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &Codec{client: client, options: options, avro: make(map[int]*avroCodec)}
+}
+
+// Marshal encodes value to wire format, broker message body is returned as is
+func (c *Codec) Marshal(v interface{}, opts ...codec.Option) ([]byte, error) {
+	if m, ok := v.(*broker.Message); ok {
+		return m.Body, nil
+	}
+
+	ctx := c.options.Context
+	subject, err := c.options.Subject(v)
+	if err != nil {
+		return nil, err
+	}
+
+	switch m := v.(type) {
+	case proto.Message:
+		// protobuf schema text can't be produced from generated code, so latest registered version is used
+		s, err := c.client.Latest(ctx, subject)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := proto.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		return append(appendIndexes(header(s.ID), m.ProtoReflect().Descriptor()), payload...), nil
+	case AvroRecord:
+		id, err := c.schemaID(ctx, subject, SchemaAvro, m.AvroSchema())
+		if err != nil {
+			return nil, err
+		}
+		ac, err := c.avroCodec(id, m.AvroSchema())
+		if err != nil {
+			return nil, err
+		}
+		buf, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.UseNumber()
+		var value interface{}
+		if err = dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		native, err := ac.schema.native(ac.schema.root, value)
+		if err != nil {
+			return nil, fmt.Errorf("schema registry: avro %s: %w", subject, err)
+		}
+		return ac.codec.BinaryFromNative(header(id), native)
+	case JSONRecord:
+		id, err := c.schemaID(ctx, subject, SchemaJSON, m.JSONSchema())
+		if err != nil {
+			return nil, err
+		}
+		buf, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		return append(header(id), buf...), nil
+	}
+
+	return nil, fmt.Errorf("schema registry: unsupported value %T", v)
+}
+
+// Unmarshal decodes wire format using schema id from data, broker message gets data as body
+func (c *Codec) Unmarshal(d []byte, v interface{}, opts ...codec.Option) error {
+	if m, ok := v.(*broker.Message); ok {
+		m.Body = d
+		if len(d) >= 5 && d[0] == magicByte {
+			if m.Header == nil {
+				m.Header = metadata.New(1)
+			}
+			if _, ok = m.Header.Get(metadata.HeaderContentType); !ok {
+				m.Header.Set(metadata.HeaderContentType, ContentType)
+			}
+		}
+		return nil
+	}
+
+	if len(d) < 5 || d[0] != magicByte {
+		return errors.New("schema registry: invalid wire format")
+	}
+	id := int(binary.BigEndian.Uint32(d[1:5]))
+	s, err := c.client.SchemaByID(c.options.Context, id)
+	if err != nil {
+		return err
+	}
+	payload := d[5:]
+
+	switch s.Type {
+	case SchemaProtobuf:
+		m, ok := v.(proto.Message)
+		if !ok {
+			return fmt.Errorf("schema registry: schema %d is protobuf, %T is not proto message", id, v)
+		}
+		if payload, err = skipIndexes(payload); err != nil {
+			return err
+		}
+		return proto.Unmarshal(payload, m)
+	case SchemaAvro:
+		ac, err := c.avroCodec(id, s.Schema)
+		if err != nil {
+			return err
+		}
+		native, _, err := ac.codec.NativeFromBinary(payload)
+		if err != nil {
+			return fmt.Errorf("schema registry: avro schema %d: %w", id, err)
+		}
+		value, err := ac.schema.plain(ac.schema.root, native)
+		if err != nil {
+			return fmt.Errorf("schema registry: avro schema %d: %w", id, err)
+		}
+		buf, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(buf, v)
+	case SchemaJSON:
+		return json.Unmarshal(payload, v)
+	default:
+		return fmt.Errorf("schema registry: unsupported schema type %s", s.Type)
+	}
+}
+
+func (c *Codec) ReadHeader(r io.Reader, m *codec.Message, t codec.MessageType) error {
+	return nil
+}
+
+func (c *Codec) ReadBody(r io.Reader, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(buf, v)
+}
+
+func (c *Codec) Write(w io.Writer, m *codec.Message, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	buf, err := c.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func (c *Codec) String() string {
+	return "schema_registry"
+}
+
+func (c *Codec) Name() string {
+	return "schema_registry"
+}
+
+// schemaID returns id of schema, registering it if allowed
+func (c *Codec) schemaID(ctx context.Context, subject string, schemaType string, schema string) (int, error) {
+	id, err := c.client.Lookup(ctx, subject, schemaType, schema)
+	if err == nil || !errors.Is(err, ErrNotFound) || !c.options.AutoRegister {
+		return id, err
+	}
+
+	if c.options.CheckCompatibility {
+		ok, err := c.client.Compatible(ctx, subject, schemaType, schema)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, fmt.Errorf("schema registry: schema is not compatible with latest version of %s", subject)
+		}
+	}
+	return c.client.Register(ctx, subject, schemaType, schema)
+}
+
+func (c *Codec) avroCodec(id int, schema string) (*avroCodec, error) {
+	c.mu.RLock()
+	ac, ok := c.avro[id]
+	c.mu.RUnlock()
+	if ok {
+		return ac, nil
+	}
+
+	gc, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, fmt.Errorf("schema registry: avro schema %d: %w", id, err)
+	}
+	as, err := newAvroSchema(schema)
+	if err != nil {
+		return nil, fmt.Errorf("schema registry: avro schema %d: %w", id, err)
+	}
+	ac = &avroCodec{codec: gc, schema: as}
+	c.mu.Lock()
+	c.avro[id] = ac
+	c.mu.Unlock()
+
+	return ac, nil
+}
+
+// RecordNameSubject returns full name of avro record, protobuf message or json schema title
+func RecordNameSubject(v interface{}) (string, error) {
+	switch m := v.(type) {
+	case proto.Message:
+		return string(m.ProtoReflect().Descriptor().FullName()), nil
+	case AvroRecord:
+		var s struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		}
+		if err := json.Unmarshal([]byte(m.AvroSchema()), &s); err != nil || s.Name == "" {
+			return "", fmt.Errorf("schema registry: avro schema of %T has no record name", v)
+		}
+		if s.Namespace == "" {
+			return s.Name, nil
+		}
+		return s.Namespace + "." + s.Name, nil
+	case JSONRecord:
+		var s struct {
+			Title string `json:"title"`
+		}
+		if err := json.Unmarshal([]byte(m.JSONSchema()), &s); err != nil || s.Title == "" {
+			return "", fmt.Errorf("schema registry: json schema of %T has no title", v)
+		}
+		return s.Title, nil
+	}
+	return "", fmt.Errorf("schema registry: unsupported value %T", v)
+}
+
+func header(id int) []byte {
+	buf := make([]byte, 5, 64)
+	buf[0] = magicByte
+	binary.BigEndian.PutUint32(buf[1:], uint32(id))
+	return buf
+}
+
+// appendIndexes appends path of message inside proto file, first message is encoded as single 0
+func appendIndexes(buf []byte, md protoreflect.MessageDescriptor) []byte {
+	var indexes []int
+	for d := protoreflect.Descriptor(md); ; {
+		indexes = append([]int{d.Index()}, indexes...)
+		parent, ok := d.Parent().(protoreflect.MessageDescriptor)
+		if !ok {
+			break
+		}
+		d = parent
+	}
+	if len(indexes) == 1 && indexes[0] == 0 {
+		return append(buf, 0)
+	}
+
+	tmp := make([]byte, binary.MaxVarintLen64)
+	buf = append(buf, tmp[:binary.PutVarint(tmp, int64(len(indexes)))]...)
+	for _, idx := range indexes {
+		buf = append(buf, tmp[:binary.PutVarint(tmp, int64(idx))]...)
+	}
+	return buf
+}
+
+func skipIndexes(payload []byte) ([]byte, error) {
+	r := bytes.NewReader(payload)
+	n, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("schema registry: protobuf message indexes: %w", err)
+	}
+	for i := int64(0); i < n; i++ {
+		if _, err = binary.ReadVarint(r); err != nil {
+			return nil, fmt.Errorf("schema registry: protobuf message indexes: %w", err)
+		}
+	}
+	return payload[len(payload)-r.Len():], nil
+}
@@ -0,0 +1,184 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.unistack.org/micro/v3/broker"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// testRegistry implements subset of schema registry api used by client
+type testRegistry struct {
+	mu       sync.Mutex
+	schemas  []Schema
+	requests int
+	// latest version of subject is incompatible with any other schema
+	strict bool
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+
+	var in Schema
+	if req.Method == http.MethodPost {
+		if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	find := func(fn func(s Schema) bool) *Schema {
+		for i := len(r.schemas) - 1; i >= 0; i-- {
+			if fn(r.schemas[i]) {
+				return &r.schemas[i]
+			}
+		}
+		return nil
+	}
+	reply := func(s *Schema, v interface{}) {
+		if s == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code":40403,"message":"not found"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(v)
+	}
+
+	path := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case path[0] == "schemas":
+		id, _ := strconv.Atoi(path[2])
+		s := find(func(s Schema) bool { return s.ID == id })
+		reply(s, s)
+	case path[0] == "compatibility":
+		s := find(func(s Schema) bool { return s.Subject == path[2] })
+		reply(s, map[string]bool{"is_compatible": !r.strict})
+	case len(path) == 2:
+		s := find(func(s Schema) bool { return s.Subject == path[1] && s.Schema == in.Schema })
+		reply(s, s)
+	case req.Method == http.MethodGet:
+		s := find(func(s Schema) bool { return s.Subject == path[1] })
+		reply(s, s)
+	default:
+		s := find(func(s Schema) bool { return s.Subject == path[1] && s.Schema == in.Schema })
+		if s == nil {
+			r.schemas = append(r.schemas, Schema{ID: len(r.schemas) + 1, Subject: path[1], Type: in.Type, Schema: in.Schema})
+			s = &r.schemas[len(r.schemas)-1]
+		}
+		reply(s, map[string]int{"id": s.ID})
+	}
+}
+
+type order struct {
+	ID    string `json:"id"`
+	Total int64  `json:"total"`
+}
+
+func (o *order) AvroSchema() string {
+	return `{"type":"record","name":"Order","namespace":"shop","fields":[{"name":"id","type":"string"},{"name":"total","type":"long"}]}`
+}
+
+func TestCodecAvro(t *testing.T) {
+	reg := &testRegistry{}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	c := NewCodec(NewClient(srv.URL), AutoRegister(true), CheckCompatibility(true))
+
+	in := &order{ID: "1", Total: 100}
+	buf, err := c.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != 0 || buf[4] != 1 {
+		t.Fatalf("invalid wire header % x", buf[:5])
+	}
+	if len(reg.schemas) != 1 || reg.schemas[0].Subject != "shop.Order" {
+		t.Fatalf("schema not registered under record name: %v", reg.schemas)
+	}
+
+	requests := reg.requests
+	if _, err = c.Marshal(in); err != nil {
+		t.Fatal(err)
+	}
+	if reg.requests != requests {
+		t.Fatal("schema id must be cached")
+	}
+
+	// other codec reads schema by id from registry
+	out := &order{}
+	if err = NewCodec(NewClient(srv.URL)).Unmarshal(buf, out); err != nil {
+		t.Fatal(err)
+	}
+	if *out != *in {
+		t.Fatalf("decoded %v, expected %v", out, in)
+	}
+
+	msg := &broker.Message{}
+	if err = c.Unmarshal(buf, msg); err != nil || string(msg.Body) != string(buf) {
+		t.Fatal("broker message body must be kept in wire format")
+	}
+}
+
+type orderV2 struct {
+	order
+}
+
+func (o *orderV2) AvroSchema() string {
+	return `{"type":"record","name":"Order","namespace":"shop","fields":[{"name":"id","type":"int"}]}`
+}
+
+func TestCodecCompatibility(t *testing.T) {
+	reg := &testRegistry{}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	if _, err := NewCodec(NewClient(srv.URL)).Marshal(&order{ID: "1"}); err == nil {
+		t.Fatal("expected error for unregistered schema without auto registration")
+	}
+
+	c := NewCodec(NewClient(srv.URL), AutoRegister(true), CheckCompatibility(true))
+	if _, err := c.Marshal(&order{ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	reg.strict = true
+	if _, err := c.Marshal(&orderV2{}); err == nil || !strings.Contains(err.Error(), "not compatible") {
+		t.Fatalf("expected compatibility error, got %v", err)
+	}
+}
+
+func TestCodecProtobuf(t *testing.T) {
+	reg := &testRegistry{schemas: []Schema{{
+		ID:      7,
+		Subject: "google.protobuf.StringValue",
+		Type:    SchemaProtobuf,
+		Schema:  `syntax = "proto3"; package google.protobuf; message StringValue { string value = 1; }`,
+	}}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	c := NewCodec(NewClient(srv.URL))
+	buf, err := c.Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// StringValue is message 7 of wrappers.proto, indexes are zigzag encoded [7]
+	if buf[4] != 7 || buf[5] != 2 || buf[6] != 14 {
+		t.Fatalf("invalid wire header % x", buf[:7])
+	}
+
+	out := &wrapperspb.StringValue{}
+	if err = c.Unmarshal(buf, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Value != "hello" {
+		t.Fatalf("decoded %q", out.Value)
+	}
+}
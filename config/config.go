@@ -0,0 +1,534 @@
+// Package config loads typed config struct from defaults, json or yaml file, environment and command line flags.
+//
+// Precedence is defaults < file < sources < env < flags:
+//   - defaults are values already set in struct and `default:"..."` tags of zero fields
+//   - file fields are matched by json tags, yaml file is converted to json first
+//   - sources, like consul, return json documents applied in order
+//   - environment variables are named by `env:"..."` tags
+//   - flags are named by dotted json path, like -server.addr or -broker.reader.group
+//
+// Optional sections are pointers, like *service.BrokerConfig, they stay nil unless file, source, env or flag sets them.
+//
+// Values are converted by encoding.TextUnmarshaler, json.Unmarshaler (so service.Duration accepts "10s"),
+// time.Duration, scalar kinds and comma separated string slices.
+package config
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultFileFlag is flag overriding Options.File
+var DefaultFileFlag = "config"
+
+// Validator is implemented by config structs checking themselves after loading
+type Validator interface {
+	Validate() error
+}
+
+// Source provides json document applied over config file
+type Source interface {
+	Load(ctx context.Context) ([]byte, error)
+}
+
+type Options struct {
+	// json or yaml file, format is detected by extension, optional
+	File string
+	// remote sources applied after file in order
+	Sources []Source
+	// context of sources
+	Context context.Context
+	// flag overriding File, empty disables it
+	FileFlag string
+	// command line arguments without program name, os.Args[1:] by default
+	Args []string
+	// os.LookupEnv by default
+	LookupEnv func(key string) (string, bool)
+	// flag set name used in usage
+	Name string
+}
+
+type Option func(*Options)
+
+func File(path string) Option {
+	return func(opts *Options) {
+		opts.File = path
+	}
+}
+
+func Sources(sources ...Source) Option {
+	return func(opts *Options) {
+		opts.Sources = append(opts.Sources, sources...)
+	}
+}
+
+func Context(ctx context.Context) Option {
+	return func(opts *Options) {
+		opts.Context = ctx
+	}
+}
+
+func FileFlag(name string) Option {
+	return func(opts *Options) {
+		opts.FileFlag = name
+	}
+}
+
+func Args(args []string) Option {
+	return func(opts *Options) {
+		opts.Args = args
+	}
+}
+
+func LookupEnv(fn func(key string) (string, bool)) Option {
+	return func(opts *Options) {
+		opts.LookupEnv = fn
+	}
+}
+
+func Name(name string) Option {
+	return func(opts *Options) {
+		opts.Name = name
+	}
+}
+
+// Errors holds all errors found while loading config
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return "config: " + strings.Join(msgs, "; ")
+}
+
+// Load fills dst, pointer to struct, from all sources. Conversion errors of all fields, validate tags
+// and Validator errors are returned together as Errors, flag.ErrHelp is returned if help is requested.
+func Load(dst interface{}, opts ...Option) error {
+	options := Options{
+		FileFlag:  DefaultFileFlag,
+		Args:      os.Args[1:],
+		LookupEnv: os.LookupEnv,
+		Name:      filepath.Base(os.Args[0]),
+		Context:   context.Background(),
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config: destination must be pointer to struct, not %T", dst)
+	}
+
+	var errs Errors
+
+	root := rv.Elem()
+	fields := walk(root.Type(), "", nil, nil, nil)
+	for _, f := range fields {
+		if f.def == "" {
+			continue
+		}
+		// defaults are not applied to fields of nil sections
+		if v, ok := fieldValue(root, f.index, false); ok && v.IsZero() {
+			if err := set(v, f.def); err != nil {
+				errs = append(errs, fmt.Errorf("default of %s: %w", f.path, err))
+			}
+		}
+	}
+
+	// flags are parsed before file to get file path, but applied last
+	fs := flag.NewFlagSet(options.Name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	file := options.File
+	if options.FileFlag != "" {
+		fs.StringVar(&file, options.FileFlag, options.File, "json or yaml config file")
+	}
+	values := make([]*flagValue, 0, len(fields))
+	for _, f := range fields {
+		if f.path == options.FileFlag {
+			continue
+		}
+		fv := &flagValue{field: f}
+		fs.Var(fv, f.path, f.usage())
+		values = append(values, fv)
+	}
+	for args := options.Args; ; {
+		err := fs.Parse(args)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, flag.ErrHelp) {
+			fs.SetOutput(os.Stderr)
+			fs.PrintDefaults()
+			return err
+		}
+		errs = append(errs, err)
+		// parsing stops on bad flag, the rest of arguments is parsed again
+		if len(fs.Args()) >= len(args) {
+			break
+		}
+		args = fs.Args()
+	}
+
+	if file != "" {
+		if err := loadFile(file, dst); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+
+	for _, src := range options.Sources {
+		buf, err := src.Load(options.Context)
+		if err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+		if err = json.Unmarshal(buf, dst); err != nil {
+			return fmt.Errorf("config: parse source: %w", err)
+		}
+	}
+
+	for _, f := range fields {
+		if f.env == "" {
+			continue
+		}
+		v, ok := options.LookupEnv(f.env)
+		if !ok {
+			continue
+		}
+		if err := apply(root, f, v); err != nil {
+			errs = append(errs, fmt.Errorf("env %s: %w", f.env, err))
+		}
+	}
+
+	for _, fv := range values {
+		if !fv.set {
+			continue
+		}
+		if err := apply(root, fv.field, fv.raw); err != nil {
+			errs = append(errs, fmt.Errorf("flag -%s: %w", fv.field.path, err))
+		}
+	}
+
+	if err := Validate(dst); err != nil {
+		var verrs Errors
+		if errors.As(err, &verrs) {
+			errs = append(errs, verrs...)
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func loadFile(path string, dst interface{}) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var v interface{}
+		if err = yaml.Unmarshal(buf, &v); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+		if v == nil {
+			return nil
+		}
+		// yaml is converted to json, so json tags and unmarshalers are used for both formats
+		if buf, err = json.Marshal(jsonValue(v)); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+
+	if err = json.Unmarshal(buf, dst); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// MergeMap deep merges src into dst, objects are merged and other values replaced,
+// it is used by sources combining several json documents
+func MergeMap(dst map[string]interface{}, src map[string]interface{}) {
+	for k, v := range src {
+		sm, ok := v.(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		dm, ok := dst[k].(map[string]interface{})
+		if !ok {
+			dm = make(map[string]interface{})
+			dst[k] = dm
+		}
+		MergeMap(dm, sm)
+	}
+}
+
+// jsonValue converts yaml maps with interface keys to json objects
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprint(k)] = jsonValue(v)
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = jsonValue(t[i])
+		}
+	}
+	return v
+}
+
+type field struct {
+	// dotted json path, used as flag name
+	path string
+	env  string
+	def  string
+	typ  reflect.Type
+	// indexes of struct fields from root
+	index []int
+}
+
+func (f field) usage() string {
+	if f.env != "" {
+		return "env " + f.env
+	}
+	return ""
+}
+
+// walk collects leaf fields of struct type t, fields of pointer sections are collected too,
+// so env and flags set them even if section is nil before file is loaded
+func walk(t reflect.Type, prefix string, index []int, seen []reflect.Type, fields []field) []field {
+	for _, st := range seen {
+		if st == t {
+			// recursive type
+			return fields
+		}
+	}
+	seen = append(seen, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		// embedded struct without json name is flattened as by encoding/json
+		flatten := sf.Anonymous && name == ""
+		if name == "" {
+			name = sf.Name
+		}
+		fidx := append(append([]int(nil), index...), i)
+
+		if !leafType(sf.Type) {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if flatten {
+					fields = walk(ft, prefix, fidx, seen, fields)
+				} else {
+					fields = walk(ft, prefix+name+".", fidx, seen, fields)
+				}
+			}
+			continue
+		}
+
+		fields = append(fields, field{
+			path:  prefix + name,
+			env:   sf.Tag.Get("env"),
+			def:   sf.Tag.Get("default"),
+			typ:   sf.Type,
+			index: fidx,
+		})
+	}
+	return fields
+}
+
+// fieldValue returns field of root by indexes, nil pointer sections on the way are allocated if alloc is set
+func fieldValue(root reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	v := root
+	for _, i := range index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v, true
+}
+
+// apply sets field of root to s, its section is allocated only if s is valid
+func apply(root reflect.Value, f field, s string) error {
+	tmp := reflect.New(f.typ).Elem()
+	if v, ok := fieldValue(root, f.index, false); ok {
+		tmp.Set(v)
+	}
+	if err := set(tmp, s); err != nil {
+		return err
+	}
+	v, _ := fieldValue(root, f.index, true)
+	v.Set(tmp)
+	return nil
+}
+
+var (
+	textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	jsonUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	durationType    = reflect.TypeOf(time.Duration(0))
+)
+
+// leaf reports whether v is set from single string, pointer to leaf is leaf too,
+// so optional values like *int keep nil when they are not set
+func leaf(v reflect.Value) bool {
+	return leafType(v.Type())
+}
+
+func leafType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr && scalarType(t.Elem()) {
+		return true
+	}
+	return scalarType(t)
+}
+
+func scalarType(t reflect.Type) bool {
+	pt := reflect.PtrTo(t)
+	if pt.Implements(textUnmarshaler) || pt.Implements(jsonUnmarshaler) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+// set converts s to value type
+func set(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Ptr && scalarType(v.Type().Elem()) {
+		nv := reflect.New(v.Type().Elem())
+		if err := set(nv.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(nv)
+		return nil
+	}
+	pt := reflect.PtrTo(v.Type())
+	switch {
+	case pt.Implements(textUnmarshaler):
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	case pt.Implements(jsonUnmarshaler):
+		buf := []byte(s)
+		if !json.Valid(buf) {
+			// plain strings, like durations, are passed as json strings
+			buf, _ = json.Marshal(s)
+		}
+		return v.Addr().Interface().(json.Unmarshaler).UnmarshalJSON(buf)
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		parts := strings.Split(s, ",")
+		sl := reflect.MakeSlice(v.Type(), 0, len(parts))
+		for _, p := range parts {
+			if p = strings.TrimSpace(p); p != "" {
+				sl = reflect.Append(sl, reflect.ValueOf(p).Convert(v.Type().Elem()))
+			}
+		}
+		v.Set(sl)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// flagValue keeps raw flag value, it is converted after file and env are loaded
+type flagValue struct {
+	field field
+	raw   string
+	set   bool
+}
+
+func (f *flagValue) String() string {
+	return ""
+}
+
+func (f *flagValue) Set(s string) error {
+	f.raw, f.set = s, true
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	t := f.field.typ
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Bool
+}
@@ -0,0 +1,226 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/service"
+)
+
+type testConfig struct {
+	Server  service.ServerConfig  `json:"server" validate:"required"`
+	Metric  service.MetricConfig  `json:"metric"`
+	Timeout service.Duration      `json:"timeout" env:"TIMEOUT"`
+	Retries int                   `json:"retries" env:"RETRIES" default:"3"`
+	Wait    time.Duration         `json:"-"`
+	Topics  []string              `json:"topics" env:"TOPICS"`
+	Broker  *service.BrokerConfig `json:"broker"`
+}
+
+func (c *testConfig) Validate() error {
+	if c.Server.Name == "" {
+		return errors.New("server.name required")
+	}
+	return nil
+}
+
+func env(vars map[string]string) Option {
+	return LookupEnv(func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	})
+}
+
+func writeFile(t *testing.T, name string, data string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+server:
+  name: orders
+  addr: ":8080"
+  version: "1.0"
+timeout: 5s
+retries: 5
+broker:
+  type: kafka
+  addr: ["127.0.0.1:9092"]
+  reader:
+    group: file
+`)
+
+	// broker section is nil until file is loaded
+	cfg := &testConfig{}
+	cfg.Server.ID = "default"
+	err := Load(cfg,
+		Args([]string{"-config", path, "-server.addr", ":9090", "-broker.reader.group", "flag", "-broker.writer.required_acks", "0"}),
+		env(map[string]string{"SERVER_ADDRESS": ":8081", "SERVER_VERSION": "2.0", "TIMEOUT": "1m", "TOPICS": "a, b"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch {
+	case cfg.Server.ID != "default":
+		t.Fatalf("default overwritten: %q", cfg.Server.ID)
+	case cfg.Server.Name != "orders" || cfg.Retries != 5:
+		t.Fatalf("file values not loaded: %+v", cfg)
+	case cfg.Server.Version != "2.0" || cfg.Timeout.Duration != time.Minute:
+		t.Fatalf("env must override file: %+v", cfg)
+	case cfg.Server.Addr != ":9090" || cfg.Broker.Reader.Group != "flag":
+		t.Fatalf("flags must override env and file: %+v %+v", cfg.Server, cfg.Broker.Reader)
+	case len(cfg.Topics) != 2 || cfg.Topics[1] != "b":
+		t.Fatalf("topics %v", cfg.Topics)
+	case cfg.Broker.Writer.RequiredAcks == nil || *cfg.Broker.Writer.RequiredAcks != 0:
+		t.Fatalf("pointer value not set by flag: %v", cfg.Broker.Writer.RequiredAcks)
+	}
+
+	cfg = &testConfig{}
+	if err = Load(cfg, Args([]string{"-server.name", "orders", "-server.addr", ":8080"}), env(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Retries != 3 {
+		t.Fatalf("default tag not applied: %d", cfg.Retries)
+	}
+	if cfg.Broker != nil {
+		t.Fatalf("nil section allocated: %+v", cfg.Broker)
+	}
+
+	// flag allocates nil section
+	cfg = &testConfig{}
+	err = Load(cfg, Args([]string{"-server.name", "orders", "-server.addr", ":8080", "-broker.type", "memory"}), env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Broker == nil || cfg.Broker.Type != "memory" {
+		t.Fatalf("flag of nil section not applied: %+v", cfg.Broker)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	path := writeFile(t, "config.json", `{"retries": 1}`)
+
+	cfg := &testConfig{}
+	err := Load(cfg,
+		File(path),
+		Args([]string{"-retries", "many", "-unknown", "-broker.workers", "many", "-server.name"}),
+		env(map[string]string{"TIMEOUT": "soon"}),
+	)
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 8 {
+		t.Fatalf("expected 8 errors, got %v", err)
+	}
+	for _, s := range []string{
+		"env TIMEOUT", "flag -retries", "flag -broker.workers", "-unknown", "flag needs an argument: -server.name",
+		"server.name required", "server.name: required", "server.addr: required",
+	} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("error %q does not mention %s", err, s)
+		}
+	}
+	if cfg.Broker != nil {
+		t.Fatalf("section allocated by invalid flag: %+v", cfg.Broker)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := &testConfig{
+		Server: service.ServerConfig{Name: "orders", Addr: "localhost"},
+		Metric: service.MetricConfig{Addr: ":9100"},
+		Broker: &service.BrokerConfig{Type: "kafak", Workers: -1},
+	}
+	cfg.Broker.Writer.Compression = []string{"zstd", "brotli"}
+
+	err := Validate(cfg)
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 4 {
+		t.Fatalf("expected 4 errors, got %v", err)
+	}
+	for _, s := range []string{"server.addr", "broker.type", "broker.workers", "broker.writer.compression"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("error %q does not mention %s", err, s)
+		}
+	}
+
+	cfg.Server.Addr = ":8080"
+	cfg.Broker = &service.BrokerConfig{Type: "kafka", Addr: []string{"127.0.0.1:9092"}}
+	if err = Validate(cfg); err != nil {
+		t.Fatal(err)
+	}
+	acks := 2
+	cfg.Broker.Writer.RequiredAcks = &acks
+	if err = Validate(cfg); err == nil || !strings.Contains(err.Error(), "broker.writer.required_acks") {
+		t.Fatalf("expected required_acks error, got %v", err)
+	}
+	// consumers of oneof values compare them as is
+	cfg.Broker = &service.BrokerConfig{Type: "kafka", Addr: []string{"127.0.0.1:9092"}}
+	cfg.Broker.Reader.Ordering = "Key"
+	if err = Validate(cfg); err == nil || !strings.Contains(err.Error(), "broker.reader.ordering") {
+		t.Fatalf("expected ordering error, got %v", err)
+	}
+
+	// zero sections are skipped unless required
+	sections := &struct {
+		Postgres service.PostgresConfig `json:"postgres"`
+		Vault    service.VaultConfig    `json:"vault"`
+		Oracle   *service.OracleConfig  `json:"oracle"`
+		Consul   *service.ConsulConfig  `json:"consul" validate:"required"`
+	}{}
+	if err = Validate(sections); !errors.As(err, &errs) || len(errs) != 1 || !strings.Contains(err.Error(), "consul: required") {
+		t.Fatalf("expected required consul, got %v", err)
+	}
+
+	sections.Postgres = service.PostgresConfig{Addr: "127.0.0.1:5432"}
+	if err = Validate(sections); !errors.As(err, &errs) || len(errs) != 3 || !strings.Contains(err.Error(), "postgres.login") ||
+		!strings.Contains(err.Error(), "postgres.dbname") {
+		t.Fatalf("expected postgres login and dbname errors and required consul, got %v", err)
+	}
+
+	sections.Postgres = service.PostgresConfig{Addr: "127.0.0.1:5432", Login: "shop", DBName: "shop"}
+	for addr, valid := range map[string]bool{"127.0.0.1:8500": true, "http://consul:8500": true, "consul": false, "http://": false} {
+		sections.Consul = &service.ConsulConfig{Addr: addr}
+		if err = Validate(sections); (err == nil) != valid {
+			t.Fatalf("consul addr %q: %v", addr, err)
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := &struct {
+		Postgres service.PostgresConfig `json:"postgres"`
+		Vault    service.VaultConfig    `json:"vault"`
+		Broker   service.BrokerConfig   `json:"broker"`
+		APIKey   string                 `json:"api_key" redact:"true"`
+	}{APIKey: "key"}
+	cfg.Postgres.Login, cfg.Postgres.Passw = "orders", "secret"
+	cfg.Vault.RoleId, cfg.Vault.SecretId = "role", "secret"
+	cfg.Broker.SASL.Token = "secret"
+
+	buf, err := Redacted(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(buf), `"secret"`) || strings.Contains(string(buf), `"key"`) || !strings.Contains(string(buf), `"login":"orders"`) {
+		t.Fatalf("unexpected dump %s", buf)
+	}
+	// empty secrets are left empty to see they are not set
+	if !strings.Contains(string(buf), `"password":""`) {
+		t.Fatalf("empty password masked in %s", buf)
+	}
+}
@@ -0,0 +1,364 @@
+// Package consul provides config source reading consul KV trees of namespace and application.
+//
+// Keys of tree are mapped to json paths relative to tree root, so key config/orders/server/addr
+// becomes {"server":{"addr":...}}. Values holding valid json are decoded, others are used as strings,
+// value of tree root itself must be json object. Application tree is merged over namespace tree,
+// if it is nested in namespace tree its keys are read only as application keys.
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/config"
+	"github.com/presnalex/go-micro/v3/service"
+	"go.unistack.org/micro/v3/logger"
+)
+
+var (
+	// how long consul holds blocking query without changes
+	DefaultWatchWait = 5 * time.Minute
+	// added to watch wait to get http timeout of blocking query, consul adds up to wait/16 of jitter
+	DefaultWatchTimeout = 30 * time.Second
+	// delay before retrying failed query, doubled up to watch wait
+	DefaultRetryDelay = time.Second
+)
+
+var _ config.Source = (*Source)(nil)
+
+type Options struct {
+	HTTPClient *http.Client
+}
+
+type Option func(*Options)
+
+func HTTPClient(c *http.Client) Option {
+	return func(opts *Options) {
+		opts.HTTPClient = c
+	}
+}
+
+// Source loads config from consul and notifies subscribers when it changes
+type Source struct {
+	addr    string
+	token   string
+	wait    time.Duration
+	timeout time.Duration
+	client  *http.Client
+	trees   []*tree
+
+	mu   sync.Mutex
+	data []byte
+	subs map[int]func([]byte)
+	next int
+}
+
+// tree is single KV prefix with consul index of its last read
+type tree struct {
+	path string
+	// nested trees read separately, like application tree inside namespace tree
+	exclude []string
+	index   uint64
+	value   map[string]interface{}
+}
+
+func NewSource(cfg *service.ConsulConfig, opts ...Option) (*Source, error) {
+	options := Options{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("consul: addr required")
+	}
+	if cfg.NamespacePath == "" && cfg.AppPath == "" {
+		return nil, fmt.Errorf("consul: path or config_path required")
+	}
+
+	wait, timeout := DefaultWatchWait, DefaultWatchTimeout
+	var err error
+	if cfg.WatchWait != "" {
+		if wait, err = time.ParseDuration(cfg.WatchWait); err != nil || wait <= 0 {
+			return nil, fmt.Errorf("consul: invalid watch_wait %q", cfg.WatchWait)
+		}
+	}
+	if cfg.WatchTimeout != "" {
+		if timeout, err = time.ParseDuration(cfg.WatchTimeout); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("consul: invalid watch_timeout %q", cfg.WatchTimeout)
+		}
+	}
+
+	addr := strings.TrimSuffix(cfg.Addr, "/")
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	s := &Source{
+		addr:    addr,
+		token:   cfg.Token,
+		wait:    wait,
+		timeout: timeout,
+		client:  options.HTTPClient,
+		subs:    make(map[int]func([]byte)),
+	}
+	if s.client == nil {
+		s.client = &http.Client{}
+	}
+	// namespace settings are shared by services, application settings override them
+	for _, path := range []string{cfg.NamespacePath, cfg.AppPath} {
+		if path = strings.Trim(path, "/"); path != "" {
+			s.trees = append(s.trees, &tree{path: path})
+		}
+	}
+	for _, t := range s.trees {
+		for _, o := range s.trees {
+			if strings.HasPrefix(o.path, t.path+"/") {
+				t.exclude = append(t.exclude, o.path+"/")
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// Load reads all trees and returns merged json document
+func (s *Source) Load(ctx context.Context) ([]byte, error) {
+	for _, t := range s.trees {
+		value, index, err := s.get(ctx, t, 0)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		t.value, t.index = value, index
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := s.merge()
+	if err != nil {
+		return nil, err
+	}
+	s.data = data
+	return data, nil
+}
+
+// Subscribe registers fn called with merged document after each change, returned func unsubscribes
+func (s *Source) Subscribe(fn func(data []byte)) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.next
+	s.next++
+	s.subs[id] = fn
+	return func() {
+		s.mu.Lock()
+		delete(s.subs, id)
+		s.mu.Unlock()
+	}
+}
+
+// Watch watches all trees with blocking queries until ctx is done, Load must be called first
+func (s *Source) Watch(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, t := range s.trees {
+		wg.Add(1)
+		go func(t *tree) {
+			defer wg.Done()
+			s.watch(ctx, t)
+		}(t)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (s *Source) watch(ctx context.Context, t *tree) {
+	delay := DefaultRetryDelay
+	for {
+		s.mu.Lock()
+		index := t.index
+		s.mu.Unlock()
+
+		value, next, err := s.get(ctx, t, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Errorf(ctx, "consul: watch %s: %v", t.path, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > s.wait {
+				delay = s.wait
+			}
+			continue
+		}
+		delay = DefaultRetryDelay
+
+		if next < index {
+			// index went backwards, e.g. after consul snapshot restore, start over
+			next = 0
+		}
+		if next == index {
+			// wait expired without changes
+			continue
+		}
+		s.update(t, value, next)
+	}
+}
+
+// update stores tree value and notifies subscribers if merged document changed
+func (s *Source) update(t *tree, value map[string]interface{}, index uint64) {
+	s.mu.Lock()
+	t.value, t.index = value, index
+	data, err := s.merge()
+	if err != nil || bytes.Equal(data, s.data) {
+		s.mu.Unlock()
+		return
+	}
+	s.data = data
+	subs := make([]func([]byte), 0, len(s.subs))
+	for _, fn := range s.subs {
+		subs = append(subs, fn)
+	}
+	s.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(data)
+	}
+}
+
+func (s *Source) merge() ([]byte, error) {
+	merged := make(map[string]interface{})
+	for _, t := range s.trees {
+		config.MergeMap(merged, t.value)
+	}
+	// encoding/json sorts map keys, so equal documents have equal bytes
+	return json.Marshal(merged)
+}
+
+type kv struct {
+	Key   string `json:"Key"`
+	Value []byte `json:"Value"`
+}
+
+// get reads tree, index > 0 makes blocking query returning when index changes or wait expires
+func (s *Source) get(ctx context.Context, t *tree, index uint64) (map[string]interface{}, uint64, error) {
+	path := t.path
+	q := url.Values{"recurse": {""}}
+	timeout := s.timeout
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", strconv.FormatInt(int64(s.wait/time.Millisecond), 10)+"ms")
+		timeout += s.wait
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.addr+"/v1/kv/"+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul: get %s: %w", path, err)
+	}
+	defer rsp.Body.Close()
+
+	buf, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul: get %s: %w", path, err)
+	}
+	next, _ := strconv.ParseUint(rsp.Header.Get("X-Consul-Index"), 10, 64)
+
+	switch rsp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// tree is not created yet
+		return map[string]interface{}{}, next, nil
+	default:
+		return nil, 0, fmt.Errorf("consul: get %s: status %d: %s", path, rsp.StatusCode, strings.TrimSpace(string(buf)))
+	}
+
+	var kvs []kv
+	if err = json.Unmarshal(buf, &kvs); err != nil {
+		return nil, 0, fmt.Errorf("consul: get %s: %w", path, err)
+	}
+	value, err := treeValue(t, kvs)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, next, nil
+}
+
+// treeValue converts keys of tree to nested object
+func treeValue(t *tree, kvs []kv) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+kvs:
+	for _, p := range kvs {
+		if p.Value == nil || strings.HasSuffix(p.Key, "/") {
+			// folder
+			continue
+		}
+		if p.Key != t.path && !strings.HasPrefix(p.Key, t.path+"/") {
+			// recurse matches sibling prefixes too, like config/shopping for config/shop
+			continue
+		}
+		for _, prefix := range t.exclude {
+			if strings.HasPrefix(p.Key, prefix) {
+				continue kvs
+			}
+		}
+		var v interface{} = string(p.Value)
+		if json.Valid(p.Value) {
+			if err := json.Unmarshal(p.Value, &v); err != nil {
+				return nil, fmt.Errorf("consul: key %s: %w", p.Key, err)
+			}
+		}
+
+		rel := strings.Trim(strings.TrimPrefix(p.Key, t.path), "/")
+		if rel == "" {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("consul: key %s: root value must be json object", p.Key)
+			}
+			config.MergeMap(root, m)
+			continue
+		}
+
+		node := root
+		parts := strings.Split(rel, "/")
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				node[part] = child
+			}
+			node = child
+		}
+		last := parts[len(parts)-1]
+		if m, ok := v.(map[string]interface{}); ok {
+			if child, ok := node[last].(map[string]interface{}); ok {
+				config.MergeMap(child, m)
+				continue
+			}
+		}
+		node[last] = v
+	}
+	return root, nil
+}
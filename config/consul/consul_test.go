@@ -0,0 +1,169 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/config"
+	"github.com/presnalex/go-micro/v3/service"
+)
+
+// testConsul implements recursive KV reads with blocking queries
+type testConsul struct {
+	mu      sync.Mutex
+	kv      map[string]string
+	index   uint64
+	changed chan struct{}
+	token   string
+}
+
+func newTestConsul(kv map[string]string) *testConsul {
+	return &testConsul{kv: kv, index: 1, changed: make(chan struct{})}
+}
+
+func (c *testConsul) put(key string, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kv[key] = value
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *testConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Consul-Token") != c.token {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+
+	c.mu.Lock()
+	if index > 0 && index >= c.index {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+		}
+		c.mu.Lock()
+	}
+	type kv struct {
+		Key   string
+		Value []byte
+	}
+	var kvs []kv
+	for k, v := range c.kv {
+		if strings.HasPrefix(k, prefix) {
+			kvs = append(kvs, kv{Key: k, Value: []byte(v)})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	c.mu.Unlock()
+
+	if len(kvs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(kvs)
+}
+
+type testConfig struct {
+	Server  service.ServerConfig `json:"server"`
+	Timeout service.Duration     `json:"timeout"`
+	Limit   int                  `json:"limit"`
+}
+
+func TestSource(t *testing.T) {
+	c := newTestConsul(map[string]string{
+		"config/shop":               `{"timeout": "5s", "limit": 10}`,
+		"config/shop/server/addr":   ":8080",
+		"config/shop/orders/":       "",
+		"config/shop/orders/limit":  "20",
+		"config/shop/orders/server": `{"name": "orders"}`,
+		// sibling of app tree, matched by recurse prefix
+		"config/shop/orderstimeout": "1s",
+	})
+	c.token = "secret"
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	s, err := NewSource(&service.ConsulConfig{
+		Addr:          strings.TrimPrefix(srv.URL, "http://"),
+		Token:         "secret",
+		NamespacePath: "config/shop",
+		AppPath:       "config/shop/orders",
+		WatchWait:     "100ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &testConfig{}
+	if err = config.Load(cfg, config.Sources(s), config.Args(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Addr != ":8080" || cfg.Server.Name != "orders" || cfg.Limit != 20 || cfg.Timeout.Duration != 5*time.Second {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	updates := make(chan []byte, 10)
+	unsubscribe := s.Subscribe(func(data []byte) { updates <- data })
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Watch(ctx) }()
+
+	c.put("config/shop/orders/limit", "30")
+	select {
+	case data := <-updates:
+		cfg = &testConfig{}
+		if err = json.Unmarshal(data, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Limit != 30 || cfg.Server.Addr != ":8080" || strings.Contains(string(data), `"orders":`) {
+			t.Fatalf("unexpected update %s", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("change not delivered")
+	}
+
+	// index changes without changing merged document are not delivered
+	c.put("config/shop/orders/limit", "30")
+	select {
+	case data := <-updates:
+		t.Fatalf("unexpected update %s", data)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch not stopped")
+	}
+}
+
+func TestNewSource(t *testing.T) {
+	for _, cfg := range []*service.ConsulConfig{
+		{NamespacePath: "config"},
+		{Addr: "127.0.0.1:8500"},
+		{Addr: "127.0.0.1:8500", AppPath: "config/app", WatchWait: "soon"},
+	} {
+		if _, err := NewSource(cfg); err == nil {
+			t.Fatalf("expected error for %+v", cfg)
+		}
+	}
+}
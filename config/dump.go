@@ -0,0 +1,113 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"go.unistack.org/micro/v3/logger"
+)
+
+var (
+	// DefaultRedacted is names of struct fields masked by Redacted, compared case insensitive
+	DefaultRedacted = []string{"Passw", "Password", "Token", "SecretId"}
+	// DefaultRedactedValue replaces non empty secrets
+	DefaultRedactedValue = "***"
+)
+
+// Redacted returns json of v with values of DefaultRedacted fields masked,
+// fields may also be masked by `redact:"true"` tag
+func Redacted(v interface{}) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err = json.Unmarshal(buf, &doc); err != nil {
+		return nil, err
+	}
+	redact(reflect.ValueOf(v), doc)
+	return json.Marshal(doc)
+}
+
+// Log writes redacted config to logger, it is called at startup to see actual config of instance
+func Log(ctx context.Context, v interface{}) {
+	buf, err := Redacted(v)
+	if err != nil {
+		logger.Errorf(ctx, "config: dump: %v", err)
+		return
+	}
+	logger.Infof(ctx, "config: %s", buf)
+}
+
+// redact masks secrets in doc, json representation of v
+func redact(v reflect.Value, doc interface{}) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return
+		}
+		redactStruct(v, obj)
+	case reflect.Slice, reflect.Array:
+		arr, ok := doc.([]interface{})
+		if !ok {
+			return
+		}
+		for i := 0; i < v.Len() && i < len(arr); i++ {
+			redact(v.Index(i), arr[i])
+		}
+	}
+}
+
+func redactStruct(v reflect.Value, obj map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			redactStruct(v.Field(i), obj)
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		value, ok := obj[name]
+		if !ok {
+			continue
+		}
+		if !redacted(sf) {
+			redact(v.Field(i), value)
+			continue
+		}
+		if !v.Field(i).IsZero() {
+			obj[name] = DefaultRedactedValue
+		}
+	}
+}
+
+func redacted(sf reflect.StructField) bool {
+	if sf.Tag.Get("redact") == "true" {
+		return true
+	}
+	for _, name := range DefaultRedacted {
+		if strings.EqualFold(sf.Name, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package reload
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/presnalex/go-micro/v3/service"
+	"go.unistack.org/micro/v3/client"
+	"go.unistack.org/micro/v3/logger"
+)
+
+// LogLevel sets level of logger.DefaultLogger, level returns LoggerConfig.LogLevel of config
+func LogLevel(level func(cfg interface{}) string) Hook {
+	return Hook{
+		Name: "logger",
+		Validate: func(next interface{}) error {
+			switch strings.ToLower(level(next)) {
+			case "", "trace", "debug", "info", "warn", "error", "fatal":
+				return nil
+			}
+			return fmt.Errorf("unknown log level %q", level(next))
+		},
+		Apply: func(next interface{}) error {
+			logger.DefaultLogger.Level(logger.ParseLevel(level(next)))
+			return nil
+		},
+	}
+}
+
+// Client applies retries, timeouts and pool options of ClientConfig to c
+func Client(c client.Client, ccfg func(cfg interface{}) *service.ClientConfig) Hook {
+	return Hook{
+		Name: "client",
+		Validate: func(next interface{}) error {
+			cfg := ccfg(next)
+			if cfg.ClientRetries < 0 || cfg.ClientRequestTimeout < 0 || cfg.ClientPoolSize < 0 ||
+				cfg.ClientDialTimeout < 0 || cfg.ClientPoolTTL < 0 {
+				return fmt.Errorf("negative client settings %+v", *cfg)
+			}
+			return nil
+		},
+		Apply: func(next interface{}) error {
+			return c.Init(service.ClientTuningOptions(ccfg(next))...)
+		},
+	}
+}
+
+// PostgresPool applies pool sizes and connection lifetimes of PostgresConfig to db from postgres.Connect
+func PostgresPool(db *sqlx.DB, pcfg func(cfg interface{}) *service.PostgresConfig) Hook {
+	return poolHook("postgres", db, func(cfg interface{}) [4]int {
+		c := pcfg(cfg)
+		return [4]int{c.ConnMax, c.ConnMaxIdle, c.ConnLifetime, c.ConnMaxIdleTime}
+	})
+}
+
+// OraclePool applies pool sizes and connection lifetimes of OracleConfig to db from oracle.Connect
+func OraclePool(db *sqlx.DB, ocfg func(cfg interface{}) *service.OracleConfig) Hook {
+	return poolHook("oracle", db, func(cfg interface{}) [4]int {
+		c := ocfg(cfg)
+		return [4]int{c.ConnMax, c.ConnMaxIdle, c.ConnLifetime, c.ConnMaxIdleTime}
+	})
+}
+
+// poolHook sets max open, max idle, lifetime and idle time seconds, zero values keep current settings
+// like postgres.Connect and oracle.Connect leave database/sql defaults
+func poolHook(name string, db *sqlx.DB, pool func(cfg interface{}) [4]int) Hook {
+	return Hook{
+		Name: name,
+		Validate: func(next interface{}) error {
+			p := pool(next)
+			for _, v := range p {
+				if v < 0 {
+					return fmt.Errorf("negative pool settings %v", p)
+				}
+			}
+			return nil
+		},
+		Apply: func(next interface{}) error {
+			p := pool(next)
+			if p[0] > 0 {
+				db.SetMaxOpenConns(p[0])
+			}
+			if p[1] > 0 {
+				db.SetMaxIdleConns(p[1])
+			}
+			if p[2] > 0 {
+				db.SetConnMaxLifetime(time.Duration(p[2]) * time.Second)
+			}
+			if p[3] > 0 {
+				db.SetConnMaxIdleTime(time.Duration(p[3]) * time.Second)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,45 @@
+package reload
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.unistack.org/micro/v3/logger"
+)
+
+var (
+	// default metric prefix
+	DefaultMetricPrefix = "micro_"
+	// default label prefix
+	DefaultLabelPrefix = "micro_"
+
+	reloadCounter *prometheus.CounterVec
+
+	mu sync.Mutex
+)
+
+func registerMetrics() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if reloadCounter == nil {
+		reloadCounter = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("%sconfig_reload_total", DefaultMetricPrefix),
+				Help: "How many config reloads done, partitioned by status",
+			},
+			[]string{
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "status"),
+			},
+		)
+	}
+
+	if err := prometheus.DefaultRegisterer.Register(reloadCounter); err != nil {
+		// if already registered, skip fatal
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			logger.Fatal(context.Background(), err.Error())
+		}
+	}
+}
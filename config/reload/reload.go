@@ -0,0 +1,135 @@
+// Package reload applies runtime settings of reloaded config to running components without restart.
+//
+// Components register hooks in Registry, Reload loads fresh config and passes it to all hooks:
+// every hook validates it first, then hooks apply it in registration order. When hook fails to apply,
+// hooks applied before it get previous config back, so components stay consistent with Current.
+package reload
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/presnalex/go-micro/v3/config"
+	"go.unistack.org/micro/v3/logger"
+)
+
+// Hook is component subscribed to config changes, configs are values returned by Registry new func
+type Hook struct {
+	// used in errors and logs
+	Name string
+	// checks next config before any hook applies it, optional
+	Validate func(next interface{}) error
+	// applies next config, also called with previous config on rollback
+	Apply func(next interface{}) error
+}
+
+// Registry keeps current config and hooks applying its changes
+type Registry struct {
+	newConfig func() interface{}
+	opts      []config.Option
+
+	mu      sync.Mutex
+	current interface{}
+	hooks   map[int]Hook
+	order   []int
+	next    int
+}
+
+// New creates registry of current config loaded by opts, newConfig returns empty
+// pointer to the same struct filled by Reload with the same opts
+func New(current interface{}, newConfig func() interface{}, opts ...config.Option) *Registry {
+	registerMetrics()
+
+	return &Registry{
+		newConfig: newConfig,
+		opts:      opts,
+		current:   current,
+		hooks:     make(map[int]Hook),
+	}
+}
+
+// Register adds hook called on next reloads, returned func unregisters it
+func (r *Registry) Register(h Hook) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := r.next
+	r.next++
+	r.hooks[id] = h
+	r.order = append(r.order, id)
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.hooks, id)
+		for i, v := range r.order {
+			if v == id {
+				r.order = append(r.order[:i], r.order[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Current returns last applied config
+func (r *Registry) Current() interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload loads config again and applies it, it can be called from source subscription
+func (r *Registry) Reload(ctx context.Context) error {
+	next := r.newConfig()
+	opts := append([]config.Option{config.Context(ctx)}, r.opts...)
+	if err := config.Load(next, opts...); err != nil {
+		reloadCounter.WithLabelValues("invalid").Inc()
+		return err
+	}
+	return r.Apply(ctx, next)
+}
+
+// Apply validates next config by all hooks and applies it, previous config is applied back
+// to already updated hooks if any hook fails
+func (r *Registry) Apply(ctx context.Context, next interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hooks := make([]Hook, 0, len(r.order))
+	for _, id := range r.order {
+		hooks = append(hooks, r.hooks[id])
+	}
+
+	var errs config.Errors
+	for _, h := range hooks {
+		if h.Validate == nil {
+			continue
+		}
+		if err := h.Validate(next); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", h.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		reloadCounter.WithLabelValues("invalid").Inc()
+		return errs
+	}
+
+	for i, h := range hooks {
+		err := h.Apply(next)
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("config: reload %s: %w", h.Name, err)
+		for j := i - 1; j >= 0; j-- {
+			if rerr := hooks[j].Apply(r.current); rerr != nil {
+				logger.Errorf(ctx, "config: rollback %s: %v", hooks[j].Name, rerr)
+			}
+		}
+		reloadCounter.WithLabelValues("rollback").Inc()
+		return err
+	}
+
+	r.current = next
+	reloadCounter.WithLabelValues("success").Inc()
+	return nil
+}
@@ -0,0 +1,128 @@
+package reload
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/presnalex/go-micro/v3/config"
+	"github.com/presnalex/go-micro/v3/service"
+)
+
+type testConfig struct {
+	Limit    int                    `json:"limit" env:"LIMIT"`
+	Postgres service.PostgresConfig `json:"postgres"`
+}
+
+type testConnector struct{}
+
+func (testConnector) Connect(context.Context) (driver.Conn, error) {
+	return nil, errors.New("not connected")
+}
+
+func (testConnector) Driver() driver.Driver { return nil }
+
+func TestReload(t *testing.T) {
+	env := map[string]string{"LIMIT": "10"}
+	opts := []config.Option{
+		config.Args(nil),
+		config.LookupEnv(func(key string) (string, bool) {
+			v, ok := env[key]
+			return v, ok
+		}),
+	}
+	// postgres is set like by file, so it is validated
+	newConfig := func() interface{} {
+		return &testConfig{Postgres: service.PostgresConfig{Addr: "127.0.0.1:5432", Login: "test", DBName: "test"}}
+	}
+	cfg := newConfig().(*testConfig)
+	if err := config.Load(cfg, opts...); err != nil {
+		t.Fatal(err)
+	}
+	r := New(cfg, newConfig, opts...)
+
+	var applied, failing []int
+	r.Register(Hook{
+		Name: "applied",
+		Validate: func(next interface{}) error {
+			if next.(*testConfig).Limit > 100 {
+				return errors.New("limit too big")
+			}
+			return nil
+		},
+		Apply: func(next interface{}) error {
+			applied = append(applied, next.(*testConfig).Limit)
+			return nil
+		},
+	})
+	unregister := r.Register(Hook{
+		Name: "failing",
+		Apply: func(next interface{}) error {
+			limit := next.(*testConfig).Limit
+			if limit == 50 {
+				return errors.New("rejected")
+			}
+			failing = append(failing, limit)
+			return nil
+		},
+	})
+
+	env["LIMIT"] = "20"
+	if err := r.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r.Current().(*testConfig).Limit != 20 || len(applied) != 1 || len(failing) != 1 {
+		t.Fatalf("reload not applied: %v %v", applied, failing)
+	}
+
+	env["LIMIT"] = "200"
+	var errs config.Errors
+	if err := r.Reload(context.Background()); !errors.As(err, &errs) || len(applied) != 1 {
+		t.Fatalf("invalid config applied: %v %v", err, applied)
+	}
+
+	// rejected config is rolled back on hooks applied before
+	env["LIMIT"] = "50"
+	if err := r.Reload(context.Background()); err == nil {
+		t.Fatal("expected rejection")
+	}
+	if r.Current().(*testConfig).Limit != 20 || applied[len(applied)-1] != 20 || applied[len(applied)-2] != 50 {
+		t.Fatalf("not rolled back: current %+v, applied %v", r.Current(), applied)
+	}
+
+	unregister()
+	if err := r.Reload(context.Background()); err != nil || r.Current().(*testConfig).Limit != 50 {
+		t.Fatalf("unregistered hook still called: %v", err)
+	}
+}
+
+func TestPostgresPool(t *testing.T) {
+	db := sqlx.NewDb(sql.OpenDB(testConnector{}), "pgx")
+	defer db.Close()
+
+	h := PostgresPool(db, func(cfg interface{}) *service.PostgresConfig { return &cfg.(*testConfig).Postgres })
+	next := &testConfig{Postgres: service.PostgresConfig{ConnMax: 5}}
+	if err := h.Validate(next); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Apply(next); err != nil {
+		t.Fatal(err)
+	}
+	if db.Stats().MaxOpenConnections != 5 {
+		t.Fatalf("max open %d", db.Stats().MaxOpenConnections)
+	}
+	// zero keeps current setting like on connect
+	if err := h.Apply(&testConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if db.Stats().MaxOpenConnections != 5 {
+		t.Fatalf("max open %d reset by zero setting", db.Stats().MaxOpenConnections)
+	}
+
+	if err := h.Validate(&testConfig{Postgres: service.PostgresConfig{ConnMaxIdle: -1}}); err == nil {
+		t.Fatal("negative pool size accepted")
+	}
+}
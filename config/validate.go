@@ -0,0 +1,243 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Validate checks `validate:"..."` tags of v fields and calls Validator of v and nested structs.
+// Rules are comma separated:
+//   - required: value is not zero, for struct field it also forces validation of zero struct
+//   - min=N, max=N: bounds of number, or length of string and slice
+//   - oneof=a b c: value is one of listed words, case sensitive
+//   - url: absolute url with scheme and host
+//   - hostport: host:port, host may be empty like in ":8080"
+//   - addr: hostport or url, like "127.0.0.1:8500" or "http://127.0.0.1:8500"
+//
+// Rules other than required are skipped for zero values and applied to each element of string slice.
+// Zero nested structs and nil pointers are skipped as optional sections unless they are required,
+// so fields of section are checked only if section is set or required.
+// All found errors are returned as Errors, fields are named by dotted json path.
+func Validate(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("config: validate %T, not struct", v)
+	}
+
+	errs := validateStruct(rv, "", nil)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateStruct(v reflect.Value, prefix string, errs Errors) Errors {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		flatten := sf.Anonymous && name == ""
+		if name == "" {
+			name = sf.Name
+		}
+		path := prefix + name
+		fv := v.Field(i)
+		rules := sf.Tag.Get("validate")
+
+		switch {
+		case !fv.IsZero():
+			if err := validateValue(fv, rules); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			}
+		case !hasRule(rules, "required"):
+			continue
+		case fv.Kind() == reflect.Struct && !leaf(fv):
+			// required zero section is validated, so its required fields are reported
+		default:
+			errs = append(errs, fmt.Errorf("%s: required", path))
+			continue
+		}
+
+		if leaf(fv) {
+			continue
+		}
+		if fv.Kind() == reflect.Ptr {
+			fv = fv.Elem()
+		}
+		switch fv.Kind() {
+		case reflect.Struct:
+			if flatten {
+				errs = validateStruct(fv, prefix, errs)
+			} else {
+				errs = validateStruct(fv, path+".", errs)
+			}
+		case reflect.Slice:
+			if fv.Type().Elem().Kind() != reflect.Struct {
+				continue
+			}
+			for j := 0; j < fv.Len(); j++ {
+				errs = validateStruct(fv.Index(j), fmt.Sprintf("%s.%d.", path, j), errs)
+			}
+		}
+	}
+
+	if v.CanAddr() {
+		v = v.Addr()
+	}
+	if vd, ok := v.Interface().(Validator); ok {
+		if err := vd.Validate(); err != nil {
+			var verrs Errors
+			if errors.As(err, &verrs) {
+				for _, verr := range verrs {
+					errs = append(errs, prefixError(prefix, verr))
+				}
+			} else {
+				errs = append(errs, prefixError(prefix, err))
+			}
+		}
+	}
+	return errs
+}
+
+func prefixError(prefix string, err error) error {
+	if prefix == "" {
+		return err
+	}
+	return fmt.Errorf("%s%w", prefix, err)
+}
+
+func hasRule(rules string, name string) bool {
+	for _, rule := range strings.Split(rules, ",") {
+		if rule == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateValue applies rules to non zero value
+func validateValue(v reflect.Value, rules string) error {
+	if rules == "" {
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg := rule, ""
+		if idx := strings.Index(rule, "="); idx >= 0 {
+			name, arg = rule[:idx], rule[idx+1:]
+		}
+
+		var err error
+		switch name {
+		case "required":
+		case "min", "max":
+			err = checkBound(v, name, arg)
+		case "oneof", "url", "hostport", "addr":
+			err = eachString(v, func(s string) error { return checkString(s, name, arg) })
+		default:
+			err = fmt.Errorf("unknown validate rule %q", rule)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkBound(v reflect.Value, name string, arg string) error {
+	bound, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s bound %q", name, arg)
+	}
+
+	var n float64
+	what := "value"
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		n = v.Float()
+	case reflect.String, reflect.Slice, reflect.Map:
+		n, what = float64(v.Len()), "length"
+	default:
+		return fmt.Errorf("%s is not supported by %s", v.Type(), name)
+	}
+
+	if name == "min" && n < bound {
+		return fmt.Errorf("%s %v is less than %s", what, n, arg)
+	}
+	if name == "max" && n > bound {
+		return fmt.Errorf("%s %v is greater than %s", what, n, arg)
+	}
+	return nil
+}
+
+func eachString(v reflect.Value, fn func(string) error) error {
+	switch {
+	case v.Kind() == reflect.String:
+		return fn(v.String())
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		for i := 0; i < v.Len(); i++ {
+			if err := fn(v.Index(i).String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not string", v.Type())
+}
+
+func checkString(s string, name string, arg string) error {
+	switch name {
+	case "oneof":
+		for _, word := range strings.Fields(arg) {
+			if s == word {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q must be one of %s", s, strings.Join(strings.Fields(arg), ", "))
+	case "url":
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%q is not absolute url", s)
+		}
+	case "addr":
+		if strings.Contains(s, "://") {
+			return checkString(s, "url", "")
+		}
+		return checkString(s, "hostport", "")
+	case "hostport":
+		_, port, err := net.SplitHostPort(s)
+		if err != nil {
+			return err
+		}
+		if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("%q has invalid port", s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+// Package vault provides vault client with token or AppRole login, config source reading KV v1 and v2 secrets
+// and dynamic database credentials renewed while service runs.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/service"
+	"go.unistack.org/micro/v3/logger"
+)
+
+var (
+	DefaultTimeout = 10 * time.Second
+	// delay before retrying failed renewal or login
+	DefaultRetryDelay = 5 * time.Second
+
+	// ErrNotFound is returned when secret does not exist
+	ErrNotFound = errors.New("vault: not found")
+)
+
+type Options struct {
+	HTTPClient *http.Client
+	// KV engine version of secret paths, detected by mount if zero
+	KVVersion int
+}
+
+type Option func(*Options)
+
+func HTTPClient(c *http.Client) Option {
+	return func(opts *Options) {
+		opts.HTTPClient = c
+	}
+}
+
+func KVVersion(v int) Option {
+	return func(opts *Options) {
+		opts.KVVersion = v
+	}
+}
+
+// Secret is vault response, Data of KV v2 secret is already unwrapped
+type Secret struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *Auth                  `json:"auth"`
+}
+
+type Auth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+// Client talks to vault with token from config or got by AppRole login,
+// Run keeps token valid renewing it or logging in again.
+type Client struct {
+	addr    string
+	cfg     *service.VaultConfig
+	options Options
+
+	mu        sync.RWMutex
+	token     string
+	ttl       time.Duration
+	renewable bool
+	issued    time.Time
+	mounts    map[string]mount
+}
+
+type mount struct {
+	path    string
+	version int
+}
+
+func NewClient(cfg *service.VaultConfig, opts ...Option) (*Client, error) {
+	options := Options{
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if cfg.Uri == "" {
+		return nil, fmt.Errorf("vault: uri required")
+	}
+	if cfg.Token == "" && (cfg.RoleId == "" || cfg.SecretId == "") {
+		return nil, fmt.Errorf("vault: token or roleid and secretid required")
+	}
+
+	return &Client{
+		addr:    strings.TrimSuffix(cfg.Uri, "/"),
+		cfg:     cfg,
+		options: options,
+		mounts:  make(map[string]mount),
+	}, nil
+}
+
+// Login gets token by AppRole or looks up configured token to learn its ttl
+func (c *Client) Login(ctx context.Context) error {
+	if c.cfg.Token != "" {
+		c.mu.Lock()
+		c.token = c.cfg.Token
+		c.mu.Unlock()
+
+		var rsp struct {
+			Data struct {
+				TTL       int  `json:"ttl"`
+				Renewable bool `json:"renewable"`
+			} `json:"data"`
+		}
+		if err := c.do(ctx, http.MethodGet, "auth/token/lookup-self", nil, &rsp); err != nil {
+			return err
+		}
+		c.setToken(c.cfg.Token, rsp.Data.TTL, rsp.Data.Renewable)
+		return nil
+	}
+
+	rsp := &Secret{}
+	in := map[string]string{"role_id": c.cfg.RoleId, "secret_id": c.cfg.SecretId}
+	if err := c.do(ctx, http.MethodPost, "auth/approle/login", in, rsp); err != nil {
+		return err
+	}
+	if rsp.Auth == nil || rsp.Auth.ClientToken == "" {
+		return fmt.Errorf("vault: approle login returned no token")
+	}
+	c.setToken(rsp.Auth.ClientToken, rsp.Auth.LeaseDuration, rsp.Auth.Renewable)
+	return nil
+}
+
+func (c *Client) setToken(token string, ttl int, renewable bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+	c.ttl = time.Duration(ttl) * time.Second
+	c.renewable = renewable
+	c.issued = time.Now()
+}
+
+// Run renews token at 2/3 of its ttl until ctx is done, AppRole login is repeated
+// when token can't be renewed anymore. Tokens without ttl are left as is.
+func (c *Client) Run(ctx context.Context) error {
+	for {
+		c.mu.RLock()
+		ttl, issued, renewable := c.ttl, c.issued, c.renewable
+		c.mu.RUnlock()
+		if ttl == 0 || (!renewable && c.cfg.Token != "") {
+			// nothing can be done with configured token, it expires as is
+			<-ctx.Done()
+			return ctx.Err()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(issued.Add(ttl * 2 / 3))):
+		}
+
+		if err := c.refresh(ctx); err != nil {
+			logger.Errorf(ctx, "vault: refresh token: %v", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(DefaultRetryDelay):
+			}
+		}
+	}
+}
+
+func (c *Client) refresh(ctx context.Context) error {
+	c.mu.RLock()
+	token, ttl, renewable := c.token, c.ttl, c.renewable
+	c.mu.RUnlock()
+
+	if renewable {
+		rsp := &Secret{}
+		in := map[string]int{"increment": int(ttl / time.Second)}
+		err := c.do(ctx, http.MethodPost, "auth/token/renew-self", in, rsp)
+		if err == nil && rsp.Auth == nil {
+			err = fmt.Errorf("vault: renew returned no auth")
+		}
+		switch {
+		case err != nil && c.cfg.Token != "":
+			return err
+		case err != nil:
+			logger.Errorf(ctx, "vault: renew token, login again: %v", err)
+		case c.cfg.Token != "" || time.Duration(rsp.Auth.LeaseDuration)*time.Second >= ttl:
+			c.setToken(token, rsp.Auth.LeaseDuration, rsp.Auth.Renewable)
+			return nil
+		}
+	}
+	// renewed ttl shorter than requested means max ttl is reached
+	return c.Login(ctx)
+}
+
+// Read reads secret at path, KV v2 paths are given without data segment, like secret/app
+func (c *Client) Read(ctx context.Context, path string) (*Secret, error) {
+	path = strings.Trim(path, "/")
+	m, err := c.mount(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if m.version != 2 {
+		rsp := &Secret{}
+		if err = c.do(ctx, http.MethodGet, path, nil, rsp); err != nil {
+			return nil, err
+		}
+		return rsp, nil
+	}
+
+	var rsp struct {
+		Secret
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err = c.do(ctx, http.MethodGet, m.path+"data/"+strings.TrimPrefix(path, m.path), nil, &rsp); err != nil {
+		return nil, err
+	}
+	secret := rsp.Secret
+	secret.Data = rsp.Data.Data
+	return &secret, nil
+}
+
+// mount returns KV mount of path and its version
+func (c *Client) mount(ctx context.Context, path string) (mount, error) {
+	idx := strings.Index(path, "/")
+	if idx < 1 {
+		return mount{}, fmt.Errorf("vault: path %q has no mount, like secret/app", path)
+	}
+	if c.options.KVVersion != 0 {
+		return mount{path: path[:idx+1], version: c.options.KVVersion}, nil
+	}
+
+	c.mu.RLock()
+	for prefix, m := range c.mounts {
+		if strings.HasPrefix(path, prefix) {
+			c.mu.RUnlock()
+			return m, nil
+		}
+	}
+	c.mu.RUnlock()
+
+	var rsp struct {
+		Data struct {
+			Path    string `json:"path"`
+			Type    string `json:"type"`
+			Options struct {
+				Version string `json:"version"`
+			} `json:"options"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, "sys/internal/ui/mounts/"+path, nil, &rsp); err != nil {
+		return mount{}, err
+	}
+	m := mount{path: rsp.Data.Path, version: 1}
+	if rsp.Data.Options.Version == "2" {
+		m.version = 2
+	}
+	if m.path == "" {
+		m.path = path[:idx+1]
+	}
+
+	c.mu.Lock()
+	c.mounts[m.path] = m
+	c.mu.Unlock()
+
+	return m, nil
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.addr+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	c.mu.RUnlock()
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rsp, err := c.options.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault: %s %s: %w", method, path, err)
+	}
+	defer rsp.Body.Close()
+
+	buf, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return fmt.Errorf("vault: %s %s: %w", method, path, err)
+	}
+
+	switch {
+	case rsp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: %s %s", ErrNotFound, method, path)
+	case rsp.StatusCode == http.StatusNoContent:
+		return nil
+	case rsp.StatusCode >= 300:
+		var rerr struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(buf, &rerr)
+		return fmt.Errorf("vault: %s %s: status %d: %s", method, path, rsp.StatusCode, strings.Join(rerr.Errors, ", "))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(buf, out)
+}
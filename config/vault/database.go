@@ -0,0 +1,209 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/presnalex/go-micro/v3/config/reload"
+	"github.com/presnalex/go-micro/v3/database/postgres"
+	"github.com/presnalex/go-micro/v3/service"
+	"go.unistack.org/micro/v3/logger"
+)
+
+// DatabaseCredentials keeps dynamic credentials of database secrets engine role.
+// Lease is renewed at 1/3 of its duration, when max ttl does not allow renewing anymore
+// new credentials are issued while previous ones still have 1/3 of lease duration left.
+type DatabaseCredentials struct {
+	client *Client
+	path   string
+
+	mu       sync.RWMutex
+	username string
+	password string
+	leaseID  string
+	// duration of the first lease, renewals request the same increment
+	duration time.Duration
+	issued   time.Time
+	expires  time.Time
+	subs     map[int]func(username string, password string)
+	next     int
+}
+
+// DatabaseCredentials issues credentials of role, path is like database/creds/orders
+func (c *Client) DatabaseCredentials(ctx context.Context, path string) (*DatabaseCredentials, error) {
+	d := &DatabaseCredentials{
+		client: c,
+		path:   strings.Trim(path, "/"),
+		subs:   make(map[int]func(string, string)),
+	}
+	if err := d.issue(ctx); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Get returns current credentials, it is suitable for postgres.Credentials
+func (d *DatabaseCredentials) Get(ctx context.Context) (string, string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.username, d.password, nil
+}
+
+// Grace is how long previous credentials stay valid after rotation,
+// connections must not live longer to be closed before their credentials are revoked
+func (d *DatabaseCredentials) Grace() time.Duration {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.duration / 3
+}
+
+// Subscribe registers fn called with new credentials after rotation, returned func unsubscribes
+func (d *DatabaseCredentials) Subscribe(fn func(username string, password string)) func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id := d.next
+	d.next++
+	d.subs[id] = fn
+	return func() {
+		d.mu.Lock()
+		delete(d.subs, id)
+		d.mu.Unlock()
+	}
+}
+
+// Run renews lease and rotates credentials until ctx is done
+func (d *DatabaseCredentials) Run(ctx context.Context) error {
+	for {
+		at, rotate, ok := d.schedule()
+		if !ok {
+			// credentials without lease never expire
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(at)):
+		}
+
+		if err := d.step(ctx, rotate); err != nil {
+			logger.Errorf(ctx, "vault: database credentials %s: %v", d.path, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(DefaultRetryDelay):
+			}
+		}
+	}
+}
+
+// schedule returns time of next renewal or rotation
+func (d *DatabaseCredentials) schedule() (at time.Time, rotate bool, ok bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.duration == 0 {
+		return time.Time{}, false, false
+	}
+	rotateAt := d.expires.Add(-d.duration / 3)
+	renewAt := d.issued.Add(d.duration / 3)
+	if !rotateAt.After(renewAt) {
+		return rotateAt, true, true
+	}
+	return renewAt, false, true
+}
+
+func (d *DatabaseCredentials) step(ctx context.Context, rotate bool) error {
+	if rotate {
+		return d.issue(ctx)
+	}
+
+	d.mu.RLock()
+	in := map[string]interface{}{"lease_id": d.leaseID, "increment": int(d.duration / time.Second)}
+	d.mu.RUnlock()
+
+	rsp := &Secret{}
+	if err := d.client.do(ctx, http.MethodPut, "sys/leases/renew", in, rsp); err != nil {
+		// lease may be revoked already, so new credentials are issued at once
+		logger.Errorf(ctx, "vault: renew lease of %s: %v", d.path, err)
+		return d.issue(ctx)
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	d.issued, d.expires = now, now.Add(time.Duration(rsp.LeaseDuration)*time.Second)
+	d.mu.Unlock()
+	return nil
+}
+
+// issue reads new credentials and notifies subscribers if they already had previous ones
+func (d *DatabaseCredentials) issue(ctx context.Context) error {
+	rsp := &Secret{}
+	if err := d.client.do(ctx, http.MethodGet, d.path, nil, rsp); err != nil {
+		return err
+	}
+	username, _ := rsp.Data["username"].(string)
+	password, _ := rsp.Data["password"].(string)
+	if username == "" {
+		return fmt.Errorf("vault: %s returned no username", d.path)
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	rotated := d.username != ""
+	d.username, d.password, d.leaseID = username, password, rsp.LeaseID
+	d.duration = time.Duration(rsp.LeaseDuration) * time.Second
+	d.issued, d.expires = now, now.Add(d.duration)
+	subs := make([]func(string, string), 0, len(d.subs))
+	for _, fn := range d.subs {
+		subs = append(subs, fn)
+	}
+	d.mu.Unlock()
+
+	if rotated {
+		for _, fn := range subs {
+			fn(username, password)
+		}
+	}
+	return nil
+}
+
+// ConnectPostgres opens pool using current credentials for each new connection,
+// connection lifetime is limited by credentials grace, so connections opened with rotated
+// credentials are closed before their lease ends.
+func ConnectPostgres(cfg *service.PostgresConfig, creds *DatabaseCredentials) (*sqlx.DB, error) {
+	db, err := postgres.Connect(cfg, postgres.Credentials(creds.Get))
+	if err != nil {
+		return nil, err
+	}
+
+	limitLifetime(db, cfg, creds)
+	return db, nil
+}
+
+// PostgresPool is reload.PostgresPool for pool from ConnectPostgres, lifetime stays limited by credentials grace
+func PostgresPool(db *sqlx.DB, creds *DatabaseCredentials, pcfg func(cfg interface{}) *service.PostgresConfig) reload.Hook {
+	h := reload.PostgresPool(db, pcfg)
+	apply := h.Apply
+	h.Apply = func(next interface{}) error {
+		if err := apply(next); err != nil {
+			return err
+		}
+		limitLifetime(db, pcfg(next), creds)
+		return nil
+	}
+	return h
+}
+
+func limitLifetime(db *sqlx.DB, cfg *service.PostgresConfig, creds *DatabaseCredentials) {
+	grace := creds.Grace()
+	if lifetime := time.Duration(cfg.ConnLifetime) * time.Second; grace > 0 && (lifetime == 0 || lifetime > grace) {
+		db.SetConnMaxLifetime(grace)
+	}
+}
@@ -0,0 +1,75 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/presnalex/go-micro/v3/config"
+)
+
+var _ config.Source = (*Source)(nil)
+
+// Source reads secrets at VaultConfig.NamespacePath and AppPath as config document,
+// application secret overrides namespace one. Secret keys are json paths, nested objects
+// or dotted keys like "postgres.passw" fill PostgresConfig.Passw of postgres section.
+type Source struct {
+	client *Client
+	paths  []string
+}
+
+func NewSource(c *Client) *Source {
+	s := &Source{client: c}
+	for _, path := range []string{c.cfg.NamespacePath, c.cfg.AppPath} {
+		if path = strings.Trim(path, "/"); path != "" {
+			s.paths = append(s.paths, path)
+		}
+	}
+	return s
+}
+
+// Load logs in if needed and returns merged secrets, missing secrets are skipped
+func (s *Source) Load(ctx context.Context) ([]byte, error) {
+	s.client.mu.RLock()
+	token := s.client.token
+	s.client.mu.RUnlock()
+	if token == "" {
+		if err := s.client.Login(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	merged := make(map[string]interface{})
+	for _, path := range s.paths {
+		secret, err := s.client.Read(ctx, path)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range secret.Data {
+			node := merged
+			parts := strings.Split(k, ".")
+			for _, part := range parts[:len(parts)-1] {
+				child, ok := node[part].(map[string]interface{})
+				if !ok {
+					child = make(map[string]interface{})
+					node[part] = child
+				}
+				node = child
+			}
+			last := parts[len(parts)-1]
+			if m, ok := v.(map[string]interface{}); ok {
+				if child, ok := node[last].(map[string]interface{}); ok {
+					config.MergeMap(child, m)
+					continue
+				}
+			}
+			node[last] = v
+		}
+	}
+
+	return json.Marshal(merged)
+}
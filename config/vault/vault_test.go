@@ -0,0 +1,205 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/presnalex/go-micro/v3/config"
+	"github.com/presnalex/go-micro/v3/service"
+)
+
+// testVault implements approle login, token renewal, KV v1 and v2 mounts and database credentials
+type testVault struct {
+	mu     sync.Mutex
+	logins int
+	creds  int
+	// lease duration returned by renewals
+	renew int
+}
+
+func (v *testVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	reply := func(body string) {
+		_, _ = w.Write([]byte(body))
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if path == "auth/approle/login" {
+		var in map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		if in["role_id"] != "role" || in["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		v.logins++
+		reply(fmt.Sprintf(`{"auth":{"client_token":"token-%d","lease_duration":60,"renewable":true}}`, v.logins))
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("X-Vault-Token"), "token-") {
+		w.WriteHeader(http.StatusForbidden)
+		reply(`{"errors":["permission denied"]}`)
+		return
+	}
+
+	switch {
+	case path == "auth/token/renew-self":
+		reply(fmt.Sprintf(`{"auth":{"client_token":"","lease_duration":%d,"renewable":true}}`, v.renew))
+	case strings.HasPrefix(path, "sys/internal/ui/mounts/secret/"):
+		reply(`{"data":{"path":"secret/","type":"kv","options":{"version":"2"}}}`)
+	case strings.HasPrefix(path, "sys/internal/ui/mounts/kv/"):
+		reply(`{"data":{"path":"kv/","type":"kv","options":null}}`)
+	case path == "secret/data/shop":
+		reply(`{"data":{"data":{"postgres":{"login":"shop","passw":"ns"},"broker.password":"kafka"},"metadata":{"version":3}}}`)
+	case path == "kv/shop/orders":
+		reply(`{"lease_duration":2764800,"data":{"postgres.passw":"app"}}`)
+	case path == "database/creds/orders":
+		v.creds++
+		reply(fmt.Sprintf(`{"lease_id":"database/creds/orders/%d","lease_duration":3600,"renewable":true,"data":{"username":"user-%d","password":"pass"}}`, v.creds, v.creds))
+	case path == "sys/leases/renew":
+		var in map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		if in["lease_id"] != fmt.Sprintf("database/creds/orders/%d", v.creds) {
+			w.WriteHeader(http.StatusBadRequest)
+			reply(`{"errors":["lease not found"]}`)
+			return
+		}
+		reply(fmt.Sprintf(`{"lease_id":"%s","lease_duration":%d,"renewable":true}`, in["lease_id"], v.renew))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		reply(`{"errors":[]}`)
+	}
+}
+
+func testClient(t *testing.T) (*Client, *testVault) {
+	t.Helper()
+	v := &testVault{}
+	srv := httptest.NewServer(v)
+	t.Cleanup(srv.Close)
+
+	c, err := NewClient(&service.VaultConfig{
+		Uri:           srv.URL,
+		RoleId:        "role",
+		SecretId:      "secret",
+		NamespacePath: "secret/shop",
+		AppPath:       "kv/shop/orders",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, v
+}
+
+func TestSource(t *testing.T) {
+	c, _ := testClient(t)
+
+	cfg := &struct {
+		Postgres service.PostgresConfig `json:"postgres"`
+		Broker   service.BrokerConfig   `json:"broker"`
+	}{}
+	cfg.Postgres.Addr, cfg.Postgres.DBName = "localhost:5432", "orders"
+	if err := config.Load(cfg, config.Sources(NewSource(c)), config.Args(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Postgres.Login != "shop" || cfg.Postgres.Passw != "app" || cfg.Broker.Password != "kafka" {
+		t.Fatalf("unexpected config %+v %+v", cfg.Postgres, cfg.Broker)
+	}
+}
+
+func TestClientKVVersion(t *testing.T) {
+	c, _ := testClient(t)
+	c.options.KVVersion = 2
+	if err := c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := c.Read(context.Background(), "secret/shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := secret.Data["postgres"]; !ok {
+		t.Fatalf("unexpected secret data %v", secret.Data)
+	}
+	if _, err = c.Read(context.Background(), "shop"); err == nil {
+		t.Fatal("expected error for path without mount")
+	}
+	// detected mount must not be empty prefix either
+	c.options.KVVersion = 0
+	if _, err = c.Read(context.Background(), "shop"); err == nil || !strings.Contains(err.Error(), "no mount") {
+		t.Fatalf("expected error for path without mount, got %v", err)
+	}
+}
+
+func TestClientRefresh(t *testing.T) {
+	c, v := testClient(t)
+	if err := c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	v.renew = 60
+	if err := c.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v.logins != 1 {
+		t.Fatalf("renewable token logged in again %d times", v.logins)
+	}
+
+	// max ttl reached
+	v.renew = 10
+	if err := c.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v.logins != 2 || c.token != "token-2" {
+		t.Fatalf("expected new login, got %d logins, token %s", v.logins, c.token)
+	}
+}
+
+func TestDatabaseCredentials(t *testing.T) {
+	c, v := testClient(t)
+	if err := c.Login(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := c.DatabaseCredentials(context.Background(), "database/creds/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rotated []string
+	d.Subscribe(func(username string, password string) { rotated = append(rotated, username) })
+
+	if _, rotate, ok := d.schedule(); !ok || rotate {
+		t.Fatal("fresh lease must be renewed first")
+	}
+	v.renew = 3600
+	if err = d.step(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if username, _, _ := d.Get(context.Background()); username != "user-1" || len(rotated) != 0 {
+		t.Fatalf("renewal must keep credentials, got %s", username)
+	}
+
+	// max ttl leaves less than 2/3 of lease
+	v.renew = 1200
+	if err = d.step(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	_, rotate, _ := d.schedule()
+	if !rotate {
+		t.Fatal("capped lease must be rotated")
+	}
+	if err = d.step(context.Background(), rotate); err != nil {
+		t.Fatal(err)
+	}
+	if username, _, _ := d.Get(context.Background()); username != "user-2" || len(rotated) != 1 || rotated[0] != "user-2" {
+		t.Fatalf("expected rotation to user-2, got %s, notified %v", username, rotated)
+	}
+	if d.Grace().Minutes() != 20 {
+		t.Fatalf("grace %s, expected third of lease", d.Grace())
+	}
+}
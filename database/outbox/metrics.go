@@ -0,0 +1,78 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.unistack.org/micro/v3/logger"
+)
+
+var (
+	// default metric prefix
+	DefaultMetricPrefix = "micro_outbox_"
+	// default label prefix
+	DefaultLabelPrefix = "micro_"
+
+	publishCounter *prometheus.CounterVec
+	pendingGauge   *prometheus.GaugeVec
+	lagGauge       *prometheus.GaugeVec
+
+	mu sync.Mutex
+)
+
+func registerMetrics() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if publishCounter == nil {
+		publishCounter = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("%spublish_total", DefaultMetricPrefix),
+				Help: "How many outbox records published, partitioned by topic and status",
+			},
+			[]string{
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "topic"),
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "status"),
+			},
+		)
+	}
+
+	if pendingGauge == nil {
+		pendingGauge = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%spending", DefaultMetricPrefix),
+				Help: "The number of outbox records not published yet",
+			},
+			[]string{
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "table"),
+			},
+		)
+	}
+
+	if lagGauge == nil {
+		lagGauge = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%slag_seconds", DefaultMetricPrefix),
+				Help: "Age of the oldest outbox record not published yet",
+			},
+			[]string{
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "table"),
+			},
+		)
+	}
+
+	for _, collector := range []prometheus.Collector{
+		publishCounter,
+		pendingGauge,
+		lagGauge,
+	} {
+		if err := prometheus.DefaultRegisterer.Register(collector); err != nil {
+			// if already registered, skip fatal
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				logger.Fatal(context.Background(), err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package outbox implements transactional outbox: events are inserted into postgres table
+// in the same transaction as business data and published to broker by Relay after commit.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/presnalex/go-micro/v3/codec/rawjson"
+	"github.com/presnalex/go-micro/v3/database/wrapper"
+	"github.com/presnalex/go-micro/v3/wrapper/requestid"
+	"go.unistack.org/micro/v3/codec"
+	"go.unistack.org/micro/v3/metadata"
+)
+
+var (
+	DefaultTable         = "outbox"
+	DefaultBatchSize     = 100
+	DefaultPollInterval  = time.Second
+	DefaultStatsInterval = 5 * time.Second
+)
+
+type Options struct {
+	// outbox table name, may include schema
+	Table string
+	// postgres NOTIFY channel, relay wakes up on notification instead of waiting for poll interval
+	Channel string
+	// Listener opens connection used by relay to LISTEN on Channel, like postgres.ConnectListener.
+	// Polling is still used as fallback if notification is lost.
+	Listener     func(ctx context.Context) (*pgx.Conn, error)
+	BatchSize    int
+	PollInterval time.Duration
+	// how often pending count and lag metrics are updated
+	StatsInterval time.Duration
+	// sent rows older than retention are deleted, 0 keeps them forever
+	Retention time.Duration
+	Codec     codec.Codec
+}
+
+type Option func(*Options)
+
+func Table(name string) Option {
+	return func(opts *Options) {
+		opts.Table = name
+	}
+}
+
+func Channel(name string) Option {
+	return func(opts *Options) {
+		opts.Channel = name
+	}
+}
+
+func Listener(fn func(ctx context.Context) (*pgx.Conn, error)) Option {
+	return func(opts *Options) {
+		opts.Listener = fn
+	}
+}
+
+func BatchSize(n int) Option {
+	return func(opts *Options) {
+		opts.BatchSize = n
+	}
+}
+
+func PollInterval(td time.Duration) Option {
+	return func(opts *Options) {
+		opts.PollInterval = td
+	}
+}
+
+func StatsInterval(td time.Duration) Option {
+	return func(opts *Options) {
+		opts.StatsInterval = td
+	}
+}
+
+func Retention(td time.Duration) Option {
+	return func(opts *Options) {
+		opts.Retention = td
+	}
+}
+
+func Codec(c codec.Codec) Option {
+	return func(opts *Options) {
+		opts.Codec = c
+	}
+}
+
+// Execer is implemented by wrapper.TxWrapper
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+var _ Execer = (*wrapper.TxWrapper)(nil)
+
+type Outbox struct {
+	options Options
+}
+
+func New(opts ...Option) *Outbox {
+	options := Options{
+		Table:         DefaultTable,
+		BatchSize:     DefaultBatchSize,
+		PollInterval:  DefaultPollInterval,
+		StatsInterval: DefaultStatsInterval,
+		Codec:         rawjson.NewCodec(),
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &Outbox{options: options}
+}
+
+// Schema returns DDL for outbox table
+func (o *Outbox) Schema() string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+	id bigserial PRIMARY KEY,
+	topic text NOT NULL,
+	headers jsonb NOT NULL DEFAULT '{}',
+	body bytea NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	sent_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS %[2]s_unsent_idx ON %[1]s (id) WHERE sent_at IS NULL;`, o.options.Table, indexName(o.options.Table))
+}
+
+// Publish inserts message into outbox table within tx, message is published by Relay after tx commit.
+// Headers are taken from outgoing context metadata, request id is kept so consumers can correlate the event
+// with request that produced it.
+func (o *Outbox) Publish(ctx context.Context, tx Execer, topic string, msg interface{}) error {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = metadata.Copy(md)
+	} else {
+		md = metadata.New(3)
+	}
+	if _, ok = md.Get(requestid.DefaultKey); !ok {
+		if id, ok := requestid.GetIncomingRequestId(ctx); ok {
+			md.Set(requestid.DefaultKey, id)
+		}
+	}
+	md.Set("Content-Type", "application/json")
+	md.Set("Micro-Topic", topic)
+
+	body, err := o.options.Codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	headers, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (topic, headers, body) VALUES ($1, $2, $3)", o.options.Table)
+	if _, err = tx.ExecContext(wrapper.QueryContext(ctx, "outbox_insert"), query, topic, headers, body); err != nil {
+		return fmt.Errorf("outbox: insert: %w", err)
+	}
+
+	if o.options.Channel != "" {
+		// notification is delivered only when transaction commits
+		if _, err = tx.ExecContext(wrapper.QueryContext(ctx, "outbox_notify"), "SELECT pg_notify($1, $2)", o.options.Channel, topic); err != nil {
+			return fmt.Errorf("outbox: notify: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func indexName(table string) string {
+	name := []byte(table)
+	for i, c := range name {
+		if c == '.' {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
@@ -0,0 +1,138 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/wrapper/requestid"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/metadata"
+)
+
+type testExec struct {
+	queries []string
+	args    [][]interface{}
+}
+
+func (e *testExec) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	e.queries = append(e.queries, query)
+	e.args = append(e.args, args)
+	return nil, nil
+}
+
+func TestPublish(t *testing.T) {
+	o := New(Table("events.outbox"), Channel("outbox"))
+	tx := &testExec{}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Metadata{requestid.DefaultKey: "req-1"})
+	if err := o.Publish(ctx, tx, "orders", map[string]string{"id": "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tx.queries) != 2 {
+		t.Fatalf("queries %v, expected insert and notify", tx.queries)
+	}
+	if !strings.HasPrefix(tx.queries[0], "INSERT INTO events.outbox ") {
+		t.Fatalf("unexpected insert %q", tx.queries[0])
+	}
+	if tx.args[0][0] != "orders" {
+		t.Fatalf("topic %v, expected orders", tx.args[0][0])
+	}
+	md := metadata.New(0)
+	if err := json.Unmarshal(tx.args[0][1].([]byte), &md); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := md.Get(requestid.DefaultKey); id != "req-1" {
+		t.Fatalf("request id %q, expected req-1", id)
+	}
+	if topic, _ := md.Get("Micro-Topic"); topic != "orders" {
+		t.Fatalf("Micro-Topic %q, expected orders", topic)
+	}
+	if body := string(tx.args[0][2].([]byte)); body != `{"id":"1"}` {
+		t.Fatalf("body %s", body)
+	}
+	if tx.args[1][0] != "outbox" || tx.args[1][1] != "orders" {
+		t.Fatalf("notify args %v", tx.args[1])
+	}
+}
+
+type testStore struct {
+	recs []*record
+	sent []int64
+}
+
+func (s *testStore) process(ctx context.Context, limit int, fn func(recs []*record) []int64) (int, error) {
+	recs := s.recs
+	if len(recs) > limit {
+		recs = recs[:limit]
+	}
+	sent := fn(recs)
+	s.sent = append(s.sent, sent...)
+	s.recs = s.recs[len(sent):]
+	return len(recs), nil
+}
+
+func (s *testStore) stats(ctx context.Context) (int64, time.Duration, error) {
+	return int64(len(s.recs)), 0, nil
+}
+
+func (s *testStore) cleanup(ctx context.Context, retention time.Duration) error {
+	return nil
+}
+
+type testBroker struct {
+	broker.Broker
+	fail   int64
+	topics []string
+	ids    []string
+}
+
+func (b *testBroker) Publish(ctx context.Context, topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	id, _ := msg.Header.Get(requestid.DefaultKey)
+	if id == "fail" && b.fail > 0 {
+		b.fail--
+		return errors.New("broker unavailable")
+	}
+	b.topics = append(b.topics, topic)
+	b.ids = append(b.ids, id)
+	return nil
+}
+
+func TestRelay(t *testing.T) {
+	registerMetrics()
+
+	st := &testStore{}
+	for i, id := range []string{"a", "b", "fail", "c"} {
+		st.recs = append(st.recs, &record{
+			ID:      int64(i + 1),
+			Topic:   "orders",
+			Headers: []byte(`{"X-Request-Id":"` + id + `"}`),
+			Body:    []byte(`{}`),
+		})
+	}
+	b := &testBroker{fail: 1}
+	r := &Relay{options: New(BatchSize(10)).options, store: st, broker: b}
+
+	if _, err := r.relay(context.Background()); err == nil {
+		t.Fatal("expected publish error")
+	}
+	if len(st.sent) != 2 || st.sent[0] != 1 || st.sent[1] != 2 {
+		t.Fatalf("sent %v, expected records before failed one", st.sent)
+	}
+
+	n, err := r.relay(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || len(st.recs) != 0 {
+		t.Fatalf("processed %d, left %d", n, len(st.recs))
+	}
+	if strings.Join(b.ids, ",") != "a,b,fail,c" {
+		t.Fatalf("published %v, expected insertion order", b.ids)
+	}
+}
@@ -0,0 +1,223 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/presnalex/go-micro/v3/database/wrapper"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/logger"
+	"go.unistack.org/micro/v3/metadata"
+)
+
+type record struct {
+	ID      int64  `db:"id"`
+	Topic   string `db:"topic"`
+	Headers []byte `db:"headers"`
+	Body    []byte `db:"body"`
+}
+
+// store hides postgres from relay logic
+type store interface {
+	// process locks up to limit unsent records, passes them to fn and marks records returned by fn as sent
+	process(ctx context.Context, limit int, fn func(recs []*record) []int64) (int, error)
+	// stats returns number of unsent records and age of the oldest one
+	stats(ctx context.Context) (int64, time.Duration, error)
+	cleanup(ctx context.Context, retention time.Duration) error
+}
+
+// Relay publishes outbox records to broker in insertion order and marks them sent.
+// Several relays may run against the same table, records are locked with SKIP LOCKED.
+type Relay struct {
+	options Options
+	store   store
+	broker  broker.Broker
+	wake    chan struct{}
+}
+
+// Relay creates relay reading outbox table through db, b is usually broker created by service.InitBroker
+func (o *Outbox) Relay(db *wrapper.Wrapper, b broker.Broker) *Relay {
+	return &Relay{
+		options: o.options,
+		store:   &pgStore{db: db, table: o.options.Table},
+		broker:  b,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Run publishes records until ctx is done
+func (r *Relay) Run(ctx context.Context) error {
+	registerMetrics()
+
+	if r.options.Listener != nil && r.options.Channel != "" {
+		go r.listenLoop(ctx)
+	}
+
+	poll := time.NewTicker(r.options.PollInterval)
+	defer poll.Stop()
+	stats := time.NewTicker(r.options.StatsInterval)
+	defer stats.Stop()
+
+	for {
+		// drain table, then wait for notification or next poll
+		for {
+			n, err := r.relay(ctx)
+			if err != nil {
+				logger.Errorf(ctx, "outbox: relay %s: %v", r.options.Table, err)
+				break
+			}
+			if n < r.options.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-poll.C:
+		case <-r.wake:
+		case <-stats.C:
+			r.collect(ctx)
+		}
+	}
+}
+
+// relay publishes single batch and returns number of records processed
+func (r *Relay) relay(ctx context.Context) (int, error) {
+	var perr error
+	n, err := r.store.process(ctx, r.options.BatchSize, func(recs []*record) []int64 {
+		sent := make([]int64, 0, len(recs))
+		for _, rec := range recs {
+			if perr = r.publish(ctx, rec); perr != nil {
+				// keep order, next records are published after this one
+				publishCounter.WithLabelValues(rec.Topic, "failure").Inc()
+				break
+			}
+			publishCounter.WithLabelValues(rec.Topic, "success").Inc()
+			sent = append(sent, rec.ID)
+		}
+		return sent
+	})
+	if err != nil {
+		return 0, err
+	}
+	if perr != nil {
+		return 0, perr
+	}
+	return n, nil
+}
+
+func (r *Relay) publish(ctx context.Context, rec *record) error {
+	md := metadata.New(0)
+	if len(rec.Headers) > 0 {
+		if err := json.Unmarshal(rec.Headers, &md); err != nil {
+			return fmt.Errorf("record %d headers: %w", rec.ID, err)
+		}
+	}
+	if err := r.broker.Publish(ctx, rec.Topic, &broker.Message{Header: md, Body: rec.Body}); err != nil {
+		return fmt.Errorf("publish record %d to %s: %w", rec.ID, rec.Topic, err)
+	}
+	return nil
+}
+
+func (r *Relay) collect(ctx context.Context) {
+	pending, lag, err := r.store.stats(ctx)
+	if err != nil {
+		logger.Errorf(ctx, "outbox: stats %s: %v", r.options.Table, err)
+		return
+	}
+	pendingGauge.WithLabelValues(r.options.Table).Set(float64(pending))
+	lagGauge.WithLabelValues(r.options.Table).Set(lag.Seconds())
+
+	if r.options.Retention > 0 {
+		if err = r.store.cleanup(ctx, r.options.Retention); err != nil {
+			logger.Errorf(ctx, "outbox: cleanup %s: %v", r.options.Table, err)
+		}
+	}
+}
+
+func (r *Relay) listenLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := r.waitNotifications(ctx); err != nil && ctx.Err() == nil {
+			logger.Errorf(ctx, "outbox: listen %s: %v", r.options.Channel, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(r.options.PollInterval):
+			}
+		}
+	}
+}
+
+func (r *Relay) waitNotifications(ctx context.Context) error {
+	conn, err := r.options.Listener(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{r.options.Channel}.Sanitize()); err != nil {
+		return err
+	}
+	for {
+		if _, err = conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+type pgStore struct {
+	db    *wrapper.Wrapper
+	table string
+}
+
+func (s *pgStore) process(ctx context.Context, limit int, fn func(recs []*record) []int64) (int, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var recs []*record
+	query := fmt.Sprintf("SELECT id, topic, headers, body FROM %s WHERE sent_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED", s.table)
+	if err = tx.SelectContext(wrapper.QueryContext(ctx, "outbox_select"), &recs, query, limit); err != nil {
+		return 0, err
+	}
+	if len(recs) == 0 {
+		return 0, nil
+	}
+
+	if sent := fn(recs); len(sent) > 0 {
+		query = fmt.Sprintf("UPDATE %s SET sent_at = now() WHERE id = ANY($1)", s.table)
+		if _, err = tx.ExecContext(wrapper.QueryContext(ctx, "outbox_mark_sent"), query, sent); err != nil {
+			// records are published again on next run, consumers must tolerate duplicates
+			return 0, err
+		}
+	}
+
+	return len(recs), tx.Commit()
+}
+
+func (s *pgStore) stats(ctx context.Context) (int64, time.Duration, error) {
+	var res struct {
+		Pending int64   `db:"pending"`
+		Lag     float64 `db:"lag"`
+	}
+	query := fmt.Sprintf("SELECT count(*) AS pending, coalesce(extract(epoch FROM now() - min(created_at)), 0)::float8 AS lag FROM %s WHERE sent_at IS NULL", s.table)
+	if err := s.db.GetContext(wrapper.QueryContext(ctx, "outbox_stats"), &res, query); err != nil {
+		return 0, 0, err
+	}
+	return res.Pending, time.Duration(res.Lag * float64(time.Second)), nil
+}
+
+func (s *pgStore) cleanup(ctx context.Context, retention time.Duration) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE sent_at < now() - make_interval(secs => $1)", s.table)
+	_, err := s.db.ExecContext(wrapper.QueryContext(ctx, "outbox_cleanup"), query, retention.Seconds())
+	return err
+}
@@ -1,6 +1,7 @@
 package postgres
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"time"
@@ -11,36 +12,55 @@ import (
 	"github.com/presnalex/go-micro/v3/service"
 )
 
-func Connect(cfg *service.PostgresConfig) (*sqlx.DB, error) {
-	// format connection string
-	dbstr := fmt.Sprintf(
-		"postgres://%s:%s@%s/%s?sslmode=disable&statement_cache_mode=describe",
-		cfg.Login,
-		url.QueryEscape(cfg.Passw),
-		cfg.Addr,
-		cfg.DBName,
-	)
+type Options struct {
+	// Credentials returns login and password for each new connection, used instead of config ones
+	Credentials func(ctx context.Context) (login string, passw string, err error)
+}
 
-	// parse connection string
-	dbConf, err := pgx.ParseConfig(dbstr)
-	if err != nil {
-		return nil, err
+type Option func(*Options)
+
+// Credentials makes pool take login and password of new connections from fn,
+// so rotated credentials are used without reopening pool
+func Credentials(fn func(ctx context.Context) (login string, passw string, err error)) Option {
+	return func(opts *Options) {
+		opts.Credentials = fn
 	}
+}
 
-	// needed for pgbouncer
-	dbConf.RuntimeParams = map[string]string{
-		"standard_conforming_strings": "on",
-		"application_name":            cfg.AppName,
+func Connect(cfg *service.PostgresConfig, opts ...Option) (*sqlx.DB, error) {
+	options := Options{}
+	for _, opt := range opts {
+		opt(&options)
 	}
-	// may be needed for pbbouncer, needs to check
-	// dbConf.PreferSimpleProtocol = true
-	// register pgx conn
-	connStr := stdlib.RegisterConnConfig(dbConf)
 
-	db, err := sqlx.Connect("pgx", connStr)
+	dbConf, err := parseConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
+	// may be needed for pbbouncer, needs to check
+	// dbConf.PreferSimpleProtocol = true
+
+	var db *sqlx.DB
+	if options.Credentials != nil {
+		db = sqlx.NewDb(stdlib.OpenDB(*dbConf, stdlib.OptionBeforeConnect(func(ctx context.Context, cc *pgx.ConnConfig) error {
+			login, passw, err := options.Credentials(ctx)
+			if err != nil {
+				return err
+			}
+			cc.User, cc.Password = login, passw
+			return nil
+		})), "pgx")
+		if err = db.Ping(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	} else {
+		// register pgx conn
+		connStr := stdlib.RegisterConnConfig(dbConf)
+		if db, err = sqlx.Connect("pgx", connStr); err != nil {
+			return nil, err
+		}
+	}
 
 	if cfg.ConnMax > 0 {
 		db.SetMaxOpenConns(int(cfg.ConnMax))
@@ -57,3 +77,49 @@ func Connect(cfg *service.PostgresConfig) (*sqlx.DB, error) {
 
 	return db, nil
 }
+
+// ConnectListener opens single connection outside of pool, used for LISTEN.
+// It must go directly to postgres, pgbouncer in transaction mode does not deliver notifications.
+// With Credentials login and password are taken from fn, like for pool connections.
+func ConnectListener(ctx context.Context, cfg *service.PostgresConfig, opts ...Option) (*pgx.Conn, error) {
+	options := Options{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	dbConf, err := parseConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if options.Credentials != nil {
+		if dbConf.User, dbConf.Password, err = options.Credentials(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return pgx.ConnectConfig(ctx, dbConf)
+}
+
+func parseConfig(cfg *service.PostgresConfig) (*pgx.ConnConfig, error) {
+	// format connection string
+	dbstr := fmt.Sprintf(
+		"postgres://%s:%s@%s/%s?sslmode=disable&statement_cache_mode=describe",
+		cfg.Login,
+		url.QueryEscape(cfg.Passw),
+		cfg.Addr,
+		cfg.DBName,
+	)
+
+	// parse connection string
+	dbConf, err := pgx.ParseConfig(dbstr)
+	if err != nil {
+		return nil, err
+	}
+
+	// needed for pgbouncer
+	dbConf.RuntimeParams = map[string]string{
+		"standard_conforming_strings": "on",
+		"application_name":            cfg.AppName,
+	}
+
+	return dbConf, nil
+}
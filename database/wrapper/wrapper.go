@@ -278,6 +278,9 @@ type Wrapper struct {
 	db      *sqlx.DB
 	options Options
 	labels  []string
+	// closed on Close to stop stats collection
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 type TxWrapper struct {
@@ -319,6 +322,7 @@ func NewWrapper(db *sqlx.DB, opts ...Option) *Wrapper {
 		db:      db,
 		options: options,
 		labels:  []string{options.DBHost, options.DBName, options.Name, options.Version, options.ID},
+		done:    make(chan struct{}),
 	}
 
 	go w.collect()
@@ -493,7 +497,14 @@ func (w *Wrapper) PrepareContext(ctx context.Context, query string) (*sql.Stmt,
 	return res, err
 }
 
+// PingContext checks connection to database, it is used by health checks
+func (w *Wrapper) PingContext(ctx context.Context) error {
+	return w.db.PingContext(ctx)
+}
+
+// Close stops stats collection and closes db
 func (w *Wrapper) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
 	return w.db.Close()
 }
 
@@ -606,6 +617,8 @@ func (w *Wrapper) collect() {
 
 	for {
 		select {
+		case <-w.done:
+			return
 		case <-ticker.C:
 			if w.db == nil {
 				continue
@@ -0,0 +1,439 @@
+// Package dlq replays messages moved to error topic by service.NewErrorHandler back to their source topic
+package dlq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/codec/rawjson"
+	"github.com/presnalex/go-micro/v3/wrapper/retry"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/codec"
+	"go.unistack.org/micro/v3/metadata"
+)
+
+var (
+	HeaderError    = textproto.CanonicalMIMEHeaderKey("Micro-Error")
+	HeaderAppname  = textproto.CanonicalMIMEHeaderKey("Micro-Appname")
+	HeaderTopic    = textproto.CanonicalMIMEHeaderKey("Micro-Topic")
+	HeaderReplayed = textproto.CanonicalMIMEHeaderKey("Micro-Replayed")
+
+	// stop reading if nothing fetched during this period, protects from waiting
+	// for offsets occupied by transaction markers
+	DefaultIdleTimeout = 10 * time.Second
+)
+
+// Message is dead lettered message read from error topic
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Timestamp time.Time
+	Header    metadata.Metadata
+	Body      []byte
+}
+
+// SourceTopic returns topic where message was published originally
+func (m *Message) SourceTopic() string {
+	if v, ok := m.Header.Get(retry.HeaderSourceTopic); ok && v != "" {
+		return v
+	}
+	if v, ok := m.Header.Get(HeaderTopic); ok && v != m.Topic {
+		return v
+	}
+	return ""
+}
+
+// Filter selects messages to replay, empty fields match everything
+type Filter struct {
+	AppName       string
+	ErrorContains string
+	From          time.Time
+	To            time.Time
+	Headers       map[string]string
+}
+
+func (f Filter) Match(m *Message) bool {
+	if f.AppName != "" {
+		if v, _ := m.Header.Get(HeaderAppname); v != f.AppName {
+			return false
+		}
+	}
+	if f.ErrorContains != "" {
+		if v, _ := m.Header.Get(HeaderError); !strings.Contains(v, f.ErrorContains) {
+			return false
+		}
+	}
+	if !f.From.IsZero() && m.Timestamp.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !m.Timestamp.Before(f.To) {
+		return false
+	}
+	for k, v := range f.Headers {
+		if hv, ok := m.Header.Get(k); !ok || hv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Report describes replay progress
+type Report struct {
+	Read     int64
+	Matched  int64
+	Replayed int64
+	Skipped  int64
+	// rewrite or publish failed
+	Failed int64
+	// record value not decoded by codec
+	Undecoded int64
+	// message not encoded by codec for target topic
+	Unencoded int64
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("read %d, matched %d, replayed %d, skipped %d, failed %d, undecoded %d, unencoded %d",
+		r.Read, r.Matched, r.Replayed, r.Skipped, r.Failed, r.Undecoded, r.Unencoded)
+}
+
+type Options struct {
+	// error topic to read
+	Topic string
+	// destination topic, by default message source topic
+	Target string
+	Filter Filter
+	// Rewrite can change message body or headers before republish
+	Rewrite func(m *Message) error
+	// DryRun reads and filters messages without publishing
+	DryRun bool
+	// Progress called after each fetched batch
+	Progress    func(r Report)
+	IdleTimeout time.Duration
+	Codec       codec.Codec
+}
+
+type Option func(*Options)
+
+func Topic(topic string) Option {
+	return func(opts *Options) {
+		opts.Topic = topic
+	}
+}
+
+func Target(topic string) Option {
+	return func(opts *Options) {
+		opts.Target = topic
+	}
+}
+
+func WithFilter(f Filter) Option {
+	return func(opts *Options) {
+		opts.Filter = f
+	}
+}
+
+func Rewrite(fn func(m *Message) error) Option {
+	return func(opts *Options) {
+		opts.Rewrite = fn
+	}
+}
+
+func DryRun(b bool) Option {
+	return func(opts *Options) {
+		opts.DryRun = b
+	}
+}
+
+func Progress(fn func(r Report)) Option {
+	return func(opts *Options) {
+		opts.Progress = fn
+	}
+}
+
+func IdleTimeout(td time.Duration) Option {
+	return func(opts *Options) {
+		opts.IdleTimeout = td
+	}
+}
+
+func Codec(c codec.Codec) Option {
+	return func(opts *Options) {
+		opts.Codec = c
+	}
+}
+
+// kafkaClient is the part of kgo client used by replayer
+type kafkaClient interface {
+	Request(ctx context.Context, req kmsg.Request) (kmsg.Response, error)
+	ProduceSync(ctx context.Context, rs ...*kgo.Record) kgo.ProduceResults
+	PollFetches(ctx context.Context) kgo.Fetches
+	Close()
+}
+
+func newKafkaClient(kopts ...kgo.Opt) (kafkaClient, error) {
+	return kgo.NewClient(kopts...)
+}
+
+// Replayer reads error topic from the beginning up to offsets that existed on start
+// and republishes matched messages
+type Replayer struct {
+	kopts   []kgo.Opt
+	options Options
+	// replaced by tests
+	newClient func(kopts ...kgo.Opt) (kafkaClient, error)
+}
+
+// NewReplayer creates replayer, kopts must contain connection options, like from service.NewKafkaClient
+func NewReplayer(kopts []kgo.Opt, opts ...Option) *Replayer {
+	options := Options{
+		IdleTimeout: DefaultIdleTimeout,
+		Codec:       rawjson.NewCodec(),
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &Replayer{kopts: kopts, options: options, newClient: newKafkaClient}
+}
+
+func (r *Replayer) Run(ctx context.Context) (Report, error) {
+	var report Report
+
+	if r.options.Topic == "" {
+		return report, fmt.Errorf("dlq: error topic required")
+	}
+
+	producer, err := r.newClient(r.kopts...)
+	if err != nil {
+		return report, err
+	}
+	defer producer.Close()
+
+	start, end, err := listOffsets(ctx, producer, r.options.Topic)
+	if err != nil {
+		return report, err
+	}
+
+	offsets := make(map[int32]kgo.Offset, len(end))
+	for p := range end {
+		if start[p] < end[p] {
+			offsets[p] = kgo.NewOffset().At(start[p])
+		}
+	}
+	if len(offsets) == 0 {
+		return report, nil
+	}
+
+	kopts := make([]kgo.Opt, 0, len(r.kopts)+1)
+	kopts = append(kopts, r.kopts...)
+	kopts = append(kopts, kgo.ConsumePartitions(map[string]map[int32]kgo.Offset{r.options.Topic: offsets}))
+	consumer, err := r.newClient(kopts...)
+	if err != nil {
+		return report, err
+	}
+	defer consumer.Close()
+
+	for len(offsets) > 0 {
+		pctx, cancel := context.WithTimeout(ctx, r.options.IdleTimeout)
+		fetches := consumer.PollFetches(pctx)
+		cancel()
+		if err = ctx.Err(); err != nil {
+			return report, err
+		}
+		if fetches.IsClientClosed() {
+			return report, kgo.ErrClientClosed
+		}
+		if fetches.NumRecords() == 0 && pctx.Err() != nil {
+			// nothing new, remaining offsets are not data records
+			break
+		}
+		for _, ferr := range fetches.Errors() {
+			if !errors.Is(ferr.Err, context.DeadlineExceeded) {
+				return report, fmt.Errorf("dlq: fetch %s/%d: %w", ferr.Topic, ferr.Partition, ferr.Err)
+			}
+		}
+
+		var rerr error
+		fetches.EachRecord(func(rec *kgo.Record) {
+			if rerr != nil {
+				return
+			}
+			if _, ok := offsets[rec.Partition]; !ok {
+				return
+			}
+			if rec.Offset+1 >= end[rec.Partition] {
+				// end of partition reached, skip records published after start
+				delete(offsets, rec.Partition)
+				if rec.Offset >= end[rec.Partition] {
+					return
+				}
+			}
+			rerr = r.process(ctx, producer, rec, &report)
+		})
+		if rerr != nil {
+			return report, rerr
+		}
+
+		if r.options.Progress != nil {
+			r.options.Progress(report)
+		}
+	}
+
+	return report, nil
+}
+
+func (r *Replayer) process(ctx context.Context, producer kafkaClient, rec *kgo.Record, report *Report) error {
+	report.Read++
+
+	m, err := r.decode(rec)
+	if err != nil {
+		report.Undecoded++
+		return nil
+	}
+	if !r.options.Filter.Match(m) {
+		return nil
+	}
+	report.Matched++
+
+	target := r.options.Target
+	if target == "" {
+		target = m.SourceTopic()
+	}
+	if target == "" || target == r.options.Topic {
+		report.Skipped++
+		return nil
+	}
+
+	if r.options.Rewrite != nil {
+		if err = r.options.Rewrite(m); err != nil {
+			report.Failed++
+			return nil
+		}
+	}
+
+	if r.options.DryRun {
+		report.Replayed++
+		return nil
+	}
+
+	value, err := r.options.Codec.Marshal(&broker.Message{Header: cleanHeader(m.Header, target), Body: m.Body})
+	if err != nil {
+		report.Unencoded++
+		return nil
+	}
+
+	if err = producer.ProduceSync(ctx, &kgo.Record{Topic: target, Key: rec.Key, Value: value}).FirstErr(); err != nil {
+		report.Failed++
+		// broker is unavailable, no sense to continue
+		return fmt.Errorf("dlq: publish to %s: %w", target, err)
+	}
+	report.Replayed++
+
+	return nil
+}
+
+func (r *Replayer) decode(rec *kgo.Record) (*Message, error) {
+	bm := &broker.Message{}
+	if err := r.options.Codec.Unmarshal(rec.Value, bm); err != nil {
+		return nil, err
+	}
+	if bm.Header == nil {
+		bm.Header = metadata.New(len(rec.Headers))
+	}
+	// body only messages carry headers in kafka record
+	for _, h := range rec.Headers {
+		if _, ok := bm.Header.Get(h.Key); !ok {
+			bm.Header.Set(h.Key, string(h.Value))
+		}
+	}
+
+	return &Message{
+		Topic:     rec.Topic,
+		Partition: rec.Partition,
+		Offset:    rec.Offset,
+		Timestamp: rec.Timestamp,
+		Header:    bm.Header,
+		Body:      bm.Body,
+	}, nil
+}
+
+// cleanHeader removes headers added by error handler and retry topics
+func cleanHeader(md metadata.Metadata, target string) metadata.Metadata {
+	nmd := metadata.New(len(md))
+	for k, v := range md {
+		switch {
+		case k == HeaderError, k == HeaderAppname, k == retry.HeaderSourceTopic:
+		case strings.HasPrefix(k, retry.HeaderErrorPrefix), strings.HasPrefix(k, "Micro-Retry-"):
+		default:
+			nmd.Set(k, v)
+		}
+	}
+	nmd.Set(HeaderTopic, target)
+	nmd.Set(HeaderReplayed, time.Now().Format(time.RFC3339))
+	return nmd
+}
+
+// listOffsets returns log start and end offsets for all partitions of topic
+func listOffsets(ctx context.Context, cl kmsg.Requestor, topic string) (map[int32]int64, map[int32]int64, error) {
+	mreq := kmsg.NewPtrMetadataRequest()
+	mtopic := kmsg.NewMetadataRequestTopic()
+	mtopic.Topic = &topic
+	mreq.Topics = append(mreq.Topics, mtopic)
+	mresp, err := mreq.RequestWith(ctx, cl)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(mresp.Topics) != 1 {
+		return nil, nil, fmt.Errorf("dlq: topic %s not found", topic)
+	}
+	if err = kerr.ErrorForCode(mresp.Topics[0].ErrorCode); err != nil {
+		return nil, nil, fmt.Errorf("dlq: topic %s metadata: %w", topic, err)
+	}
+
+	list := func(timestamp int64) (map[int32]int64, error) {
+		req := kmsg.NewPtrListOffsetsRequest()
+		rtopic := kmsg.NewListOffsetsRequestTopic()
+		rtopic.Topic = topic
+		for _, p := range mresp.Topics[0].Partitions {
+			rp := kmsg.NewListOffsetsRequestTopicPartition()
+			rp.Partition = p.Partition
+			rp.Timestamp = timestamp
+			rtopic.Partitions = append(rtopic.Partitions, rp)
+		}
+		req.Topics = append(req.Topics, rtopic)
+		resp, err := req.RequestWith(ctx, cl)
+		if err != nil {
+			return nil, err
+		}
+		offsets := make(map[int32]int64)
+		for _, t := range resp.Topics {
+			for _, p := range t.Partitions {
+				if err = kerr.ErrorForCode(p.ErrorCode); err != nil {
+					return nil, fmt.Errorf("dlq: list offsets %s/%d: %w", topic, p.Partition, err)
+				}
+				offsets[p.Partition] = p.Offset
+			}
+		}
+		return offsets, nil
+	}
+
+	// -2 means earliest and -1 latest offset
+	start, err := list(-2)
+	if err != nil {
+		return nil, nil, err
+	}
+	end, err := list(-1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return start, end, nil
+}
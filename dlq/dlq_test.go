@@ -0,0 +1,202 @@
+package dlq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/codec/rawjson"
+	"github.com/presnalex/go-micro/v3/wrapper/retry"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/codec"
+	"go.unistack.org/micro/v3/metadata"
+)
+
+func TestFilter(t *testing.T) {
+	now := time.Now()
+	m := &Message{
+		Topic:     "orders.errors",
+		Timestamp: now,
+		Header: metadata.Metadata{
+			HeaderAppname: "orders",
+			HeaderError:   "context deadline exceeded",
+			"X-Tenant":    "acme",
+		},
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		match  bool
+	}{
+		{"empty", Filter{}, true},
+		{"app", Filter{AppName: "orders"}, true},
+		{"other_app", Filter{AppName: "billing"}, false},
+		{"error", Filter{ErrorContains: "deadline"}, true},
+		{"other_error", Filter{ErrorContains: "refused"}, false},
+		{"time_range", Filter{From: now.Add(-time.Minute), To: now.Add(time.Minute)}, true},
+		{"before_range", Filter{From: now.Add(time.Minute)}, false},
+		{"after_range", Filter{To: now}, false},
+		{"header", Filter{Headers: map[string]string{"X-Tenant": "acme"}}, true},
+		{"other_header", Filter{Headers: map[string]string{"X-Tenant": "other"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if match := tt.filter.Match(m); match != tt.match {
+				t.Fatalf("match %v != %v", match, tt.match)
+			}
+		})
+	}
+}
+
+func TestSourceTopic(t *testing.T) {
+	m := &Message{Topic: "orders.errors", Header: metadata.Metadata{HeaderTopic: "orders.errors"}}
+	if topic := m.SourceTopic(); topic != "" {
+		t.Fatalf("source topic must be unknown, got %s", topic)
+	}
+	m.Header[HeaderTopic] = "orders"
+	if topic := m.SourceTopic(); topic != "orders" {
+		t.Fatalf("source topic %s != orders", topic)
+	}
+	m.Header[retry.HeaderSourceTopic] = "orders.v2"
+	if topic := m.SourceTopic(); topic != "orders.v2" {
+		t.Fatalf("source topic %s != orders.v2", topic)
+	}
+}
+
+func TestCleanHeader(t *testing.T) {
+	md := cleanHeader(metadata.Metadata{
+		HeaderError:             "boom",
+		HeaderAppname:           "orders",
+		retry.HeaderSourceTopic: "orders",
+		retry.HeaderAttempt:     "3",
+		retry.HeaderNotBefore:   time.Now().Format(time.RFC3339Nano),
+		retry.ErrorHeader(1):    "boom",
+		"X-Request-Id":          "1",
+	}, "orders")
+
+	if len(md) != 3 {
+		t.Fatalf("unexpected headers %v", md)
+	}
+	if v, _ := md.Get("X-Request-Id"); v != "1" {
+		t.Fatalf("request id lost: %v", md)
+	}
+	if v, _ := md.Get(HeaderTopic); v != "orders" {
+		t.Fatalf("topic %s != orders", v)
+	}
+}
+
+// testKafka serves single partition topic and keeps produced records
+type testKafka struct {
+	topic    string
+	records  []*kgo.Record
+	polled   bool
+	produced []*kgo.Record
+}
+
+func (k *testKafka) Request(ctx context.Context, req kmsg.Request) (kmsg.Response, error) {
+	switch r := req.(type) {
+	case *kmsg.MetadataRequest:
+		resp := kmsg.NewPtrMetadataResponse()
+		t := kmsg.NewMetadataResponseTopic()
+		t.Topic = kmsg.StringPtr(k.topic)
+		t.Partitions = append(t.Partitions, kmsg.NewMetadataResponseTopicPartition())
+		resp.Topics = append(resp.Topics, t)
+		return resp, nil
+	case *kmsg.ListOffsetsRequest:
+		resp := kmsg.NewPtrListOffsetsResponse()
+		t := kmsg.NewListOffsetsResponseTopic()
+		t.Topic = k.topic
+		p := kmsg.NewListOffsetsResponseTopicPartition()
+		if r.Topics[0].Partitions[0].Timestamp == -1 {
+			p.Offset = int64(len(k.records))
+		}
+		t.Partitions = append(t.Partitions, p)
+		resp.Topics = append(resp.Topics, t)
+		return resp, nil
+	}
+	return nil, fmt.Errorf("unexpected request %T", req)
+}
+
+func (k *testKafka) ProduceSync(ctx context.Context, rs ...*kgo.Record) kgo.ProduceResults {
+	k.produced = append(k.produced, rs...)
+	results := make(kgo.ProduceResults, 0, len(rs))
+	for _, r := range rs {
+		results = append(results, kgo.ProduceResult{Record: r})
+	}
+	return results
+}
+
+func (k *testKafka) PollFetches(ctx context.Context) kgo.Fetches {
+	if k.polled {
+		<-ctx.Done()
+		return nil
+	}
+	k.polled = true
+	return kgo.Fetches{{Topics: []kgo.FetchTopic{{Topic: k.topic, Partitions: []kgo.FetchPartition{{Records: k.records}}}}}}
+}
+
+func (k *testKafka) Close() {}
+
+// testCodec fails to encode messages with body "unencodable"
+type testCodec struct {
+	codec.Codec
+}
+
+func (c testCodec) Marshal(v interface{}, opts ...codec.Option) ([]byte, error) {
+	if m, ok := v.(*broker.Message); ok && string(m.Body) == "unencodable" {
+		return nil, errors.New("unencodable")
+	}
+	return c.Codec.Marshal(v, opts...)
+}
+
+func TestReplayerRun(t *testing.T) {
+	c := rawjson.NewCodec()
+	k := &testKafka{topic: "errors"}
+	for i, m := range []*broker.Message{
+		{Header: metadata.Metadata{retry.HeaderSourceTopic: "orders", HeaderError: "boom", "X-Request-Id": "1"}, Body: []byte(`{"id":1}`)},
+		nil,
+		{Header: metadata.Metadata{HeaderTopic: "errors"}, Body: []byte(`{"id":3}`)},
+		{Header: metadata.Metadata{retry.HeaderSourceTopic: "orders"}, Body: []byte("unencodable")},
+	} {
+		value := []byte("not json")
+		if m != nil {
+			var err error
+			if value, err = c.Marshal(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		k.records = append(k.records, &kgo.Record{Topic: "errors", Offset: int64(i), Key: []byte(fmt.Sprint(i)), Value: value})
+	}
+
+	r := NewReplayer(nil, Topic("errors"), Codec(testCodec{c}), IdleTimeout(10*time.Millisecond))
+	r.newClient = func(kopts ...kgo.Opt) (kafkaClient, error) { return k, nil }
+
+	report, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := Report{Read: 4, Matched: 3, Replayed: 1, Skipped: 1, Undecoded: 1, Unencoded: 1}
+	if report != expect {
+		t.Fatalf("report %s, expected %s", report, expect)
+	}
+
+	if len(k.produced) != 1 || k.produced[0].Topic != "orders" || string(k.produced[0].Key) != "0" {
+		t.Fatalf("unexpected produced records %v", k.produced)
+	}
+	m := &broker.Message{}
+	if err = c.Unmarshal(k.produced[0].Value, m); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Header.Get(HeaderError); ok || string(m.Body) != `{"id":1}` {
+		t.Fatalf("replayed message %v %s", m.Header, m.Body)
+	}
+	if v, _ := m.Header.Get("X-Request-Id"); v != "1" {
+		t.Fatalf("request id lost: %v", m.Header)
+	}
+}
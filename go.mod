@@ -9,16 +9,20 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/jackc/pgx/v4 v4.17.2
 	github.com/jmoiron/sqlx v1.3.5
+	github.com/linkedin/goavro/v2 v2.11.1
+	github.com/nats-io/nats.go v1.11.0
 	github.com/presnalex/codec-bytes v0.0.1
 	github.com/presnalex/micro-wrapper-metrics-prometheus v0.0.2
 	github.com/prometheus/client_golang v1.11.1
+	github.com/rabbitmq/amqp091-go v1.5.0
 	github.com/segmentio/encoding v0.3.6
 	github.com/twmb/franz-go v1.11.5
+	github.com/twmb/franz-go/pkg/kmsg v1.3.0
 	go.uber.org/zap v1.19.1
 	go.unistack.org/micro-broker-kgo/v3 v3.8.3
 	go.unistack.org/micro-codec-proto/v3 v3.8.0
 	go.unistack.org/micro-logger-zap/v3 v3.8.0
 	go.unistack.org/micro/v3 v3.10.10
 	google.golang.org/protobuf v1.28.1
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,43 @@
+package health
+
+import (
+	"context"
+
+	"github.com/presnalex/go-micro/v3/service"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/client"
+)
+
+// Pinger is implemented by *sqlx.DB and database/wrapper.Wrapper
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// DB checks database connection, name is usually config section like "postgres"
+func DB(name string, db Pinger) Checker {
+	return CheckerFunc(name, db.PingContext)
+}
+
+// Kafka checks that brokers of b respond to metadata request, b is broker created by service.InitBroker.
+// Client of broker is reused, so check fails with broker.ErrNotConnected until broker is connected.
+func Kafka(b broker.Broker) Checker {
+	return CheckerFunc("kafka", func(ctx context.Context) error {
+		cl := service.KafkaClient(b)
+		if cl == nil {
+			return broker.ErrNotConnected
+		}
+		// metadata without topics lists brokers only
+		req := kmsg.NewPtrMetadataRequest()
+		req.Topics = []kmsg.MetadataRequestTopic{}
+		_, err := req.RequestWith(ctx, cl)
+		return err
+	})
+}
+
+// Service checks downstream micro service calling endpoint with req, rsp is filled by reply
+func Service(c client.Client, svc string, endpoint string, req interface{}, rsp interface{}) Checker {
+	return CheckerFunc(svc, func(ctx context.Context) error {
+		return c.Call(ctx, c.NewRequest(svc, endpoint, req), rsp)
+	})
+}
@@ -0,0 +1,92 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gorilla/mux"
+	"github.com/presnalex/go-micro/v3/rest"
+	"go.unistack.org/micro/v3/api"
+)
+
+// build info set by linker, like -ldflags "-X github.com/presnalex/go-micro/v3/health.Revision=$(git rev-parse HEAD)"
+var (
+	Revision  string
+	BuildTime string
+)
+
+// VersionInfo is reply of /version
+type VersionInfo struct {
+	Name      string `json:"name,omitempty"`
+	Version   string `json:"version,omitempty"`
+	ID        string `json:"id,omitempty"`
+	Revision  string `json:"revision,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	Module    string `json:"module,omitempty"`
+	Go        string `json:"go"`
+}
+
+// Handler serves /live, /ready and /version, loggerMiddleware of rest does not log them
+type Handler struct {
+	h *Health
+}
+
+func NewHandler(h *Health) *Handler {
+	return &Handler{h: h}
+}
+
+func Endpoints() []*api.Endpoint {
+	return []*api.Endpoint{
+		{Name: "Health.Live", Method: []string{http.MethodGet}, Path: []string{"/live"}},
+		{Name: "Health.Ready", Method: []string{http.MethodGet}, Path: []string{"/ready"}},
+		{Name: "Health.Version", Method: []string{http.MethodGet}, Path: []string{"/version"}},
+	}
+}
+
+// Register registers health endpoints
+func Register(r *mux.Router, h *Health) error {
+	return rest.Register(r, NewHandler(h), Endpoints())
+}
+
+func (h *Handler) Live(w http.ResponseWriter, r *http.Request) {
+	writeResult(w, h.h.Live(r.Context()))
+}
+
+func (h *Handler) Ready(w http.ResponseWriter, r *http.Request) {
+	writeResult(w, h.h.Ready(r.Context()))
+}
+
+func (h *Handler) Version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.h.Version())
+}
+
+// Version returns version of server and build info
+func (h *Health) Version() VersionInfo {
+	v := VersionInfo{Revision: Revision, BuildTime: BuildTime, Go: runtime.Version()}
+	if cfg := h.options.Server; cfg != nil {
+		v.Name, v.Version, v.ID = cfg.Name, cfg.Version, cfg.ID
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		v.Module = bi.Main.Path
+		if v.Version == "" && bi.Main.Version != "(devel)" {
+			v.Version = bi.Main.Version
+		}
+	}
+	return v
+}
+
+func writeResult(w http.ResponseWriter, res Result) {
+	code := http.StatusOK
+	if res.Status != StatusOK {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, res)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,169 @@
+// Package health provides liveness, readiness and version endpoints backed by component checks.
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/service"
+)
+
+var DefaultTimeout = 5 * time.Second
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+	// app is starting or shutting down
+	StatusNotReady = "not ready"
+)
+
+// Checker checks single component, like database or broker
+type Checker interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+type checkerFunc struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+func (c checkerFunc) Name() string { return c.name }
+
+func (c checkerFunc) Check(ctx context.Context) error { return c.fn(ctx) }
+
+// CheckerFunc makes Checker of fn
+func CheckerFunc(name string, fn func(ctx context.Context) error) Checker {
+	return checkerFunc{name: name, fn: fn}
+}
+
+type Options struct {
+	// limits each check
+	Timeout time.Duration
+	// app readiness, like service.App.Ready, checked before readiness checks
+	Ready func() bool
+	// name, version and id returned by /version
+	Server *service.ServerConfig
+}
+
+type Option func(*Options)
+
+func Timeout(d time.Duration) Option {
+	return func(opts *Options) {
+		opts.Timeout = d
+	}
+}
+
+func Ready(fn func() bool) Option {
+	return func(opts *Options) {
+		opts.Ready = fn
+	}
+}
+
+func Server(cfg *service.ServerConfig) Option {
+	return func(opts *Options) {
+		opts.Server = cfg
+	}
+}
+
+// CheckResult is result of single check
+type CheckResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Result is reply of /live and /ready
+type Result struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Health keeps checks of liveness and readiness
+type Health struct {
+	options Options
+
+	mu    sync.RWMutex
+	live  []Checker
+	ready []Checker
+}
+
+func New(opts ...Option) *Health {
+	options := Options{
+		Timeout: DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return &Health{options: options}
+}
+
+// AddLive adds checks failing liveness, so process is restarted, they must not depend on other services
+func (h *Health) AddLive(checks ...Checker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.live = append(h.live, checks...)
+}
+
+// AddReady adds checks failing readiness, so instance gets no traffic while they fail
+func (h *Health) AddReady(checks ...Checker) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = append(h.ready, checks...)
+}
+
+// Live runs liveness checks
+func (h *Health) Live(ctx context.Context) Result {
+	h.mu.RLock()
+	checks := h.live
+	h.mu.RUnlock()
+	return h.run(ctx, checks)
+}
+
+// Ready runs readiness checks if app is ready
+func (h *Health) Ready(ctx context.Context) Result {
+	if h.options.Ready != nil && !h.options.Ready() {
+		return Result{Status: StatusNotReady}
+	}
+	h.mu.RLock()
+	checks := h.ready
+	h.mu.RUnlock()
+	return h.run(ctx, checks)
+}
+
+// run runs checks concurrently, each limited by timeout
+func (h *Health) run(ctx context.Context, checks []Checker) Result {
+	res := Result{Status: StatusOK}
+	if len(checks) == 0 {
+		return res
+	}
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c Checker) {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, h.options.Timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := c.Check(cctx)
+			results[i] = CheckResult{Status: StatusOK, Duration: time.Since(start).String()}
+			if err != nil {
+				results[i].Status, results[i].Error = StatusFail, err.Error()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	res.Checks = make(map[string]CheckResult, len(checks))
+	for i, c := range checks {
+		res.Checks[c.Name()] = results[i]
+		if results[i].Status != StatusOK {
+			res.Status = StatusFail
+		}
+	}
+	return res
+}
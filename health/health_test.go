@@ -0,0 +1,85 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/presnalex/go-micro/v3/service"
+	"go.unistack.org/micro/v3/broker"
+)
+
+func TestReady(t *testing.T) {
+	ready := false
+	h := New(Ready(func() bool { return ready }), Server(&service.ServerConfig{Name: "orders", Version: "1.2.0"}))
+	var dbErr error
+	h.AddReady(
+		DB("postgres", pinger(func(ctx context.Context) error { return dbErr })),
+		CheckerFunc("cache", func(ctx context.Context) error { return nil }),
+	)
+	hh := NewHandler(h)
+
+	get := func(fn http.HandlerFunc) (int, Result) {
+		w := httptest.NewRecorder()
+		fn(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		var res Result
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, res
+	}
+
+	if code, res := get(hh.Ready); code != http.StatusServiceUnavailable || res.Status != StatusNotReady {
+		t.Fatalf("not started app is ready: %d %+v", code, res)
+	}
+	if code, res := get(hh.Live); code != http.StatusOK || res.Status != StatusOK {
+		t.Fatalf("not live: %d %+v", code, res)
+	}
+
+	ready = true
+	if code, res := get(hh.Ready); code != http.StatusOK || len(res.Checks) != 2 {
+		t.Fatalf("not ready: %d %+v", code, res)
+	}
+
+	dbErr = errors.New("connection refused")
+	code, res := get(hh.Ready)
+	if code != http.StatusServiceUnavailable || res.Checks["postgres"].Error != "connection refused" || res.Checks["cache"].Status != StatusOK {
+		t.Fatalf("failed check not reported: %d %+v", code, res)
+	}
+
+	w := httptest.NewRecorder()
+	hh.Version(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var v VersionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "orders" || v.Version != "1.2.0" || v.Go == "" {
+		t.Fatalf("unexpected version %+v", v)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r := mux.NewRouter()
+	if err := Register(r, New()); err != nil {
+		t.Fatal(err)
+	}
+	for _, ep := range Endpoints() {
+		if r.Get(ep.Name) == nil {
+			t.Fatalf("%s not registered", ep.Name)
+		}
+	}
+}
+
+type pinger func(ctx context.Context) error
+
+func (p pinger) PingContext(ctx context.Context) error { return p(ctx) }
+
+func TestKafkaNotConnected(t *testing.T) {
+	if err := Kafka(broker.NewBroker()).Check(context.Background()); !errors.Is(err, broker.ErrNotConnected) {
+		t.Fatalf("expected %v, got %v", broker.ErrNotConnected, err)
+	}
+}
@@ -2,6 +2,7 @@ package rest
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -12,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/presnalex/go-micro/v3/wrapper/recovery"
 	"github.com/presnalex/go-micro/v3/wrapper/requestid"
 	"go.unistack.org/micro/v3/metadata"
 
@@ -57,11 +59,32 @@ func Register(r *mux.Router, h interface{}, eps []*api.Endpoint) error {
 		r.HandleFunc(ep.Path[0], rh).Methods(ep.Method...).Name(ep.Name)
 	}
 
-	r.Use([]mux.MiddlewareFunc{requestIdMiddleware, loggerMiddleware}...)
+	r.Use(middleware)
 
 	return nil
 }
 
+// middlewares are applied to registered endpoints in order
+var middlewares = []mux.MiddlewareFunc{requestIdMiddleware, loggerMiddleware, recovery.Middleware}
+
+type middlewareKey struct{}
+
+// middleware applies middlewares once per request, so router and its subrouters
+// passed to several Register calls do not log and recover requests twice
+func middleware(next http.Handler) http.Handler {
+	h := next
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(middlewareKey{}) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), middlewareKey{}, true)))
+	})
+}
+
 func requestIdMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		id := r.Header.Get(RequestIDHeader)
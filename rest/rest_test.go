@@ -2,6 +2,7 @@ package rest
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/gorilla/mux"
@@ -53,3 +54,35 @@ func TestRegister(t *testing.T) {
 	}
 
 }
+
+func TestRegisterMiddlewareOnce(t *testing.T) {
+	var calls int
+	defer func(m []mux.MiddlewareFunc) { middlewares = m }(middlewares)
+	middlewares = []mux.MiddlewareFunc{func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			next.ServeHTTP(w, r)
+		})
+	}}
+
+	eps := []*api.Endpoint{{Name: "service.Method", Method: []string{"GET"}, Path: []string{"/method"}}}
+	r := mux.NewRouter()
+	for i := 0; i < 2; i++ {
+		if err := Register(r, &handler{}, eps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sr := r.PathPrefix("/sub").Subrouter()
+	if err := Register(sr, &handler{}, eps); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/method", "/sub/method"} {
+		calls = 0
+		rsp := httptest.NewRecorder()
+		r.ServeHTTP(rsp, httptest.NewRequest(http.MethodGet, path, nil))
+		if rsp.Code != http.StatusOK || calls != 1 {
+			t.Fatalf("%s: code %d, middleware called %d times", path, rsp.Code, calls)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/logger"
+)
+
+const (
+	KafkaCleanupDelete        = "delete"
+	KafkaCleanupCompact       = "compact"
+	KafkaCleanupCompactDelete = "compact,delete"
+)
+
+// KafkaTopicSpec declares topic, zero values are left to broker defaults
+type KafkaTopicSpec struct {
+	Name              string `json:"name"`
+	Partitions        int32  `json:"partitions"`
+	ReplicationFactor int16  `json:"replication_factor"`
+	// retention.ms, negative means unlimited
+	Retention      Duration `json:"retention"`
+	RetentionBytes int64    `json:"retention_bytes"`
+	// "delete", "compact" or "compact,delete"
+	CleanupPolicy          string   `json:"cleanup_policy"`
+	MinCompactionLag       Duration `json:"min_compaction_lag"`
+	MaxCompactionLag       Duration `json:"max_compaction_lag"`
+	MinCleanableDirtyRatio float64  `json:"min_cleanable_dirty_ratio"`
+	// how long tombstones of compacted topic are kept
+	DeleteRetention Duration `json:"delete_retention"`
+	// any other topic configs, like {"min.insync.replicas": "2"}
+	Configs map[string]string `json:"configs"`
+}
+
+// configs returns topic configs set by spec
+func (s KafkaTopicSpec) configs() map[string]string {
+	configs := make(map[string]string, len(s.Configs)+7)
+	for k, v := range s.Configs {
+		configs[k] = v
+	}
+	ms := func(d Duration) string {
+		return strconv.FormatInt(int64(d.Duration/time.Millisecond), 10)
+	}
+	switch {
+	case s.Retention.Duration < 0:
+		configs["retention.ms"] = "-1"
+	case s.Retention.Duration > 0:
+		configs["retention.ms"] = ms(s.Retention)
+	}
+	if s.RetentionBytes != 0 {
+		configs["retention.bytes"] = strconv.FormatInt(s.RetentionBytes, 10)
+	}
+	if s.CleanupPolicy != "" {
+		configs["cleanup.policy"] = s.CleanupPolicy
+	}
+	if s.MinCompactionLag.Duration > 0 {
+		configs["min.compaction.lag.ms"] = ms(s.MinCompactionLag)
+	}
+	if s.MaxCompactionLag.Duration > 0 {
+		configs["max.compaction.lag.ms"] = ms(s.MaxCompactionLag)
+	}
+	if s.MinCleanableDirtyRatio > 0 {
+		configs["min.cleanable.dirty.ratio"] = strconv.FormatFloat(s.MinCleanableDirtyRatio, 'f', -1, 64)
+	}
+	if s.DeleteRetention.Duration > 0 {
+		configs["delete.retention.ms"] = ms(s.DeleteRetention)
+	}
+	return configs
+}
+
+func validateKafkaTopics(specs []KafkaTopicSpec) error {
+	names := make(map[string]struct{}, len(specs))
+	for _, s := range specs {
+		if s.Name == "" {
+			return fmt.Errorf("kafka topics: topic name required")
+		}
+		if _, ok := names[s.Name]; ok {
+			return fmt.Errorf("kafka topics: topic %s declared twice", s.Name)
+		}
+		names[s.Name] = struct{}{}
+		if s.Partitions < 0 || s.ReplicationFactor < 0 {
+			return fmt.Errorf("kafka topics: topic %s partitions and replication_factor must not be negative", s.Name)
+		}
+		switch s.CleanupPolicy {
+		case "", KafkaCleanupDelete, KafkaCleanupCompact, KafkaCleanupCompactDelete, "delete,compact":
+		default:
+			return fmt.Errorf("kafka topics: topic %s unsupported cleanup_policy %q, must be %q, %q or %q",
+				s.Name, s.CleanupPolicy, KafkaCleanupDelete, KafkaCleanupCompact, KafkaCleanupCompactDelete)
+		}
+		if s.MinCompactionLag.Duration < 0 || s.MaxCompactionLag.Duration < 0 || s.DeleteRetention.Duration < 0 {
+			return fmt.Errorf("kafka topics: topic %s compaction durations must not be negative", s.Name)
+		}
+		if s.MaxCompactionLag.Duration > 0 && s.MinCompactionLag.Duration > s.MaxCompactionLag.Duration {
+			return fmt.Errorf("kafka topics: topic %s min_compaction_lag greater than max_compaction_lag", s.Name)
+		}
+		if s.MinCleanableDirtyRatio < 0 || s.MinCleanableDirtyRatio > 1 {
+			return fmt.Errorf("kafka topics: topic %s min_cleanable_dirty_ratio must be between 0 and 1", s.Name)
+		}
+	}
+	return nil
+}
+
+// KafkaTopicDrift is difference between declared and actual topic setting
+type KafkaTopicDrift struct {
+	Topic    string `json:"topic"`
+	Setting  string `json:"setting"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+func (d KafkaTopicDrift) String() string {
+	return fmt.Sprintf("%s %s: expected %s, actual %s", d.Topic, d.Setting, d.Expected, d.Actual)
+}
+
+type KafkaTopicsReport struct {
+	Created []string `json:"created"`
+	// missing topics in validate only mode, validated by broker but not created
+	Missing []string          `json:"missing"`
+	Drift   []KafkaTopicDrift `json:"drift"`
+}
+
+// Err returns error if topics are missing or drifted
+func (r *KafkaTopicsReport) Err() error {
+	var msgs []string
+	if len(r.Missing) > 0 {
+		msgs = append(msgs, "missing topics "+strings.Join(r.Missing, ", "))
+	}
+	for _, d := range r.Drift {
+		msgs = append(msgs, d.String())
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.New("kafka topics: " + strings.Join(msgs, "; "))
+}
+
+// EnsureKafkaTopics creates missing topics declared in BrokerConfig.Topics and reports drift of existing ones,
+// existing topics are never changed. In validate only mode create requests are only validated by broker.
+func EnsureKafkaTopics(ctx context.Context, cfg *BrokerConfig, validateOnly bool) (*KafkaTopicsReport, error) {
+	if err := validateKafkaTopics(cfg.Topics); err != nil {
+		return nil, err
+	}
+	cl, err := NewKafkaClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer cl.Close()
+
+	return ensureKafkaTopics(ctx, cl, cfg.Topics, validateOnly)
+}
+
+func ensureKafkaTopics(ctx context.Context, cl kafkaRequester, specs []KafkaTopicSpec, validateOnly bool) (*KafkaTopicsReport, error) {
+	report := &KafkaTopicsReport{}
+	if len(specs) == 0 {
+		return report, nil
+	}
+
+	mreq := kmsg.NewPtrMetadataRequest()
+	for _, s := range specs {
+		mt := kmsg.NewMetadataRequestTopic()
+		mt.Topic = kmsg.StringPtr(s.Name)
+		mreq.Topics = append(mreq.Topics, mt)
+	}
+	mresp, err := mreq.RequestWith(ctx, cl)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]kmsg.MetadataResponseTopic, len(mresp.Topics))
+	for _, t := range mresp.Topics {
+		if t.Topic == nil {
+			continue
+		}
+		err = kerr.ErrorForCode(t.ErrorCode)
+		switch {
+		case err == nil:
+			existing[*t.Topic] = t
+		case errors.Is(err, kerr.UnknownTopicOrPartition):
+		default:
+			return nil, fmt.Errorf("kafka topics: metadata of %s: %w", *t.Topic, err)
+		}
+	}
+
+	var missing []KafkaTopicSpec
+	var present []KafkaTopicSpec
+	for _, s := range specs {
+		if _, ok := existing[s.Name]; ok {
+			present = append(present, s)
+		} else {
+			missing = append(missing, s)
+		}
+	}
+
+	if err = createKafkaTopics(ctx, cl, missing, validateOnly, report); err != nil {
+		return nil, err
+	}
+	if err = driftKafkaTopics(ctx, cl, present, existing, report); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func createKafkaTopics(ctx context.Context, cl kafkaRequester, specs []KafkaTopicSpec, validateOnly bool, report *KafkaTopicsReport) error {
+	if len(specs) == 0 {
+		return nil
+	}
+
+	req := kmsg.NewPtrCreateTopicsRequest()
+	req.ValidateOnly = validateOnly
+	if deadline, ok := ctx.Deadline(); ok {
+		req.TimeoutMillis = int32(time.Until(deadline) / time.Millisecond)
+	}
+	for _, s := range specs {
+		rt := kmsg.NewCreateTopicsRequestTopic()
+		rt.Topic = s.Name
+		rt.NumPartitions, rt.ReplicationFactor = -1, -1
+		if s.Partitions > 0 {
+			rt.NumPartitions = s.Partitions
+		}
+		if s.ReplicationFactor > 0 {
+			rt.ReplicationFactor = s.ReplicationFactor
+		}
+		for k, v := range s.configs() {
+			rc := kmsg.NewCreateTopicsRequestTopicConfig()
+			rc.Name, rc.Value = k, kmsg.StringPtr(v)
+			rt.Configs = append(rt.Configs, rc)
+		}
+		req.Topics = append(req.Topics, rt)
+	}
+
+	resp, err := req.RequestWith(ctx, cl)
+	if err != nil {
+		return err
+	}
+	for _, t := range resp.Topics {
+		err = kerr.ErrorForCode(t.ErrorCode)
+		switch {
+		case err == nil && validateOnly:
+			report.Missing = append(report.Missing, t.Topic)
+		case err == nil:
+			report.Created = append(report.Created, t.Topic)
+		case errors.Is(err, kerr.TopicAlreadyExists):
+			// created concurrently by other instance
+		default:
+			if t.ErrorMessage != nil {
+				err = fmt.Errorf("%w: %s", err, *t.ErrorMessage)
+			}
+			return fmt.Errorf("kafka topics: create %s: %w", t.Topic, err)
+		}
+	}
+	sort.Strings(report.Created)
+	sort.Strings(report.Missing)
+
+	return nil
+}
+
+func driftKafkaTopics(ctx context.Context, cl kafkaRequester, specs []KafkaTopicSpec, existing map[string]kmsg.MetadataResponseTopic, report *KafkaTopicsReport) error {
+	if len(specs) == 0 {
+		return nil
+	}
+
+	req := kmsg.NewPtrDescribeConfigsRequest()
+	for _, s := range specs {
+		rr := kmsg.NewDescribeConfigsRequestResource()
+		rr.ResourceType = kmsg.ConfigResourceTypeTopic
+		rr.ResourceName = s.Name
+		req.Resources = append(req.Resources, rr)
+	}
+	resp, err := req.RequestWith(ctx, cl)
+	if err != nil {
+		return err
+	}
+	actual := make(map[string]map[string]string, len(resp.Resources))
+	for _, r := range resp.Resources {
+		if err = kerr.ErrorForCode(r.ErrorCode); err != nil {
+			return fmt.Errorf("kafka topics: describe configs of %s: %w", r.ResourceName, err)
+		}
+		configs := make(map[string]string, len(r.Configs))
+		for _, c := range r.Configs {
+			if c.Value != nil {
+				configs[c.Name] = *c.Value
+			}
+		}
+		actual[r.ResourceName] = configs
+	}
+
+	for _, s := range specs {
+		t := existing[s.Name]
+		drift := func(setting string, expected string, actual string) {
+			report.Drift = append(report.Drift, KafkaTopicDrift{Topic: s.Name, Setting: setting, Expected: expected, Actual: actual})
+		}
+		if s.Partitions > 0 && int(s.Partitions) != len(t.Partitions) {
+			drift("partitions", strconv.Itoa(int(s.Partitions)), strconv.Itoa(len(t.Partitions)))
+		}
+		if s.ReplicationFactor > 0 && len(t.Partitions) > 0 && int(s.ReplicationFactor) != len(t.Partitions[0].Replicas) {
+			drift("replication_factor", strconv.Itoa(int(s.ReplicationFactor)), strconv.Itoa(len(t.Partitions[0].Replicas)))
+		}
+
+		configs := s.configs()
+		keys := make([]string, 0, len(configs))
+		for k := range configs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if v, ok := actual[s.Name][k]; !ok || !equalKafkaConfig(k, configs[k], v) {
+				drift(k, configs[k], v)
+			}
+		}
+	}
+
+	return nil
+}
+
+func equalKafkaConfig(name string, expected string, actual string) bool {
+	if name == "cleanup.policy" {
+		split := func(v string) []string {
+			parts := strings.Split(strings.ReplaceAll(v, " ", ""), ",")
+			sort.Strings(parts)
+			return parts
+		}
+		return strings.Join(split(expected), ",") == strings.Join(split(actual), ",")
+	}
+	ef, eerr := strconv.ParseFloat(expected, 64)
+	af, aerr := strconv.ParseFloat(actual, 64)
+	if eerr == nil && aerr == nil {
+		return ef == af
+	}
+	return expected == actual
+}
+
+// kafkaTopicsBroker creates declared topics on connect by client of wrapped broker, before subscribing
+type kafkaTopicsBroker struct {
+	broker.Broker
+	cfg *BrokerConfig
+}
+
+func newKafkaTopicsBroker(b broker.Broker, cfg *BrokerConfig) *kafkaTopicsBroker {
+	return &kafkaTopicsBroker{Broker: b, cfg: cfg}
+}
+
+func (b *kafkaTopicsBroker) Connect(ctx context.Context) error {
+	if err := b.Broker.Connect(ctx); err != nil {
+		return err
+	}
+	cl := KafkaClient(b.Broker)
+	if cl == nil {
+		return broker.ErrNotConnected
+	}
+
+	report, err := ensureKafkaTopics(ctx, cl, b.cfg.Topics, false)
+	if err != nil {
+		return err
+	}
+	if len(report.Created) > 0 {
+		logger.Infof(ctx, "kafka topics: created %s", strings.Join(report.Created, ", "))
+	}
+	for _, d := range report.Drift {
+		// changing partitions or configs of live topic is left to operator
+		logger.Warnf(ctx, "kafka topics: drift %s", d)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// testTopicAdmin keeps topics with partition count and configs
+type testTopicAdmin struct {
+	partitions map[string]int
+	configs    map[string]map[string]string
+	validated  []string
+}
+
+func (a *testTopicAdmin) Request(ctx context.Context, req kmsg.Request) (kmsg.Response, error) {
+	switch r := req.(type) {
+	case *kmsg.MetadataRequest:
+		resp := kmsg.NewPtrMetadataResponse()
+		for _, rt := range r.Topics {
+			t := kmsg.NewMetadataResponseTopic()
+			t.Topic = rt.Topic
+			n, ok := a.partitions[*rt.Topic]
+			if !ok {
+				t.ErrorCode = kerr.UnknownTopicOrPartition.Code
+			}
+			for i := 0; i < n; i++ {
+				p := kmsg.NewMetadataResponseTopicPartition()
+				p.Partition, p.Replicas = int32(i), []int32{1, 2}
+				t.Partitions = append(t.Partitions, p)
+			}
+			resp.Topics = append(resp.Topics, t)
+		}
+		return resp, nil
+	case *kmsg.CreateTopicsRequest:
+		resp := kmsg.NewPtrCreateTopicsResponse()
+		for _, rt := range r.Topics {
+			t := kmsg.NewCreateTopicsResponseTopic()
+			t.Topic = rt.Topic
+			if r.ValidateOnly {
+				a.validated = append(a.validated, rt.Topic)
+			} else {
+				a.partitions[rt.Topic] = int(rt.NumPartitions)
+				a.configs[rt.Topic] = make(map[string]string)
+				for _, c := range rt.Configs {
+					a.configs[rt.Topic][c.Name] = *c.Value
+				}
+			}
+			resp.Topics = append(resp.Topics, t)
+		}
+		return resp, nil
+	case *kmsg.DescribeConfigsRequest:
+		resp := kmsg.NewPtrDescribeConfigsResponse()
+		for _, rr := range r.Resources {
+			res := kmsg.NewDescribeConfigsResponseResource()
+			res.ResourceName = rr.ResourceName
+			for k, v := range a.configs[rr.ResourceName] {
+				c := kmsg.NewDescribeConfigsResponseResourceConfig()
+				c.Name, c.Value = k, kmsg.StringPtr(v)
+				res.Configs = append(res.Configs, c)
+			}
+			resp.Resources = append(resp.Resources, res)
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("unexpected request %T", req)
+}
+
+func TestEnsureKafkaTopics(t *testing.T) {
+	var specs []KafkaTopicSpec
+	if err := json.Unmarshal([]byte(`[
+		{"name": "orders", "partitions": 6, "replication_factor": 2, "retention": "168h", "cleanup_policy": "delete"},
+		{"name": "customers", "partitions": 3, "cleanup_policy": "compact", "min_cleanable_dirty_ratio": 0.1, "delete_retention": "24h"}
+	]`), &specs); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateKafkaTopics(specs); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &testTopicAdmin{
+		partitions: map[string]int{"orders": 3},
+		configs: map[string]map[string]string{"orders": {
+			"retention.ms":   "604800000",
+			"cleanup.policy": "compact,delete",
+		}},
+	}
+
+	report, err := ensureKafkaTopics(context.Background(), a, specs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Created) != 0 || len(report.Missing) != 1 || len(a.validated) != 1 || report.Missing[0] != "customers" {
+		t.Fatalf("validate only created topics: %+v", report)
+	}
+	expected := map[string]bool{"partitions": true, "cleanup.policy": true}
+	if len(report.Drift) != len(expected) {
+		t.Fatalf("unexpected drift %v", report.Drift)
+	}
+	for _, d := range report.Drift {
+		if d.Topic != "orders" || !expected[d.Setting] {
+			t.Fatalf("unexpected drift %s", d)
+		}
+	}
+	if report.Err() == nil {
+		t.Fatal("expected error for missing and drifted topics")
+	}
+
+	a.partitions["orders"] = 6
+	a.configs["orders"]["cleanup.policy"] = "delete"
+	if report, err = ensureKafkaTopics(context.Background(), a, specs, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Created) != 1 || report.Err() != nil {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if a.partitions["customers"] != 3 || a.configs["customers"]["cleanup.policy"] != "compact" ||
+		a.configs["customers"]["delete.retention.ms"] != fmt.Sprint(int64(24*time.Hour/time.Millisecond)) {
+		t.Fatalf("topic created with %d partitions, configs %v", a.partitions["customers"], a.configs["customers"])
+	}
+
+	if err = validateKafkaTopics(append(specs, KafkaTopicSpec{Name: "orders"})); err == nil {
+		t.Fatal("expected error for duplicate topic")
+	}
+	if err = validateKafkaTopics([]KafkaTopicSpec{{Name: "t", CleanupPolicy: "forever"}}); err == nil {
+		t.Fatal("expected error for unsupported cleanup policy")
+	}
+}
@@ -0,0 +1,353 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	dbwrapper "github.com/presnalex/go-micro/v3/database/wrapper"
+	mlogger "github.com/presnalex/go-micro/v3/logger"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/client"
+	"go.unistack.org/micro/v3/server"
+)
+
+// AppComponent is started by App after components it depends on and stopped before them
+type AppComponent struct {
+	Name  string
+	Start func(ctx context.Context) error
+	Stop  func(ctx context.Context) error
+}
+
+type AppOptions struct {
+	// server.DefaultServer by default
+	Server server.Server
+	// client.DefaultClient by default
+	Client client.Client
+	// opens pool of PostgresConfig section, like postgres.Connect
+	Postgres func(cfg *PostgresConfig) (*sqlx.DB, error)
+	// opens pool of OracleConfig section, like oracle.Connect
+	Oracle func(cfg *OracleConfig) (*sqlx.DB, error)
+	// started after databases and broker, before server
+	Components []AppComponent
+	// how long app stays not ready before stopping, so load balancers stop sending requests
+	DrainPeriod time.Duration
+	// limits each phase of shutdown
+	StopTimeout time.Duration
+	// signals starting shutdown in Run
+	Signals []os.Signal
+	// options of metrics server started if MetricConfig.Addr is set
+	Metrics []MetricsServerOption
+}
+
+type AppOption func(*AppOptions)
+
+func AppServer(s server.Server) AppOption {
+	return func(opts *AppOptions) {
+		opts.Server = s
+	}
+}
+
+func AppClient(c client.Client) AppOption {
+	return func(opts *AppOptions) {
+		opts.Client = c
+	}
+}
+
+func AppPostgres(connect func(cfg *PostgresConfig) (*sqlx.DB, error)) AppOption {
+	return func(opts *AppOptions) {
+		opts.Postgres = connect
+	}
+}
+
+func AppOracle(connect func(cfg *OracleConfig) (*sqlx.DB, error)) AppOption {
+	return func(opts *AppOptions) {
+		opts.Oracle = connect
+	}
+}
+
+func AppComponents(components ...AppComponent) AppOption {
+	return func(opts *AppOptions) {
+		opts.Components = append(opts.Components, components...)
+	}
+}
+
+func AppDrainPeriod(d time.Duration) AppOption {
+	return func(opts *AppOptions) {
+		opts.DrainPeriod = d
+	}
+}
+
+func AppStopTimeout(d time.Duration) AppOption {
+	return func(opts *AppOptions) {
+		opts.StopTimeout = d
+	}
+}
+
+func AppSignals(signals ...os.Signal) AppOption {
+	return func(opts *AppOptions) {
+		opts.Signals = signals
+	}
+}
+
+func AppMetrics(mopts ...MetricsServerOption) AppOption {
+	return func(opts *AppOptions) {
+		opts.Metrics = append(opts.Metrics, mopts...)
+	}
+}
+
+// App is service assembled from sections of single config struct:
+// logger.LoggerConfig, ServerConfig, ClientConfig, BrokerConfig, MetricConfig, CoreConfig, PostgresConfig and OracleConfig.
+// Sections are found by type among fields of config, databases are named by json name of their field.
+// Components are started in order metrics, databases, broker, AppOptions.Components, server
+// and stopped in reverse order, see Shutdown.
+type App struct {
+	options AppOptions
+
+	Server  server.Server
+	Client  client.Client
+	Broker  broker.Broker
+	Metrics *MetricsServer
+
+	dbs        map[string]*dbwrapper.Wrapper
+	components []AppComponent
+	inflight   *inflight
+	ready      int32
+
+	mu      sync.Mutex
+	started int
+}
+
+// appSections holds config sections found in config struct
+type appSections struct {
+	logger *mlogger.LoggerConfig
+	server *ServerConfig
+	client *ClientConfig
+	broker *BrokerConfig
+	metric *MetricConfig
+	core   *CoreConfig
+	// databases in order of fields
+	dbs []appDB
+}
+
+type appDB struct {
+	name     string
+	postgres *PostgresConfig
+	oracle   *OracleConfig
+}
+
+// New creates logger, broker, client and server, opens databases, cfg is pointer to config struct
+func New(cfg interface{}, opts ...AppOption) (*App, error) {
+	options := AppOptions{
+		Server:      server.DefaultServer,
+		Client:      client.DefaultClient,
+		DrainPeriod: defaultAppDrainPeriod,
+		StopTimeout: defaultAppStopTimeout,
+		Signals:     []os.Signal{syscall.SIGTERM, os.Interrupt},
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	rv := reflect.ValueOf(cfg)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("app: config must be pointer to struct, not %T", cfg)
+	}
+	sections := &appSections{}
+	sections.find(rv.Elem())
+
+	a := &App{options: options, dbs: make(map[string]*dbwrapper.Wrapper), inflight: newInflight()}
+	if err := a.init(sections); err != nil {
+		for _, db := range a.dbs {
+			_ = db.Close()
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *App) init(s *appSections) error {
+	if s.logger != nil {
+		mlogger.DefaultLogger(s.logger)
+	}
+
+	// server id is generated by ServerOptions and used in database metrics
+	var sopts []server.Option
+	if s.server != nil {
+		var err error
+		if sopts, err = ServerOptions(s.server); err != nil {
+			return err
+		}
+	}
+
+	if s.metric != nil && s.metric.Addr != "" {
+		a.Metrics = NewMetricsServer(s.metric, s.core, a.options.Metrics...)
+		a.components = append(a.components, AppComponent{
+			Name:  "metrics",
+			Start: a.Metrics.Start,
+			Stop:  a.Metrics.Stop,
+		})
+	}
+
+	var wopts []dbwrapper.Option
+	if s.server != nil {
+		wopts = append(wopts,
+			dbwrapper.ServiceName(s.server.Name),
+			dbwrapper.ServiceVersion(s.server.Version),
+			dbwrapper.ServiceID(s.server.ID),
+		)
+	}
+	for _, d := range s.dbs {
+		var (
+			db             *sqlx.DB
+			host, database string
+			err            error
+		)
+		switch {
+		case d.postgres != nil && a.options.Postgres == nil:
+			return fmt.Errorf("app: postgres section %s requires AppPostgres option", d.name)
+		case d.postgres != nil:
+			db, err = a.options.Postgres(d.postgres)
+			host, database = d.postgres.Addr, d.postgres.DBName
+		case a.options.Oracle == nil:
+			return fmt.Errorf("app: oracle section %s requires AppOracle option", d.name)
+		default:
+			db, err = a.options.Oracle(d.oracle)
+			host, database = d.oracle.Addr, d.oracle.DBName
+		}
+		if err != nil {
+			return fmt.Errorf("app: %s: %w", d.name, err)
+		}
+		dbopts := append([]dbwrapper.Option{dbwrapper.DBHost(host), dbwrapper.DBName(database)}, wopts...)
+		a.addDB(d.name, db, dbopts)
+	}
+
+	if s.broker != nil && s.broker.Type != "" {
+		b, err := InitBrokerE(s.broker)
+		if err != nil {
+			return err
+		}
+		a.Broker = b
+		a.components = append(a.components, AppComponent{
+			Name:  "broker",
+			Start: b.Connect,
+			Stop:  b.Disconnect,
+		})
+	}
+
+	a.components = append(a.components, a.options.Components...)
+
+	if s.client != nil {
+		if a.options.Client == nil {
+			return fmt.Errorf("app: client section requires AppClient option")
+		}
+		copts, err := ClientOptions(s.client)
+		if err != nil {
+			return err
+		}
+		if a.Broker != nil {
+			copts = append(copts, BrokerClientOptions(a.Broker)...)
+		}
+		if err = a.options.Client.Init(copts...); err != nil {
+			return err
+		}
+		a.Client = a.options.Client
+	}
+
+	if s.server != nil {
+		if a.options.Server == nil {
+			return fmt.Errorf("app: server section requires AppServer option")
+		}
+		if a.Broker != nil {
+			sopts = append(sopts, BrokerServerOptions(a.Broker)...)
+		}
+		sopts = append(sopts,
+			server.WrapHandler(a.inflight.handlerWrapper()),
+			server.WrapSubscriber(a.inflight.subscriberWrapper()),
+		)
+		if err := a.options.Server.Init(sopts...); err != nil {
+			return err
+		}
+		a.Server = a.options.Server
+		// stopped server accepts no new requests, then running ones are waited
+		a.components = append(a.components, AppComponent{
+			Name: "inflight",
+			Stop: a.inflight.wait,
+		}, AppComponent{
+			Name:  "server",
+			Start: func(context.Context) error { return a.Server.Start() },
+			Stop:  func(context.Context) error { return a.Server.Stop() },
+		})
+	}
+
+	return nil
+}
+
+func (a *App) addDB(name string, db *sqlx.DB, opts []dbwrapper.Option) {
+	w := dbwrapper.NewWrapper(db, opts...)
+	a.dbs[name] = w
+	a.components = append(a.components, AppComponent{
+		Name:  name,
+		Start: db.PingContext,
+		Stop:  func(context.Context) error { return w.Close() },
+	})
+}
+
+// DB returns database of section with json name, like "postgres"
+func (a *App) DB(name string) *dbwrapper.Wrapper {
+	return a.dbs[name]
+}
+
+// find collects sections among fields of config struct and its nested structs
+func (s *appSections) find(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+		if fv.Kind() != reflect.Struct || !fv.CanAddr() {
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			name = strings.ToLower(sf.Name)
+		}
+
+		switch p := fv.Addr().Interface().(type) {
+		case *mlogger.LoggerConfig:
+			s.logger = p
+		case *ServerConfig:
+			s.server = p
+		case *ClientConfig:
+			s.client = p
+		case *BrokerConfig:
+			s.broker = p
+		case *MetricConfig:
+			s.metric = p
+		case *CoreConfig:
+			s.core = p
+		case *PostgresConfig:
+			s.dbs = append(s.dbs, appDB{name: name, postgres: p})
+		case *OracleConfig:
+			s.dbs = append(s.dbs, appDB{name: name, oracle: p})
+		default:
+			if sf.Anonymous {
+				s.find(fv)
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/client"
+	"go.unistack.org/micro/v3/server"
+)
+
+type testAppServer struct {
+	server.Server
+	mu      sync.Mutex
+	events  *[]string
+	options server.Options
+}
+
+func (s *testAppServer) Init(opts ...server.Option) error {
+	for _, opt := range opts {
+		opt(&s.options)
+	}
+	return nil
+}
+
+func (s *testAppServer) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*s.events = append(*s.events, "start server")
+	return nil
+}
+
+func (s *testAppServer) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*s.events = append(*s.events, "stop server")
+	return nil
+}
+
+type testAppClient struct {
+	client.Client
+	options client.Options
+}
+
+func (c *testAppClient) Init(opts ...client.Option) error {
+	for _, opt := range opts {
+		opt(&c.options)
+	}
+	return nil
+}
+
+type testDBConnector struct{}
+
+func (testDBConnector) Connect(context.Context) (driver.Conn, error) { return testDBConn{}, nil }
+
+func (testDBConnector) Driver() driver.Driver { return nil }
+
+type testDBConn struct{}
+
+func (testDBConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+
+func (testDBConn) Close() error { return nil }
+
+func (testDBConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func TestApp(t *testing.T) {
+	defaultBroker := broker.DefaultBroker
+
+	cfg := &struct {
+		Server   ServerConfig   `json:"server"`
+		Client   ClientConfig   `json:"client"`
+		Broker   BrokerConfig   `json:"broker"`
+		Postgres PostgresConfig `json:"postgres"`
+		Reports  *PostgresConfig
+	}{
+		Server:   ServerConfig{Name: "orders", Addr: ":0"},
+		Broker:   BrokerConfig{Type: "memory"},
+		Postgres: PostgresConfig{Addr: "db:5432", DBName: "orders"},
+		Reports:  &PostgresConfig{Addr: "reports:5432", DBName: "reports"},
+	}
+
+	var events []string
+	component := func(name string, err error) AppComponent {
+		return AppComponent{
+			Name: name,
+			Start: func(context.Context) error {
+				events = append(events, "start "+name)
+				return err
+			},
+			Stop: func(context.Context) error {
+				events = append(events, "stop "+name)
+				return nil
+			},
+		}
+	}
+	var connected []string
+	connect := func(pcfg *PostgresConfig) (*sqlx.DB, error) {
+		connected = append(connected, pcfg.DBName)
+		return sqlx.NewDb(sql.OpenDB(testDBConnector{}), "pgx"), nil
+	}
+
+	srv, cli := &testAppServer{events: &events}, &testAppClient{}
+	a, err := New(cfg,
+		AppServer(srv),
+		AppClient(cli),
+		AppPostgres(connect),
+		AppComponents(component("consumer", nil)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.ID == "" || a.Broker == nil || a.Client == nil {
+		t.Fatalf("app not assembled: %+v", a)
+	}
+	if srv.options.Broker != a.Broker || cli.options.Broker != a.Broker {
+		t.Fatalf("server broker %v and client broker %v, expected configured %v", srv.options.Broker, cli.options.Broker, a.Broker)
+	}
+	if broker.DefaultBroker != defaultBroker {
+		t.Fatal("app must not replace broker.DefaultBroker")
+	}
+	if a.DB("postgres") == nil || a.DB("reports") == nil || !reflect.DeepEqual(connected, []string{"orders", "reports"}) {
+		t.Fatalf("databases not opened in order: %v", connected)
+	}
+
+	if err = a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"start consumer", "start server", "stop server", "stop consumer"}; !reflect.DeepEqual(events, expected) {
+		t.Fatalf("events %v, expected %v", events, expected)
+	}
+
+	// failed component stops started ones, server is not started
+	events = nil
+	a, err = New(cfg,
+		AppServer(&testAppServer{events: &events}),
+		AppClient(&testAppClient{}),
+		AppPostgres(connect),
+		AppComponents(component("consumer", nil), component("cache", errors.New("unavailable"))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Start(context.Background()); err == nil {
+		t.Fatal("expected start error")
+	}
+	if expected := []string{"start consumer", "start cache", "stop consumer"}; !reflect.DeepEqual(events, expected) {
+		t.Fatalf("events %v, expected %v", events, expected)
+	}
+
+	if _, err = New(cfg, AppServer(&testAppServer{events: &events})); err == nil {
+		t.Fatal("postgres section without connector accepted")
+	}
+}
+
+func TestAppShutdown(t *testing.T) {
+	var events []string
+	srv := &testAppServer{events: &events}
+	a, err := New(&struct {
+		Server ServerConfig `json:"server"`
+	}{Server: ServerConfig{Name: "orders", Addr: ":0"}},
+		AppServer(srv),
+		AppDrainPeriod(10*time.Millisecond),
+		AppStopTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Ready() {
+		t.Fatal("ready before start")
+	}
+	if err = a.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !a.Ready() {
+		t.Fatal("not ready after start")
+	}
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := a.inflight.handlerWrapper()(func(ctx context.Context, req server.Request, rsp interface{}) error {
+		close(started)
+		<-release
+		srv.mu.Lock()
+		events = append(events, "handler done")
+		srv.mu.Unlock()
+		return nil
+	})
+	go func() { _ = handler(context.Background(), nil, nil) }()
+	<-started
+
+	done := make(chan error)
+	go func() { done <- a.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	if a.Ready() {
+		t.Fatal("ready while shutting down")
+	}
+	select {
+	case err = <-done:
+		t.Fatalf("shutdown did not wait for handler: %v", err)
+	default:
+	}
+
+	close(release)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"start server", "stop server", "handler done"}; !reflect.DeepEqual(events, expected) {
+		t.Fatalf("events %v, expected %v", events, expected)
+	}
+}
@@ -2,105 +2,706 @@ package service
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	nats "github.com/nats-io/nats.go"
 	raw "github.com/presnalex/codec-bytes"
+	amqpbroker "github.com/presnalex/go-micro/v3/broker/amqp"
+	natsbroker "github.com/presnalex/go-micro/v3/broker/nats"
+	"github.com/presnalex/go-micro/v3/codec/rawjson"
+	"github.com/presnalex/go-micro/v3/codec/registry"
+	"github.com/presnalex/go-micro/v3/wrapper/retry"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/oauth"
 	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
 	kafka "go.unistack.org/micro-broker-kgo/v3"
 	"go.unistack.org/micro/v3/broker"
 	"go.unistack.org/micro/v3/client"
+	"go.unistack.org/micro/v3/codec"
 	"go.unistack.org/micro/v3/logger"
 	"go.unistack.org/micro/v3/metadata"
+	"go.unistack.org/micro/v3/server"
 )
 
+const (
+	SASLPlain       = "plain"
+	SASLScramSHA256 = "scram-sha-256"
+	SASLScramSHA512 = "scram-sha-512"
+	SASLOAuthBearer = "oauthbearer"
+)
+
+const (
+	// start offsets, same values as in kafka-go
+	kafkaLastOffset  int64 = -1
+	kafkaFirstOffset int64 = -2
+)
+
+// NewKafkaWriterConfig returns writer options, process exits on invalid settings,
+// so broker never connects without configured tls or sasl. Use NewKafkaWriterConfigE to get the error
 func NewKafkaWriterConfig(cfg *BrokerConfig) []broker.Option {
+	opts, err := NewKafkaWriterConfigE(cfg)
+	if err != nil {
+		logger.Fatalf(context.Background(), "kafka writer: %v", err)
+	}
+	return opts
+}
+
+func NewKafkaWriterConfigE(cfg *BrokerConfig) ([]broker.Option, error) {
 	var opts []broker.Option
 
-	kopts := []kgo.Opt{
-		kgo.FetchMaxWait(1 * time.Second),
-		kgo.StopProducerOnDataLossDetected(),
-		kgo.ClientID(cfg.ClientID),
-		kgo.ProducerBatchCompression(kgo.NoCompression()),
-		kgo.MaxBufferedRecords(1000),
-		kgo.RequiredAcks(kgo.LeaderAck()),
-		// kgo.ProducerLinger(1 * time.Second), dont set by default to speedup publishing
-		kgo.ProducerBatchMaxBytes(1 * 1024 * 1024),
-	}
-	if len(cfg.Username) > 0 && len(cfg.Password) > 0 {
-		kopts = append(kopts,
-			kgo.SASL((plain.Auth{User: cfg.Username, Pass: cfg.Password}).AsMechanism()),
-		)
+	kopts, err := newKafkaWriterOptions(cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	if cfg.Writer.BatchBytes > 0 {
-		kopts = append(kopts, kgo.ProducerBatchMaxBytes(int32(cfg.Writer.BatchBytes)))
+	opts = append(opts,
+		kafka.Options(kopts...),
+	)
+
+	return opts, nil
+}
+
+// NewKafkaReaderConfig returns reader options, process exits on invalid settings,
+// so broker never connects without configured tls or sasl. Use NewKafkaReaderConfigE to get the error
+func NewKafkaReaderConfig(cfg *BrokerConfig) []broker.Option {
+	opts, err := NewKafkaReaderConfigE(cfg)
+	if err != nil {
+		logger.Fatalf(context.Background(), "kafka reader: %v", err)
 	}
-	if cfg.Writer.BatchTimeout.Duration > 0 {
-		kopts = append(kopts, kgo.ProducerLinger(cfg.Writer.BatchTimeout.Duration))
+	return opts
+}
+
+func NewKafkaReaderConfigE(cfg *BrokerConfig) ([]broker.Option, error) {
+	var opts []broker.Option
+
+	kopts, commitInterval, err := newKafkaReaderOptions(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	opts = append(opts,
+		kafka.CommitInterval(commitInterval),
 		kafka.Options(kopts...),
 	)
 
-	return opts
+	return opts, nil
 }
 
-func NewKafkaReaderConfig(cfg *BrokerConfig) []broker.Option {
-	var opts []broker.Option
+// NewKafkaClientOptions returns kgo options with the same addresses and security settings
+// as broker created by InitBroker, useful for tools and admin tasks not covered by micro broker
+func NewKafkaClientOptions(cfg *BrokerConfig) ([]kgo.Opt, error) {
+	kopts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Addr...),
+		kgo.ClientID(cfg.ClientID),
+	}
+	sopts, err := newKafkaSecurityOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return append(kopts, sopts...), nil
+}
+
+func NewKafkaClient(cfg *BrokerConfig, opts ...kgo.Opt) (*kgo.Client, error) {
+	kopts, err := NewKafkaClientOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return kgo.NewClient(append(kopts, opts...)...)
+}
+
+func newKafkaWriterOptions(cfg *BrokerConfig) ([]kgo.Opt, error) {
+	ws, err := newKafkaWriterSettings(cfg)
+	if err != nil {
+		return nil, err
+	}
+	sopts, err := newKafkaSecurityOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return append(ws.opts(cfg.ClientID), sopts...), nil
+}
+
+// kafkaWriterSettings are writer settings resolved from config, zero values keep kgo defaults
+type kafkaWriterSettings struct {
+	acks            kgo.Acks
+	idempotent      bool
+	partitioner     kgo.Partitioner
+	compression     []kgo.CompressionCodec
+	retries         int
+	maxBuffered     int
+	batchMaxBytes   int32
+	linger          time.Duration
+	requestTimeout  time.Duration
+	deliveryTimeout time.Duration
+}
+
+func newKafkaWriterSettings(cfg *BrokerConfig) (*kafkaWriterSettings, error) {
+	ws := &kafkaWriterSettings{
+		compression:   []kgo.CompressionCodec{kgo.NoCompression()},
+		maxBuffered:   1000,
+		batchMaxBytes: 1 * 1024 * 1024,
+	}
+
+	wcfg := cfg.Writer
+
+	if wcfg.MaxAttempts < 0 || wcfg.BatchSize < 0 || wcfg.BatchBytes < 0 {
+		return nil, fmt.Errorf("kafka writer: max_attempts, batch_size and batch_bytes must not be negative")
+	}
+	if wcfg.BatchTimeout.Duration < 0 || wcfg.ReadTimeout.Duration < 0 || wcfg.WriteTimeout.Duration < 0 {
+		return nil, fmt.Errorf("kafka writer: batch_timeout, read_timeout and write_timeout must not be negative")
+	}
+
+	switch {
+	case wcfg.RequiredAcks == nil && wcfg.Idempotent:
+		ws.acks, ws.idempotent = kgo.AllISRAcks(), true
+	case wcfg.RequiredAcks == nil:
+		// leader ack is the default, kgo permits it only without idempotency
+		ws.acks = kgo.LeaderAck()
+	case *wcfg.RequiredAcks == -1:
+		// all acks alone do not require idempotency, it is enabled only by idempotent
+		ws.acks, ws.idempotent = kgo.AllISRAcks(), wcfg.Idempotent
+	case wcfg.Idempotent:
+		return nil, fmt.Errorf("kafka writer: idempotent producing requires required_acks -1 (all)")
+	case *wcfg.RequiredAcks == 1:
+		ws.acks = kgo.LeaderAck()
+	case *wcfg.RequiredAcks == 0:
+		ws.acks = kgo.NoAck()
+	default:
+		return nil, fmt.Errorf("kafka writer: unsupported required_acks %d, must be 0 (none), 1 (leader) or -1 (all)", *wcfg.RequiredAcks)
+	}
+
+	partitioner, err := newKafkaPartitioner(wcfg.Partitioner)
+	if err != nil {
+		return nil, err
+	}
+	ws.partitioner = partitioner
+
+	if len(wcfg.Compression) > 0 {
+		if ws.compression, err = newKafkaCompression(wcfg.Compression); err != nil {
+			return nil, err
+		}
+	}
 
+	if wcfg.MaxAttempts > 0 {
+		ws.retries = wcfg.MaxAttempts
+	}
+	if wcfg.BatchSize > 0 {
+		// kgo limits batches only by bytes, max buffered records would block publishing instead
+		logger.Warnf(context.Background(), "kafka writer: batch_size is ignored, batches are limited by batch_bytes and batch_timeout")
+	}
+	if wcfg.BatchBytes > 0 {
+		ws.batchMaxBytes = int32(wcfg.BatchBytes)
+	}
+	ws.linger = wcfg.BatchTimeout.Duration
+	// how long broker may take to respond to produce request
+	ws.requestTimeout = wcfg.ReadTimeout.Duration
+	// overall time limit to deliver the record, including retries
+	ws.deliveryTimeout = wcfg.WriteTimeout.Duration
+
+	return ws, nil
+}
+
+func (ws *kafkaWriterSettings) opts(clientID string) []kgo.Opt {
 	kopts := []kgo.Opt{
 		kgo.FetchMaxWait(1 * time.Second),
-		kgo.ClientID(cfg.ClientID),
-		// kgo.AllowedConcurrentFetches(3),
+		kgo.StopProducerOnDataLossDetected(),
+		kgo.ClientID(clientID),
+		kgo.ProducerBatchCompression(ws.compression...),
+		kgo.MaxBufferedRecords(ws.maxBuffered),
+		// kgo.ProducerLinger(1 * time.Second), dont set by default to speedup publishing
+		kgo.ProducerBatchMaxBytes(ws.batchMaxBytes),
+		kgo.RequiredAcks(ws.acks),
+	}
+	if !ws.idempotent {
+		kopts = append(kopts, kgo.DisableIdempotentWrite())
+	}
+	if ws.partitioner != nil {
+		kopts = append(kopts, kgo.RecordPartitioner(ws.partitioner))
+	}
+	if ws.retries > 0 {
+		kopts = append(kopts, kgo.RecordRetries(ws.retries))
 	}
-	if len(cfg.Username) > 0 && len(cfg.Password) > 0 {
-		kopts = append(kopts,
-			kgo.SASL((plain.Auth{User: cfg.Username, Pass: cfg.Password}).AsMechanism()),
-		)
+	if ws.linger > 0 {
+		kopts = append(kopts, kgo.ProducerLinger(ws.linger))
 	}
+	if ws.requestTimeout > 0 {
+		kopts = append(kopts, kgo.ProduceRequestTimeout(ws.requestTimeout))
+	}
+	if ws.deliveryTimeout > 0 {
+		kopts = append(kopts, kgo.RecordDeliveryTimeout(ws.deliveryTimeout))
+	}
+	return kopts
+}
 
-	commitInterval := 1 * time.Second
+func newKafkaReaderOptions(cfg *BrokerConfig) ([]kgo.Opt, time.Duration, error) {
+	rs, err := newKafkaReaderSettings(cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	sopts, err := newKafkaSecurityOptions(cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	return append(rs.opts(cfg.ClientID), sopts...), rs.commitInterval, nil
+}
+
+// kafkaReaderSettings are reader settings resolved from config, zero values keep kgo defaults
+type kafkaReaderSettings struct {
+	minBytes       int32
+	maxBytes       int32
+	maxWait        time.Duration
+	heartbeat      time.Duration
+	session        time.Duration
+	rebalance      time.Duration
+	metadataMaxAge time.Duration
+	resetOffset    *kgo.Offset
+	backoffMin     time.Duration
+	backoffMax     time.Duration
+	retries        int
+	commitInterval time.Duration
+}
 
-	if cfg.Reader.MinBytes > 0 {
-		kopts = append(kopts, kgo.FetchMinBytes(int32(cfg.Reader.MinBytes)))
+func newKafkaReaderSettings(cfg *BrokerConfig) (*kafkaReaderSettings, error) {
+	rs := &kafkaReaderSettings{
+		maxWait:        1 * time.Second,
+		commitInterval: 1 * time.Second,
+	}
+
+	rcfg := cfg.Reader
+
+	if rcfg.MinBytes < 0 || rcfg.MaxBytes < 0 || rcfg.MaxAttempts < 0 {
+		return nil, fmt.Errorf("kafka reader: min_bytes, max_bytes and max_attempts must not be negative")
+	}
+	if rcfg.MaxBytes > 0 && rcfg.MinBytes > rcfg.MaxBytes {
+		return nil, fmt.Errorf("kafka reader: min_bytes %d greater than max_bytes %d", rcfg.MinBytes, rcfg.MaxBytes)
+	}
+	for name, d := range map[string]Duration{
+		"max_wait":                 rcfg.MaxWait,
+		"read_lag_interval":        rcfg.ReadLagInterval,
+		"heartbeat_interval":       rcfg.HeartbeatInterval,
+		"commit_interval":          rcfg.CommitInterval,
+		"partition_watch_interval": rcfg.PartitionWatchInterval,
+		"session_timeout":          rcfg.SessionTimeout,
+		"rebalance_timeout":        rcfg.RebalanceTimeout,
+		"join_group_backoff":       rcfg.JoinGroupBackoff,
+		"read_backoff_min":         rcfg.ReadBackoffMin,
+		"read_backoff_max":         rcfg.ReadBackoffMax,
+	} {
+		if d.Duration < 0 {
+			return nil, fmt.Errorf("kafka reader: %s must not be negative", name)
+		}
+	}
+	if rcfg.RetentionTime.Duration > 0 {
+		// offset commit retention was removed from the protocol, kgo always uses broker side offsets.retention.minutes
+		logger.Warnf(context.Background(), "kafka reader: retention_time is deprecated and ignored, configure offsets.retention.minutes on the broker")
+	}
+	if cfg.Workers < 0 || rcfg.QueueCapacity < 0 {
+		return nil, fmt.Errorf("kafka reader: workers and queue_capacity must not be negative")
+	}
+	switch rcfg.Ordering {
+	case "", KafkaOrderingPartition, KafkaOrderingKey:
+	default:
+		return nil, fmt.Errorf("kafka reader: unsupported ordering %q, must be %q or %q", rcfg.Ordering, KafkaOrderingPartition, KafkaOrderingKey)
+	}
+	if rcfg.Group != "" && cfg.Group != "" && rcfg.Group != cfg.Group {
+		return nil, fmt.Errorf("kafka reader: group %q conflicts with top level group %q", rcfg.Group, cfg.Group)
+	}
+	if rcfg.ReadLagInterval.Duration > 0 && kafkaGroup(cfg) == "" {
+		return nil, fmt.Errorf("kafka reader: read_lag_interval requires group")
+	}
+
+	rs.minBytes = int32(rcfg.MinBytes)
+	rs.maxBytes = int32(rcfg.MaxBytes)
+	if rcfg.MaxWait.Duration > 0 {
+		rs.maxWait = rcfg.MaxWait.Duration
+	}
+	if rcfg.CommitInterval.Duration > 0 {
+		rs.commitInterval = rcfg.CommitInterval.Duration
+	}
+	if rcfg.SessionTimeout.Duration > 0 && rcfg.HeartbeatInterval.Duration >= rcfg.SessionTimeout.Duration {
+		return nil, fmt.Errorf("kafka reader: heartbeat_interval must be less than session_timeout")
+	}
+	rs.heartbeat = rcfg.HeartbeatInterval.Duration
+	rs.session = rcfg.SessionTimeout.Duration
+	rs.rebalance = rcfg.RebalanceTimeout.Duration
+	// new partitions are discovered on metadata refresh
+	rs.metadataMaxAge = rcfg.PartitionWatchInterval.Duration
+
+	switch {
+	case rcfg.StartOffset == 0:
+	case rcfg.StartOffset == kafkaFirstOffset:
+		offset := kgo.NewOffset().AtStart()
+		rs.resetOffset = &offset
+	case rcfg.StartOffset == kafkaLastOffset:
+		offset := kgo.NewOffset().AtEnd()
+		rs.resetOffset = &offset
+	case rcfg.StartOffset > 0:
+		offset := kgo.NewOffset().At(rcfg.StartOffset)
+		rs.resetOffset = &offset
+	default:
+		return nil, fmt.Errorf("kafka reader: invalid offset %d, must be -2 (first), -1 (last) or exact offset", rcfg.StartOffset)
+	}
+
+	// kgo has single backoff for all retryable requests including group joins
+	backoffMin, backoffMax := rcfg.ReadBackoffMin.Duration, rcfg.ReadBackoffMax.Duration
+	if rcfg.JoinGroupBackoff.Duration > 0 {
+		if backoffMin > 0 || backoffMax > 0 {
+			return nil, fmt.Errorf("kafka reader: join_group_backoff cannot be combined with read_backoff_min/read_backoff_max")
+		}
+		backoffMin, backoffMax = rcfg.JoinGroupBackoff.Duration, rcfg.JoinGroupBackoff.Duration
 	}
-	if cfg.Reader.MaxBytes > 0 {
-		kopts = append(kopts, kgo.FetchMaxBytes(int32(cfg.Reader.MaxBytes)))
+	if backoffMin > 0 || backoffMax > 0 {
+		if backoffMin == 0 {
+			backoffMin = defaultKafkaBackoffMin
+		}
+		if backoffMax == 0 {
+			backoffMax = defaultKafkaBackoffMax
+		}
+		if backoffMin > backoffMax {
+			return nil, fmt.Errorf("kafka reader: read_backoff_min %s greater than read_backoff_max %s", backoffMin, backoffMax)
+		}
+		rs.backoffMin, rs.backoffMax = backoffMin, backoffMax
+	}
+	rs.retries = rcfg.MaxAttempts
+
+	return rs, nil
+}
+
+func (rs *kafkaReaderSettings) opts(clientID string) []kgo.Opt {
+	kopts := []kgo.Opt{
+		kgo.FetchMaxWait(rs.maxWait),
+		kgo.ClientID(clientID),
+		// kgo.AllowedConcurrentFetches(3),
+	}
+	if rs.minBytes > 0 {
+		kopts = append(kopts, kgo.FetchMinBytes(rs.minBytes))
+	}
+	if rs.maxBytes > 0 {
+		kopts = append(kopts, kgo.FetchMaxBytes(rs.maxBytes))
 		//	kopts = append(kopts, kgo.FetchMaxPartitionBytes(int32(cfg.Reader.MaxBytes)))
 		// kopts = append(kopts, kgo.BrokerMaxReadBytes(2*int32(cfg.Reader.MaxBytes)))
 	}
-	if cfg.Reader.MaxWait.Duration > 0 {
-		kopts = append(kopts, kgo.FetchMaxWait(cfg.Reader.MaxWait.Duration))
+	if rs.heartbeat > 0 {
+		kopts = append(kopts, kgo.HeartbeatInterval(rs.heartbeat))
+	}
+	if rs.session > 0 {
+		kopts = append(kopts, kgo.SessionTimeout(rs.session))
+	}
+	if rs.rebalance > 0 {
+		kopts = append(kopts, kgo.RebalanceTimeout(rs.rebalance))
+	}
+	if rs.metadataMaxAge > 0 {
+		kopts = append(kopts, kgo.MetadataMaxAge(rs.metadataMaxAge))
+	}
+	if rs.resetOffset != nil {
+		kopts = append(kopts, kgo.ConsumeResetOffset(*rs.resetOffset))
+	}
+	if rs.backoffMax > 0 {
+		kopts = append(kopts, kgo.RetryBackoffFn(newKafkaBackoff(rs.backoffMin, rs.backoffMax)))
 	}
-	if cfg.Reader.CommitInterval.Duration > 0 {
-		commitInterval = cfg.Reader.CommitInterval.Duration
+	if rs.retries > 0 {
+		kopts = append(kopts, kgo.RequestRetries(rs.retries))
 	}
+	return kopts
+}
 
-	opts = append(opts,
-		kafka.CommitInterval(commitInterval),
-		kafka.Options(kopts...),
-	)
+// newKafkaCompression returns compression codecs in preference order,
+// kgo falls back to the next codec if broker does not support previous one
+func newKafkaCompression(names []string) ([]kgo.CompressionCodec, error) {
+	codecs := make([]kgo.CompressionCodec, 0, len(names))
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "none":
+			codecs = append(codecs, kgo.NoCompression())
+		case "gzip":
+			codecs = append(codecs, kgo.GzipCompression())
+		case "snappy":
+			codecs = append(codecs, kgo.SnappyCompression())
+		case "lz4":
+			codecs = append(codecs, kgo.Lz4Compression())
+		case "zstd":
+			codecs = append(codecs, kgo.ZstdCompression())
+		default:
+			return nil, fmt.Errorf("kafka writer: unsupported compression %q", name)
+		}
+	}
+	return codecs, nil
+}
 
+// newKafkaBackoff returns exponential backoff starting from min and limited by max
+func newKafkaBackoff(min, max time.Duration) func(int) time.Duration {
+	return func(tries int) time.Duration {
+		backoff := min
+		for i := 1; i < tries && backoff < max; i++ {
+			backoff *= 2
+		}
+		if backoff > max {
+			backoff = max
+		}
+		return backoff
+	}
+}
+
+// newKafkaSecurityOptions returns tls and sasl options shared by reader and writer
+func newKafkaSecurityOptions(cfg *BrokerConfig) ([]kgo.Opt, error) {
+	var kopts []kgo.Opt
+
+	tlsConfig, err := newBrokerTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		kopts = append(kopts, kgo.DialTLSConfig(tlsConfig))
+	}
+
+	mechanism, err := newKafkaSASLMechanism(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if mechanism != nil {
+		kopts = append(kopts, kgo.SASL(mechanism))
+	}
+
+	return kopts, nil
+}
+
+func newBrokerTLSConfig(cfg *BrokerConfig) (*tls.Config, error) {
+	tcfg := cfg.TLS
+	if !tcfg.Enabled && tcfg.CAFile == "" && tcfg.CertFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         tcfg.ServerName,
+		InsecureSkipVerify: tcfg.InsecureSkipVerify,
+	}
+
+	if tcfg.CAFile != "" {
+		buf, err := ioutil.ReadFile(tcfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("broker tls: read ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("broker tls: no certificates found in %s", tcfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if tcfg.CertFile != "" || tcfg.KeyFile != "" {
+		if tcfg.CertFile == "" || tcfg.KeyFile == "" {
+			return nil, fmt.Errorf("broker tls: both cert_file and key_file must be set")
+		}
+		cert, err := tls.LoadX509KeyPair(tcfg.CertFile, tcfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("broker tls: load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func newKafkaSASLMechanism(cfg *BrokerConfig) (sasl.Mechanism, error) {
+	mechanism := strings.ToLower(cfg.SASL.Mechanism)
+	if mechanism == "" {
+		// keep backward compatibility, username and password without mechanism means plain
+		if len(cfg.Username) == 0 || len(cfg.Password) == 0 {
+			return nil, nil
+		}
+		mechanism = SASLPlain
+	}
+
+	switch mechanism {
+	case SASLPlain:
+		return (plain.Auth{User: cfg.Username, Pass: cfg.Password}).AsMechanism(), nil
+	case SASLScramSHA256:
+		return (scram.Auth{User: cfg.Username, Pass: cfg.Password}).AsSha256Mechanism(), nil
+	case SASLScramSHA512:
+		return (scram.Auth{User: cfg.Username, Pass: cfg.Password}).AsSha512Mechanism(), nil
+	case SASLOAuthBearer:
+		if cfg.SASL.Token == "" {
+			return nil, fmt.Errorf("kafka sasl: token required for %s", SASLOAuthBearer)
+		}
+		return (oauth.Auth{Token: cfg.SASL.Token}).AsMechanism(), nil
+	default:
+		return nil, fmt.Errorf("kafka sasl: unsupported mechanism %q", cfg.SASL.Mechanism)
+	}
+}
+
+const (
+	BrokerCodecRawJSON        = "rawjson"
+	BrokerCodecSchemaRegistry = "schema_registry"
+)
+
+// NewBrokerCodec returns codec selected by cfg.Codec
+func NewBrokerCodec(cfg *BrokerConfig) (codec.Codec, error) {
+	switch cfg.Codec {
+	case "", BrokerCodecRawJSON:
+		return rawjson.NewCodec(), nil
+	case BrokerCodecSchemaRegistry:
+		rcfg := cfg.SchemaRegistry
+		if rcfg.URL == "" {
+			return nil, fmt.Errorf("schema registry: url required")
+		}
+		if rcfg.Timeout.Duration < 0 {
+			return nil, fmt.Errorf("schema registry: timeout must not be negative")
+		}
+		if rcfg.CheckCompatibility && !rcfg.AutoRegister {
+			return nil, fmt.Errorf("schema registry: check_compatibility requires auto_register")
+		}
+
+		var copts []registry.ClientOption
+		if rcfg.Username != "" {
+			copts = append(copts, registry.BasicAuth(rcfg.Username, rcfg.Password))
+		}
+		if rcfg.Timeout.Duration > 0 {
+			copts = append(copts, registry.HTTPClient(&http.Client{Timeout: rcfg.Timeout.Duration}))
+		}
+
+		return registry.NewCodec(
+			registry.NewClient(rcfg.URL, copts...),
+			registry.AutoRegister(rcfg.AutoRegister),
+			registry.CheckCompatibility(rcfg.CheckCompatibility),
+		), nil
+	default:
+		return nil, fmt.Errorf("unknown broker codec %q, must be %q or %q", cfg.Codec, BrokerCodecRawJSON, BrokerCodecSchemaRegistry)
+	}
+}
+
+// BrokerClientOptions sets broker b for client and registers schema registry codec of b for registry.ContentType,
+// messages published with client.WithMessageContentType(registry.ContentType) are sent in wire format
+func BrokerClientOptions(b broker.Broker) []client.Option {
+	opts := []client.Option{client.Broker(b)}
+	if c, ok := b.Options().Codec.(*registry.Codec); ok {
+		opts = append(opts, client.Codec(registry.ContentType, c))
+	}
+	return opts
+}
+
+// BrokerServerOptions sets broker b for server and registers schema registry codec of b for registry.ContentType,
+// so subscribers decode messages in wire format
+func BrokerServerOptions(b broker.Broker) []server.Option {
+	opts := []server.Option{server.Broker(b)}
+	if c, ok := b.Options().Codec.(*registry.Codec); ok {
+		opts = append(opts, server.Codec(registry.ContentType, c))
+	}
 	return opts
 }
 
+func NewNatsConfig(cfg *BrokerConfig) ([]broker.Option, error) {
+	ncfg := cfg.NATS
+
+	if ncfg.MaxReconnects < -1 {
+		return nil, fmt.Errorf("nats: max_reconnects must be -1 (infinite) or positive")
+	}
+	if ncfg.ReconnectWait.Duration < 0 || ncfg.Timeout.Duration < 0 || ncfg.DrainTimeout.Duration < 0 {
+		return nil, fmt.Errorf("nats: reconnect_wait, timeout and drain_timeout must not be negative")
+	}
+
+	nopts := []nats.Option{nats.Name(cfg.ClientID)}
+	switch {
+	case ncfg.Token != "":
+		nopts = append(nopts, nats.Token(ncfg.Token))
+	case cfg.Username != "":
+		nopts = append(nopts, nats.UserInfo(cfg.Username, cfg.Password))
+	}
+	if ncfg.MaxReconnects != 0 {
+		nopts = append(nopts, nats.MaxReconnects(ncfg.MaxReconnects))
+	}
+	if ncfg.ReconnectWait.Duration > 0 {
+		nopts = append(nopts, nats.ReconnectWait(ncfg.ReconnectWait.Duration))
+	}
+	if ncfg.Timeout.Duration > 0 {
+		nopts = append(nopts, nats.Timeout(ncfg.Timeout.Duration))
+	}
+	if ncfg.DrainTimeout.Duration > 0 {
+		nopts = append(nopts, nats.DrainTimeout(ncfg.DrainTimeout.Duration))
+	}
+
+	opts := []broker.Option{natsbroker.Options(nopts...)}
+	tlsConfig, err := newBrokerTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, broker.TLSConfig(tlsConfig))
+	}
+
+	return opts, nil
+}
+
+func NewAMQPConfig(cfg *BrokerConfig) ([]broker.Option, error) {
+	acfg := cfg.AMQP
+
+	if acfg.PrefetchCount < 0 {
+		return nil, fmt.Errorf("amqp: prefetch_count must not be negative")
+	}
+	switch acfg.ExchangeType {
+	case "", "topic", "direct", "fanout", "headers":
+	default:
+		return nil, fmt.Errorf("amqp: unsupported exchange_type %q", acfg.ExchangeType)
+	}
+
+	opts := []broker.Option{
+		amqpbroker.Exchange(acfg.Exchange, acfg.ExchangeType),
+		amqpbroker.Durable(acfg.Durable),
+		amqpbroker.PrefetchCount(acfg.PrefetchCount),
+		amqpbroker.Requeue(acfg.Requeue),
+	}
+	if cfg.Username != "" {
+		opts = append(opts, amqpbroker.Auth(cfg.Username, cfg.Password))
+	}
+	tlsConfig, err := newBrokerTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, broker.TLSConfig(tlsConfig))
+	}
+
+	return opts, nil
+}
+
 type BrokerConfig struct {
-	Type     string   `json:"type"`
-	Workers  int      `json:"workers"`
+	Type string `json:"type" validate:"oneof=kafka nats amqp rabbitmq memory"`
+	// message codec, "rawjson" (default) or "schema_registry"
+	Codec    string   `json:"codec" validate:"oneof=rawjson schema_registry"`
+	Workers  int      `json:"workers" validate:"min=0"`
 	Addr     []string `json:"addr"`
 	ClientID string   `json:"clientid"`
 	Username string   `json:"username"`
 	Password string   `json:"password"`
-	Reader   struct {
+	SASL     struct {
+		Mechanism string `json:"mechanism" validate:"oneof=plain scram-sha-256 scram-sha-512 oauthbearer"`
+		Token     string `json:"token"`
+	} `json:"sasl"`
+	TLS struct {
+		Enabled            bool   `json:"enabled"`
+		CAFile             string `json:"ca_file"`
+		CertFile           string `json:"cert_file"`
+		KeyFile            string `json:"key_file"`
+		ServerName         string `json:"server_name"`
+		InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	} `json:"tls"`
+	Reader struct {
 		Group                  string   `json:"group"`
-		QueueCapacity          int      `json:"queue_capacity"`
-		MinBytes               int      `json:"min_bytes"`
-		MaxBytes               int      `json:"max_bytes"`
+		QueueCapacity          int      `json:"queue_capacity" validate:"min=0"`
+		MinBytes               int      `json:"min_bytes" validate:"min=0"`
+		MaxBytes               int      `json:"max_bytes" validate:"min=0"`
 		MaxWait                Duration `json:"max_wait"`
-		ReadLagInterval        Duration `json:"read_lag_interval"`
+		ReadLagInterval        Duration `json:"read_lag_interval"` // rebalances are counted only with workers > 1 or control
 		HeartbeatInterval      Duration `json:"heartbeat_interval"`
 		CommitInterval         Duration `json:"commit_interval"`
 		PartitionWatchInterval Duration `json:"partition_watch_interval"`
@@ -108,24 +709,204 @@ type BrokerConfig struct {
 		RebalanceTimeout       Duration `json:"rebalance_timeout"`
 		JoinGroupBackoff       Duration `json:"join_group_backoff"`
 		RetentionTime          Duration `json:"retention_time"`
-		StartOffset            int64    `json:"offset"`
+		StartOffset            int64    `json:"offset" validate:"min=-2"`
 		ReadBackoffMin         Duration `json:"read_backoff_min"`
 		ReadBackoffMax         Duration `json:"read_backoff_max"`
-		MaxAttempts            int      `json:"max_attempts"`
+		MaxAttempts            int      `json:"max_attempts" validate:"min=0"` // also processing attempts of ErrorHandlerRetryConfig
+		// used with workers > 1, "partition" (default) or "key"
+		Ordering string `json:"ordering" validate:"oneof=partition key"`
+		// subscribers are consumed by pool even with single worker, so they can be paused and seeked by KafkaController
+		Control bool `json:"control"`
 	} `json:"reader"`
 	Writer struct {
-		MaxAttempts  int      `json:"max_attempts"`
-		BatchSize    int      `json:"batch_size"`
-		BatchBytes   int      `json:"batch_bytes"`
+		MaxAttempts  int      `json:"max_attempts" validate:"min=0"`
+		BatchSize    int      `json:"batch_size" validate:"min=0"`
+		BatchBytes   int      `json:"batch_bytes" validate:"min=0"`
 		BatchTimeout Duration `json:"batch_timeout"`
 		ReadTimeout  Duration `json:"read_timeout"`
 		WriteTimeout Duration `json:"write_timeout"`
-		RequiredAcks int      `json:"required_acks"`
+		// 0 (none), 1 (leader) or -1 (all), default is leader, or all for idempotent writer
+		RequiredAcks *int `json:"required_acks" validate:"min=-1,max=1"`
+		// compression codecs in preference order, like ["zstd", "lz4", "none"]
+		Compression []string `json:"compression" validate:"oneof=none gzip snappy lz4 zstd"`
+		Idempotent  bool     `json:"idempotent"`
+		// "sticky", "round-robin" or "murmur2", default is murmur2 for records with key and sticky otherwise
+		Partitioner string `json:"partitioner" validate:"oneof=sticky round-robin murmur2"`
+		// used only by KafkaTxProducer
+		TransactionalID    string   `json:"transactional_id"`
+		TransactionTimeout Duration `json:"transaction_timeout"`
 	} `json:"writer"`
+	// kafka topics created on connect if missing, drift of existing topics is logged
+	Topics []KafkaTopicSpec `json:"topics"`
+
+	NATS struct {
+		// used instead of username and password
+		Token string `json:"token"`
+		// -1 reconnects forever
+		MaxReconnects int      `json:"max_reconnects" validate:"min=-1"`
+		ReconnectWait Duration `json:"reconnect_wait"`
+		Timeout       Duration `json:"timeout"`
+		DrainTimeout  Duration `json:"drain_timeout"`
+	} `json:"nats"`
+	AMQP struct {
+		Exchange     string `json:"exchange"`
+		ExchangeType string `json:"exchange_type" validate:"oneof=topic direct fanout headers"`
+		Durable      bool   `json:"durable"`
+		// unacked messages delivered to single subscriber, 0 is unlimited
+		PrefetchCount int `json:"prefetch_count" validate:"min=0"`
+		// return unacked messages to queue instead of dropping (or dead lettering)
+		Requeue bool `json:"requeue"`
+	} `json:"amqp"`
+	SchemaRegistry struct {
+		URL      string `json:"url" validate:"url"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		// register schemas of published messages if they are not registered yet
+		AutoRegister bool `json:"auto_register"`
+		// check compatibility with latest version before registering
+		CheckCompatibility bool     `json:"check_compatibility"`
+		Timeout            Duration `json:"timeout"`
+	} `json:"schema_registry"`
 	Group string `json:"group"`
 }
 
-func NewErrorHandler(topic string, appName string, c client.Client) broker.Handler {
+// Validate checks settings depending on each other, single values are checked by validate tags
+func (cfg *BrokerConfig) Validate() error {
+	switch strings.ToLower(cfg.Type) {
+	case "kafka":
+		if len(cfg.Addr) == 0 {
+			return fmt.Errorf("addr: required for %s broker", cfg.Type)
+		}
+		for _, addr := range cfg.Addr {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return fmt.Errorf("addr: %w", err)
+			}
+		}
+	case "nats", "amqp", "rabbitmq":
+		// addresses may be urls like nats://host:4222
+		if len(cfg.Addr) == 0 {
+			return fmt.Errorf("addr: required for %s broker", cfg.Type)
+		}
+	}
+	if cfg.Codec == BrokerCodecSchemaRegistry && cfg.SchemaRegistry.URL == "" {
+		return fmt.Errorf("schema_registry.url: required for %s codec", cfg.Codec)
+	}
+	if acks := cfg.Writer.RequiredAcks; cfg.Writer.Idempotent && acks != nil && *acks != -1 {
+		return fmt.Errorf("writer.required_acks: idempotent producing requires -1 (all)")
+	}
+	return nil
+}
+
+// ErrorPolicy defines what error handler does if message can't be published to retry/error topic or acked
+// Message left unacked is redelivered by kafka pool, so commits of its partition wait for it
+type ErrorPolicy int
+
+const (
+	// retry publish and ack with backoff, then leave message unacked
+	ErrorPolicyRetry ErrorPolicy = iota
+	// leave message unacked on first failure
+	ErrorPolicySkip
+	// exit process on first failure
+	ErrorPolicyFailFast
+)
+
+type ErrorHandlerOptions struct {
+	// number of retry topics, zero means publish to error topic immediately
+	RetryAttempts   int
+	RetryBackoffMin time.Duration
+	RetryBackoffMax time.Duration
+	Policy          ErrorPolicy
+	// publish and ack attempts for ErrorPolicyRetry
+	PublishAttempts   int
+	PublishBackoffMin time.Duration
+	PublishBackoffMax time.Duration
+	// called when message can't be moved to retry/error topic or acked
+	Unrecoverable func(evt broker.Event, err error)
+}
+
+type ErrorHandlerOption func(*ErrorHandlerOptions)
+
+// ErrorHandlerRetry enables retry topics <topic>.retry.1..attempts before message lands in error topic,
+// delay before each attempt grows exponentially from min to max.
+// Delays are honoured by kafka pool subscribers (workers > 1 or reader control), others process retries at once.
+func ErrorHandlerRetry(attempts int, min, max time.Duration) ErrorHandlerOption {
+	return func(opts *ErrorHandlerOptions) {
+		opts.RetryAttempts = attempts
+		opts.RetryBackoffMin = min
+		opts.RetryBackoffMax = max
+	}
+}
+
+// ErrorHandlerRetryConfig enables retry topics using reader max_attempts and read_backoff_min/read_backoff_max,
+// max_attempts counts the first processing, so message goes through max_attempts - 1 retry topics
+func ErrorHandlerRetryConfig(cfg *BrokerConfig) ErrorHandlerOption {
+	attempts := cfg.Reader.MaxAttempts - 1
+	if attempts > 0 && cfg.Workers <= 1 && !cfg.Reader.Control {
+		logger.Warnf(context.Background(), "error handler: retry delays are ignored without kafka pool, set workers > 1 or reader control")
+	}
+	return ErrorHandlerRetry(attempts, cfg.Reader.ReadBackoffMin.Duration, cfg.Reader.ReadBackoffMax.Duration)
+}
+
+func ErrorHandlerPolicy(policy ErrorPolicy) ErrorHandlerOption {
+	return func(opts *ErrorHandlerOptions) {
+		opts.Policy = policy
+	}
+}
+
+// ErrorHandlerPublishRetry sets publish and ack attempts for ErrorPolicyRetry
+func ErrorHandlerPublishRetry(attempts int, min, max time.Duration) ErrorHandlerOption {
+	return func(opts *ErrorHandlerOptions) {
+		opts.PublishAttempts = attempts
+		opts.PublishBackoffMin = min
+		opts.PublishBackoffMax = max
+	}
+}
+
+func ErrorHandlerUnrecoverable(fn func(evt broker.Event, err error)) ErrorHandlerOption {
+	return func(opts *ErrorHandlerOptions) {
+		opts.Unrecoverable = fn
+	}
+}
+
+func NewErrorHandler(topic string, appName string, c client.Client, opts ...ErrorHandlerOption) broker.Handler {
+	registerMetrics()
+
+	options := ErrorHandlerOptions{
+		PublishAttempts: defaultErrorHandlerPublishAttempts,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	retryBackoff := newErrorHandlerBackoff(options.RetryBackoffMin, options.RetryBackoffMax)
+	publishBackoff := newErrorHandlerBackoff(options.PublishBackoffMin, options.PublishBackoffMax)
+
+	// do runs fn according to policy
+	do := func(fn func() error) error {
+		var err error
+		for attempt := 1; ; attempt++ {
+			if err = fn(); err == nil {
+				return nil
+			}
+			if options.Policy != ErrorPolicyRetry || attempt >= options.PublishAttempts {
+				return err
+			}
+			time.Sleep(publishBackoff(attempt))
+		}
+	}
+
+	// fail handles unrecoverable error according to policy
+	fail := func(ctx context.Context, evt broker.Event, err error) error {
+		if options.Unrecoverable != nil {
+			options.Unrecoverable(evt, err)
+		}
+		if options.Policy == ErrorPolicyFailFast {
+			logger.Fatal(ctx, "%s", err)
+		}
+		logger.Errorf(ctx, "%s, message left unacked", err)
+		return err
+	}
+
 	return func(evt broker.Event) error {
 		logger.Error(context.Background(), "broken message: %s", evt.Error())
 
@@ -136,18 +917,71 @@ func NewErrorHandler(topic string, appName string, c client.Client) broker.Handl
 		if appName != "" {
 			msg.Header.Set("Micro-Appname", appName)
 		}
+		// replay from error topic needs source, retry topics keep it from the first failure
+		if _, ok := msg.Header.Get(retry.HeaderSourceTopic); !ok {
+			msg.Header.Set(retry.HeaderSourceTopic, evt.Topic())
+		}
+
+		dst := topic
+		if options.RetryAttempts > 0 {
+			dst = nextRetryTopic(evt, topic, options.RetryAttempts, retryBackoff)
+		}
 
 		// create context for wrappers from message header
 		ctx := metadata.NewOutgoingContext(context.Background(), msg.Header)
 
-		if err := c.Publish(ctx, c.NewMessage(topic, &raw.Frame{Data: msg.Body}, client.WithMessageContentType("application/json"))); err != nil {
-			logger.Fatal(ctx, "cannot publish to %s topic: %s", topic, err)
+		if err := do(func() error {
+			return c.Publish(ctx, c.NewMessage(dst, &raw.Frame{Data: msg.Body}, client.WithMessageContentType("application/json")))
+		}); err != nil {
+			errorHandlerPublishCounter.WithLabelValues(dst, "failure").Inc()
+			return fail(ctx, evt, fmt.Errorf("cannot publish to %s topic: %w", dst, err))
 		}
+		errorHandlerPublishCounter.WithLabelValues(dst, "success").Inc()
 
-		if err := evt.Ack(); err != nil {
-			logger.Fatal(ctx, "unable to ack broker message: %s", err)
+		if err := do(evt.Ack); err != nil {
+			errorHandlerAckCounter.WithLabelValues(evt.Topic(), "failure").Inc()
+			return fail(ctx, evt, fmt.Errorf("unable to ack broker message: %w", err))
 		}
+		errorHandlerAckCounter.WithLabelValues(evt.Topic(), "success").Inc()
 
 		return evt.Error()
 	}
 }
+
+func newErrorHandlerBackoff(min, max time.Duration) func(int) time.Duration {
+	if min <= 0 {
+		min = defaultKafkaBackoffMin
+	}
+	if max < min {
+		max = min
+	}
+	return newKafkaBackoff(min, max)
+}
+
+// nextRetryTopic updates retry headers of message and returns topic for next attempt,
+// or error topic if all attempts are exhausted
+func nextRetryTopic(evt broker.Event, errTopic string, attempts int, backoff func(int) time.Duration) string {
+	msg := evt.Message()
+
+	attempt := 0
+	if v, ok := msg.Header.Get(retry.HeaderAttempt); ok {
+		attempt, _ = strconv.Atoi(v)
+	}
+	source, _ := msg.Header.Get(retry.HeaderSourceTopic)
+
+	// keep error of every processing attempt, first one is from source topic
+	if evt.Error() != nil {
+		msg.Header.Set(retry.ErrorHeader(attempt+1), fmt.Sprintf("%v", evt.Error()))
+	}
+
+	if attempt >= attempts {
+		msg.Header.Del(retry.HeaderNotBefore)
+		return errTopic
+	}
+
+	attempt++
+	msg.Header.Set(retry.HeaderAttempt, strconv.Itoa(attempt))
+	msg.Header.Set(retry.HeaderNotBefore, time.Now().Add(backoff(attempt)).Format(time.RFC3339Nano))
+
+	return retry.Topic(source, attempt)
+}
@@ -0,0 +1,859 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/codec/registry"
+	"github.com/presnalex/go-micro/v3/wrapper/retry"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/client"
+	"go.unistack.org/micro/v3/metadata"
+	"go.unistack.org/micro/v3/server"
+)
+
+func TestKafkaReaderOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(cfg *BrokerConfig)
+		check func(rs *kafkaReaderSettings) bool
+	}{
+		{"min_bytes", func(cfg *BrokerConfig) { cfg.Reader.MinBytes = 1 }, func(rs *kafkaReaderSettings) bool { return rs.minBytes == 1 }},
+		{"max_bytes", func(cfg *BrokerConfig) { cfg.Reader.MaxBytes = 1024 }, func(rs *kafkaReaderSettings) bool { return rs.maxBytes == 1024 }},
+		{"max_wait", func(cfg *BrokerConfig) { cfg.Reader.MaxWait.Duration = 5 * time.Second }, func(rs *kafkaReaderSettings) bool {
+			return rs.maxWait == 5*time.Second
+		}},
+		{"commit_interval", func(cfg *BrokerConfig) { cfg.Reader.CommitInterval.Duration = 3 * time.Second }, func(rs *kafkaReaderSettings) bool {
+			return rs.commitInterval == 3*time.Second
+		}},
+		{"heartbeat_interval", func(cfg *BrokerConfig) { cfg.Reader.HeartbeatInterval.Duration = time.Second }, func(rs *kafkaReaderSettings) bool {
+			return rs.heartbeat == time.Second
+		}},
+		{"session_timeout", func(cfg *BrokerConfig) { cfg.Reader.SessionTimeout.Duration = 10 * time.Second }, func(rs *kafkaReaderSettings) bool {
+			return rs.session == 10*time.Second
+		}},
+		{"rebalance_timeout", func(cfg *BrokerConfig) { cfg.Reader.RebalanceTimeout.Duration = time.Minute }, func(rs *kafkaReaderSettings) bool {
+			return rs.rebalance == time.Minute
+		}},
+		{"partition_watch_interval", func(cfg *BrokerConfig) { cfg.Reader.PartitionWatchInterval.Duration = time.Minute }, func(rs *kafkaReaderSettings) bool {
+			return rs.metadataMaxAge == time.Minute
+		}},
+		{"offset_first", func(cfg *BrokerConfig) { cfg.Reader.StartOffset = kafkaFirstOffset }, func(rs *kafkaReaderSettings) bool {
+			return rs.resetOffset != nil && *rs.resetOffset == kgo.NewOffset().AtStart()
+		}},
+		{"offset_last", func(cfg *BrokerConfig) { cfg.Reader.StartOffset = kafkaLastOffset }, func(rs *kafkaReaderSettings) bool {
+			return rs.resetOffset != nil && *rs.resetOffset == kgo.NewOffset().AtEnd()
+		}},
+		{"offset_exact", func(cfg *BrokerConfig) { cfg.Reader.StartOffset = 10 }, func(rs *kafkaReaderSettings) bool {
+			return rs.resetOffset != nil && *rs.resetOffset == kgo.NewOffset().At(10)
+		}},
+		{"read_backoff_min", func(cfg *BrokerConfig) { cfg.Reader.ReadBackoffMin.Duration = time.Second }, func(rs *kafkaReaderSettings) bool {
+			return rs.backoffMin == time.Second && rs.backoffMax == defaultKafkaBackoffMax
+		}},
+		{"read_backoff_max", func(cfg *BrokerConfig) { cfg.Reader.ReadBackoffMax.Duration = time.Second }, func(rs *kafkaReaderSettings) bool {
+			return rs.backoffMin == defaultKafkaBackoffMin && rs.backoffMax == time.Second
+		}},
+		{"join_group_backoff", func(cfg *BrokerConfig) { cfg.Reader.JoinGroupBackoff.Duration = time.Second }, func(rs *kafkaReaderSettings) bool {
+			return rs.backoffMin == time.Second && rs.backoffMax == time.Second
+		}},
+		{"max_attempts", func(cfg *BrokerConfig) { cfg.Reader.MaxAttempts = 3 }, func(rs *kafkaReaderSettings) bool { return rs.retries == 3 }},
+		{"retention_time_ignored", func(cfg *BrokerConfig) { cfg.Reader.RetentionTime.Duration = time.Hour }, func(rs *kafkaReaderSettings) bool {
+			return *rs == kafkaReaderSettings{maxWait: time.Second, commitInterval: time.Second}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &BrokerConfig{}
+			tt.set(cfg)
+			rs, err := newKafkaReaderSettings(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(rs) {
+				t.Fatalf("unexpected settings %+v", rs)
+			}
+			if _, _, err = newKafkaReaderOptions(cfg); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestKafkaWriterOptions(t *testing.T) {
+	acks := func(n int) *int { return &n }
+	tests := []struct {
+		name  string
+		set   func(cfg *BrokerConfig)
+		check func(ws *kafkaWriterSettings) bool
+	}{
+		{"default", func(cfg *BrokerConfig) {}, func(ws *kafkaWriterSettings) bool {
+			return ws.acks == kgo.LeaderAck() && !ws.idempotent && ws.maxBuffered == 1000 && ws.batchMaxBytes == 1024*1024 &&
+				ws.partitioner == nil && len(ws.compression) == 1 && ws.compression[0] == kgo.NoCompression()
+		}},
+		{"max_attempts", func(cfg *BrokerConfig) { cfg.Writer.MaxAttempts = 3 }, func(ws *kafkaWriterSettings) bool { return ws.retries == 3 }},
+		{"batch_size_ignored", func(cfg *BrokerConfig) { cfg.Writer.BatchSize = 100 }, func(ws *kafkaWriterSettings) bool { return ws.maxBuffered == 1000 }},
+		{"batch_bytes", func(cfg *BrokerConfig) { cfg.Writer.BatchBytes = 1024 }, func(ws *kafkaWriterSettings) bool { return ws.batchMaxBytes == 1024 }},
+		{"batch_timeout", func(cfg *BrokerConfig) { cfg.Writer.BatchTimeout.Duration = time.Second }, func(ws *kafkaWriterSettings) bool {
+			return ws.linger == time.Second
+		}},
+		{"read_timeout", func(cfg *BrokerConfig) { cfg.Writer.ReadTimeout.Duration = time.Second }, func(ws *kafkaWriterSettings) bool {
+			return ws.requestTimeout == time.Second
+		}},
+		{"write_timeout", func(cfg *BrokerConfig) { cfg.Writer.WriteTimeout.Duration = time.Second }, func(ws *kafkaWriterSettings) bool {
+			return ws.deliveryTimeout == time.Second
+		}},
+		{"partitioner", func(cfg *BrokerConfig) { cfg.Writer.Partitioner = KafkaPartitionerRoundRobin }, func(ws *kafkaWriterSettings) bool {
+			return ws.partitioner != nil
+		}},
+		{"compression", func(cfg *BrokerConfig) { cfg.Writer.Compression = []string{"zstd", "LZ4", "snappy", "gzip", "none"} }, func(ws *kafkaWriterSettings) bool {
+			return reflect.DeepEqual(ws.compression, []kgo.CompressionCodec{
+				kgo.ZstdCompression(), kgo.Lz4Compression(), kgo.SnappyCompression(), kgo.GzipCompression(), kgo.NoCompression(),
+			})
+		}},
+		{"acks_none", func(cfg *BrokerConfig) { cfg.Writer.RequiredAcks = acks(0) }, func(ws *kafkaWriterSettings) bool {
+			return ws.acks == kgo.NoAck() && !ws.idempotent
+		}},
+		{"acks_leader", func(cfg *BrokerConfig) { cfg.Writer.RequiredAcks = acks(1) }, func(ws *kafkaWriterSettings) bool {
+			return ws.acks == kgo.LeaderAck() && !ws.idempotent
+		}},
+		{"acks_all", func(cfg *BrokerConfig) { cfg.Writer.RequiredAcks = acks(-1) }, func(ws *kafkaWriterSettings) bool {
+			return ws.acks == kgo.AllISRAcks() && !ws.idempotent
+		}},
+		{"acks_all_idempotent", func(cfg *BrokerConfig) { cfg.Writer.RequiredAcks, cfg.Writer.Idempotent = acks(-1), true }, func(ws *kafkaWriterSettings) bool {
+			return ws.acks == kgo.AllISRAcks() && ws.idempotent
+		}},
+		{"idempotent", func(cfg *BrokerConfig) { cfg.Writer.Idempotent = true }, func(ws *kafkaWriterSettings) bool {
+			return ws.acks == kgo.AllISRAcks() && ws.idempotent
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &BrokerConfig{}
+			tt.set(cfg)
+			ws, err := newKafkaWriterSettings(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(ws) {
+				t.Fatalf("unexpected settings %+v", ws)
+			}
+			if _, err = newKafkaWriterOptions(cfg); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestKafkaOptionsValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(cfg *BrokerConfig)
+	}{
+		{"negative_min_bytes", func(cfg *BrokerConfig) { cfg.Reader.MinBytes = -1 }},
+		{"min_bytes_greater_max_bytes", func(cfg *BrokerConfig) { cfg.Reader.MinBytes, cfg.Reader.MaxBytes = 10, 5 }},
+		{"negative_max_wait", func(cfg *BrokerConfig) { cfg.Reader.MaxWait.Duration = -time.Second }},
+		{"group_conflict", func(cfg *BrokerConfig) { cfg.Group, cfg.Reader.Group = "a", "b" }},
+		{"lag_without_group", func(cfg *BrokerConfig) { cfg.Reader.ReadLagInterval.Duration = time.Second }},
+		{"heartbeat_greater_session", func(cfg *BrokerConfig) {
+			cfg.Reader.HeartbeatInterval.Duration, cfg.Reader.SessionTimeout.Duration = 10*time.Second, time.Second
+		}},
+		{"invalid_offset", func(cfg *BrokerConfig) { cfg.Reader.StartOffset = -3 }},
+		{"join_backoff_with_read_backoff", func(cfg *BrokerConfig) {
+			cfg.Reader.JoinGroupBackoff.Duration, cfg.Reader.ReadBackoffMin.Duration = time.Second, time.Second
+		}},
+		{"backoff_min_greater_max", func(cfg *BrokerConfig) {
+			cfg.Reader.ReadBackoffMin.Duration, cfg.Reader.ReadBackoffMax.Duration = time.Minute, time.Second
+		}},
+		{"invalid_acks", func(cfg *BrokerConfig) { cfg.Writer.RequiredAcks = new(int); *cfg.Writer.RequiredAcks = 2 }},
+		{"negative_batch_size", func(cfg *BrokerConfig) { cfg.Writer.BatchSize = -1 }},
+		{"unknown_partitioner", func(cfg *BrokerConfig) { cfg.Writer.Partitioner = "hash" }},
+		{"negative_write_timeout", func(cfg *BrokerConfig) { cfg.Writer.WriteTimeout.Duration = -time.Second }},
+		{"unknown_sasl", func(cfg *BrokerConfig) { cfg.SASL.Mechanism = "gssapi" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &BrokerConfig{}
+			tt.set(cfg)
+			_, _, rerr := newKafkaReaderOptions(cfg)
+			_, werr := newKafkaWriterOptions(cfg)
+			if rerr == nil && werr == nil {
+				t.Fatal("expected validation error")
+			}
+		})
+	}
+}
+
+func TestKafkaBackoff(t *testing.T) {
+	fn := newKafkaBackoff(100*time.Millisecond, time.Second)
+	for tries, expect := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		5:  time.Second,
+		50: time.Second,
+	} {
+		if v := fn(tries); v != expect {
+			t.Fatalf("tries %d: backoff %s != %s", tries, v, expect)
+		}
+	}
+}
+
+func TestKafkaWriterCompression(t *testing.T) {
+	cfg := &BrokerConfig{}
+	cfg.Writer.Compression = []string{"brotli"}
+	if _, err := newKafkaWriterOptions(cfg); err == nil {
+		t.Fatal("expected error for unknown compression")
+	}
+}
+
+// kafkaOptNames returns names of kgo functions that made options, like RequiredAcks
+func kafkaOptNames(opts []kgo.Opt) map[string]bool {
+	names := make(map[string]bool, len(opts))
+	for _, opt := range opts {
+		// kgo options are structs with single func field
+		v := reflect.ValueOf(opt)
+		if v.Kind() != reflect.Struct || v.NumField() != 1 || v.Field(0).Kind() != reflect.Func {
+			continue
+		}
+		name := runtime.FuncForPC(v.Field(0).Pointer()).Name()
+		name = strings.TrimPrefix(name, "github.com/twmb/franz-go/pkg/kgo.")
+		names[strings.Split(name, ".")[0]] = true
+	}
+	return names
+}
+
+func TestKafkaOptionSet(t *testing.T) {
+	acks := -1
+	tests := []struct {
+		name     string
+		set      func(cfg *BrokerConfig)
+		reader   bool
+		expected []string
+		missing  []string
+	}{
+		{"writer_default", func(cfg *BrokerConfig) {}, false,
+			[]string{"ClientID", "ProducerBatchCompression", "MaxBufferedRecords", "ProducerBatchMaxBytes", "RequiredAcks", "DisableIdempotentWrite"},
+			[]string{"RecordPartitioner", "RecordRetries", "ProducerLinger", "ProduceRequestTimeout", "RecordDeliveryTimeout", "SASL", "DialTLSConfig"},
+		},
+		{"writer", func(cfg *BrokerConfig) {
+			cfg.Writer.RequiredAcks, cfg.Writer.Idempotent = &acks, true
+			cfg.Writer.Partitioner = KafkaPartitionerRoundRobin
+			cfg.Writer.MaxAttempts = 3
+			cfg.Writer.BatchTimeout.Duration = time.Second
+			cfg.Writer.ReadTimeout.Duration = time.Second
+			cfg.Writer.WriteTimeout.Duration = time.Second
+			cfg.Username, cfg.Password = "user", "secret"
+			cfg.TLS.Enabled = true
+		}, false,
+			[]string{"RequiredAcks", "RecordPartitioner", "RecordRetries", "ProducerLinger", "ProduceRequestTimeout", "RecordDeliveryTimeout", "SASL", "DialTLSConfig"},
+			[]string{"DisableIdempotentWrite"},
+		},
+		{"reader_default", func(cfg *BrokerConfig) {}, true,
+			[]string{"FetchMaxWait", "ClientID"},
+			[]string{"FetchMinBytes", "FetchMaxBytes", "HeartbeatInterval", "SessionTimeout", "RebalanceTimeout", "MetadataMaxAge",
+				"ConsumeResetOffset", "RetryBackoffFn", "RequestRetries"},
+		},
+		{"reader", func(cfg *BrokerConfig) {
+			cfg.Reader.MinBytes, cfg.Reader.MaxBytes = 1, 1024
+			cfg.Reader.HeartbeatInterval.Duration = time.Second
+			cfg.Reader.SessionTimeout.Duration = 10 * time.Second
+			cfg.Reader.RebalanceTimeout.Duration = time.Minute
+			cfg.Reader.PartitionWatchInterval.Duration = time.Minute
+			cfg.Reader.StartOffset = kafkaFirstOffset
+			cfg.Reader.ReadBackoffMax.Duration = time.Second
+			cfg.Reader.MaxAttempts = 3
+		}, true,
+			[]string{"FetchMinBytes", "FetchMaxBytes", "HeartbeatInterval", "SessionTimeout", "RebalanceTimeout", "MetadataMaxAge",
+				"ConsumeResetOffset", "RetryBackoffFn", "RequestRetries"},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &BrokerConfig{}
+			tt.set(cfg)
+			var opts []kgo.Opt
+			var err error
+			if tt.reader {
+				opts, _, err = newKafkaReaderOptions(cfg)
+			} else {
+				opts, err = newKafkaWriterOptions(cfg)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := kafkaOptNames(opts)
+			for _, name := range tt.expected {
+				if !names[name] {
+					t.Fatalf("option %s not set, got %v", name, names)
+				}
+			}
+			for _, name := range tt.missing {
+				if names[name] {
+					t.Fatalf("unexpected option %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestKafkaWriterIdempotent(t *testing.T) {
+	for _, acks := range []int{0, 1} {
+		cfg := &BrokerConfig{}
+		cfg.Writer.Idempotent = true
+		cfg.Writer.RequiredAcks = &acks
+		if _, err := newKafkaWriterOptions(cfg); err == nil {
+			t.Fatalf("expected error for idempotent producing with required_acks %d", acks)
+		}
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("expected validation error for idempotent producing with required_acks %d", acks)
+		}
+	}
+}
+
+type testEvent struct {
+	broker.Event
+	topic string
+	msg   *broker.Message
+	err   error
+	acked bool
+}
+
+func (e *testEvent) Topic() string            { return e.topic }
+func (e *testEvent) Message() *broker.Message { return e.msg }
+func (e *testEvent) Error() error             { return e.err }
+func (e *testEvent) Ack() error {
+	e.acked = true
+	return nil
+}
+
+type testMessage struct {
+	client.Message
+	topic string
+}
+
+func (m *testMessage) Topic() string { return m.topic }
+
+type testClient struct {
+	client.Client
+	mu        sync.Mutex
+	published []string
+	headers   []metadata.Metadata
+	err       error
+	calls     int
+}
+
+func (c *testClient) NewMessage(topic string, msg interface{}, opts ...client.MessageOption) client.Message {
+	return &testMessage{topic: topic}
+}
+
+func (c *testClient) Publish(ctx context.Context, msg client.Message, opts ...client.PublishOption) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.err != nil {
+		return c.err
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	c.published = append(c.published, msg.Topic())
+	c.headers = append(c.headers, metadata.Copy(md))
+	return nil
+}
+
+func TestErrorHandlerRetry(t *testing.T) {
+	c := &testClient{}
+	h := NewErrorHandler("errors", "app", c, ErrorHandlerRetry(2, time.Second, time.Minute))
+
+	evt := &testEvent{
+		topic: "orders",
+		msg:   &broker.Message{Header: metadata.New(0), Body: []byte(`{}`)},
+		err:   errors.New("first"),
+	}
+
+	expect := []string{"orders.retry.1", "orders.retry.2", "errors"}
+	for i, topic := range expect {
+		if err := h(evt); err == nil {
+			t.Fatal("error handler must return event error")
+		}
+		if !evt.acked {
+			t.Fatal("message not acked")
+		}
+		if c.published[i] != topic {
+			t.Fatalf("published to %s, expected %s", c.published[i], topic)
+		}
+		md := c.headers[i]
+		if v, _ := md.Get(retry.HeaderSourceTopic); v != "orders" {
+			t.Fatalf("source topic %q != orders", v)
+		}
+		if v, _ := md.Get(retry.ErrorHeader(i + 1)); v != evt.err.Error() {
+			t.Fatalf("error history %q != %q", v, evt.err.Error())
+		}
+		evt.topic, evt.acked = topic, false
+		evt.err = errors.New(topic)
+	}
+
+	md := c.headers[len(c.headers)-1]
+	if _, ok := md.Get(retry.HeaderNotBefore); ok {
+		t.Fatal("dead lettered message must not have retry delay")
+	}
+	if v, _ := md.Get(retry.HeaderAttempt); v != "2" {
+		t.Fatalf("attempt %q != 2", v)
+	}
+}
+
+func TestErrorHandlerRetryConfig(t *testing.T) {
+	cfg := &BrokerConfig{}
+	cfg.Reader.MaxAttempts = 2
+
+	c := &testClient{}
+	h := NewErrorHandler("errors", "app", c, ErrorHandlerRetryConfig(cfg))
+	evt := &testEvent{topic: "orders", msg: &broker.Message{Header: metadata.New(0)}, err: errors.New("failed")}
+	for _, topic := range []string{"orders.retry.1", "errors"} {
+		_ = h(evt)
+		evt.topic = topic
+	}
+	// first processing is counted in max attempts
+	if len(c.published) != 2 || c.published[1] != "errors" {
+		t.Fatalf("published to %v, expected single retry topic", c.published)
+	}
+}
+
+func TestErrorHandlerSourceTopic(t *testing.T) {
+	c := &testClient{}
+	h := NewErrorHandler("errors", "app", c)
+
+	evt := &testEvent{
+		topic: "orders",
+		msg:   &broker.Message{Header: metadata.New(0), Body: []byte(`{}`)},
+		err:   errors.New("failed"),
+	}
+	_ = h(evt)
+	if v, _ := c.headers[0].Get(retry.HeaderSourceTopic); v != "orders" {
+		t.Fatalf("source topic %q != orders", v)
+	}
+}
+
+func TestErrorHandlerPolicy(t *testing.T) {
+	for policy, calls := range map[ErrorPolicy]int{
+		ErrorPolicyRetry: 3,
+		ErrorPolicySkip:  1,
+	} {
+		c := &testClient{err: errors.New("publish failed")}
+		var unrecoverable error
+		h := NewErrorHandler("errors", "app", c,
+			ErrorHandlerPolicy(policy),
+			ErrorHandlerPublishRetry(3, time.Millisecond, time.Millisecond),
+			ErrorHandlerUnrecoverable(func(evt broker.Event, err error) { unrecoverable = err }),
+		)
+
+		evt := &testEvent{
+			topic: "orders",
+			msg:   &broker.Message{Header: metadata.New(0), Body: []byte(`{}`)},
+			err:   errors.New("broken"),
+		}
+		if err := h(evt); !errors.Is(err, c.err) {
+			t.Fatalf("policy %d: unexpected error %v", policy, err)
+		}
+		if unrecoverable == nil {
+			t.Fatalf("policy %d: unrecoverable callback not called", policy)
+		}
+		if evt.acked {
+			t.Fatalf("policy %d: message must be left unacked", policy)
+		}
+		if c.calls != calls {
+			t.Fatalf("policy %d: publish called %d times, expected %d", policy, c.calls, calls)
+		}
+	}
+}
+
+func TestInitBroker(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(cfg *BrokerConfig)
+		valid bool
+	}{
+		{"memory", func(cfg *BrokerConfig) { cfg.Type = "memory" }, true},
+		{"nats", func(cfg *BrokerConfig) { cfg.Type = "nats"; cfg.NATS.MaxReconnects = -1 }, true},
+		{"amqp", func(cfg *BrokerConfig) { cfg.Type = "amqp"; cfg.AMQP.ExchangeType = "fanout" }, true},
+		{"rabbitmq", func(cfg *BrokerConfig) { cfg.Type = "rabbitmq" }, true},
+		{"schema registry", func(cfg *BrokerConfig) {
+			cfg.Type, cfg.Codec, cfg.SchemaRegistry.URL = "memory", BrokerCodecSchemaRegistry, "http://127.0.0.1:1"
+		}, true},
+		{"unknown type", func(cfg *BrokerConfig) { cfg.Type = "kafak" }, false},
+		{"unknown codec", func(cfg *BrokerConfig) { cfg.Type, cfg.Codec = "memory", "avro" }, false},
+		{"schema registry url", func(cfg *BrokerConfig) { cfg.Type, cfg.Codec = "memory", BrokerCodecSchemaRegistry }, false},
+		{"nats reconnects", func(cfg *BrokerConfig) { cfg.Type = "nats"; cfg.NATS.MaxReconnects = -2 }, false},
+		{"amqp exchange type", func(cfg *BrokerConfig) { cfg.Type = "amqp"; cfg.AMQP.ExchangeType = "queue" }, false},
+		{"amqp prefetch", func(cfg *BrokerConfig) { cfg.Type = "amqp"; cfg.AMQP.PrefetchCount = -1 }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &BrokerConfig{Addr: []string{"127.0.0.1:1"}}
+			tt.set(cfg)
+			b, err := InitBrokerE(cfg)
+			switch {
+			case tt.valid && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.valid && b == nil:
+				t.Fatal("nil broker")
+			case !tt.valid && err == nil:
+				t.Fatal("expected error")
+			}
+		})
+	}
+
+	if b, err := InitBrokerE(&BrokerConfig{}); err != nil || b != broker.DefaultBroker {
+		t.Fatalf("empty type must return default broker, got %v %v", b, err)
+	}
+	if b, err := InitBrokerE(&BrokerConfig{Type: "kafak"}); err == nil || b != nil {
+		t.Fatalf("unknown type must fail, got %v %v", b, err)
+	}
+}
+
+func TestInitBrokerKafkaLag(t *testing.T) {
+	cfg := &BrokerConfig{Type: "kafka", Addr: []string{"127.0.0.1:1"}, Group: "group"}
+	cfg.Reader.ReadLagInterval.Duration = time.Second
+
+	b, err := InitBrokerE(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, ok := b.(*kafkaLagBroker)
+	if !ok {
+		t.Fatalf("broker %T, expected lag broker", b)
+	}
+	// lag is reported without pool, default subscribers are kept
+	if _, ok := lb.Broker.(*kafkaPoolBroker); ok {
+		t.Fatal("lag interval must not enable pool")
+	}
+
+	cfg.Workers = 2
+	if b, err = InitBrokerE(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.(*kafkaLagBroker).Broker.(*kafkaPoolBroker); !ok {
+		t.Fatal("pool expected with workers > 1")
+	}
+}
+
+func TestKafkaConfig(t *testing.T) {
+	cfg := &BrokerConfig{}
+	cfg.Reader.MinBytes, cfg.Writer.BatchSize = -1, -1
+	if _, err := NewKafkaReaderConfigE(cfg); err == nil {
+		t.Fatal("expected reader config error")
+	}
+	if _, err := NewKafkaWriterConfigE(cfg); err == nil {
+		t.Fatal("expected writer config error")
+	}
+
+	// security settings fail the config instead of connecting without them
+	cfg = &BrokerConfig{}
+	cfg.TLS.CAFile = "missing.pem"
+	if _, err := NewKafkaReaderConfigE(cfg); err == nil {
+		t.Fatal("expected reader tls error")
+	}
+	cfg = &BrokerConfig{}
+	cfg.SASL.Mechanism = SASLOAuthBearer
+	if _, err := NewKafkaWriterConfigE(cfg); err == nil {
+		t.Fatal("expected writer sasl error")
+	}
+
+	cfg = &BrokerConfig{}
+	if len(NewKafkaReaderConfig(cfg)) == 0 || len(NewKafkaWriterConfig(cfg)) == 0 {
+		t.Fatal("valid config must return options")
+	}
+}
+
+// writeTestCert writes self signed certificate and its key to dir
+func writeTestCert(t *testing.T, dir string) (certFile string, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafka"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestBrokerTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err = ioutil.WriteFile(garbage, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &BrokerConfig{}
+	if tlsConfig, err := newBrokerTLSConfig(cfg); err != nil || tlsConfig != nil {
+		t.Fatalf("tls must be disabled by default, got %v %v", tlsConfig, err)
+	}
+
+	cfg.TLS.CAFile, cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ServerName = certFile, certFile, keyFile, "kafka"
+	tlsConfig, err := newBrokerTLSConfig(cfg)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case tlsConfig.RootCAs == nil || len(tlsConfig.Certificates) != 1:
+		t.Fatalf("ca and client certificate not loaded: %+v", tlsConfig)
+	case tlsConfig.ServerName != "kafka" || tlsConfig.MinVersion != tls.VersionTLS12:
+		t.Fatalf("unexpected tls settings: %+v", tlsConfig)
+	}
+
+	tests := []struct {
+		name string
+		set  func(cfg *BrokerConfig)
+	}{
+		{"missing_ca", func(cfg *BrokerConfig) { cfg.TLS.CAFile = filepath.Join(dir, "missing.pem") }},
+		{"invalid_ca", func(cfg *BrokerConfig) { cfg.TLS.CAFile = garbage }},
+		{"cert_without_key", func(cfg *BrokerConfig) { cfg.TLS.CertFile = certFile }},
+		{"invalid_cert", func(cfg *BrokerConfig) { cfg.TLS.CertFile, cfg.TLS.KeyFile = garbage, keyFile }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &BrokerConfig{}
+			tt.set(cfg)
+			if _, err := newBrokerTLSConfig(cfg); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestKafkaSASLMechanism(t *testing.T) {
+	tests := []struct {
+		name   string
+		set    func(cfg *BrokerConfig)
+		expect string
+	}{
+		{"none", func(cfg *BrokerConfig) {}, ""},
+		{"plain_by_credentials", func(cfg *BrokerConfig) { cfg.Username, cfg.Password = "user", "pass" }, "PLAIN"},
+		{"plain", func(cfg *BrokerConfig) { cfg.SASL.Mechanism = "PLAIN" }, "PLAIN"},
+		{"scram_sha_256", func(cfg *BrokerConfig) { cfg.SASL.Mechanism = SASLScramSHA256 }, "SCRAM-SHA-256"},
+		{"scram_sha_512", func(cfg *BrokerConfig) { cfg.SASL.Mechanism = SASLScramSHA512 }, "SCRAM-SHA-512"},
+		{"oauthbearer", func(cfg *BrokerConfig) { cfg.SASL.Mechanism, cfg.SASL.Token = SASLOAuthBearer, "token" }, "OAUTHBEARER"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &BrokerConfig{}
+			tt.set(cfg)
+			mechanism, err := newKafkaSASLMechanism(cfg)
+			switch {
+			case err != nil:
+				t.Fatal(err)
+			case tt.expect == "" && mechanism != nil:
+				t.Fatalf("unexpected mechanism %s", mechanism.Name())
+			case tt.expect != "" && (mechanism == nil || mechanism.Name() != tt.expect):
+				t.Fatalf("expected mechanism %s, got %v", tt.expect, mechanism)
+			}
+		})
+	}
+
+	cfg := &BrokerConfig{}
+	cfg.SASL.Mechanism = SASLOAuthBearer
+	if _, err := newKafkaSASLMechanism(cfg); err == nil {
+		t.Fatal("expected error for oauthbearer without token")
+	}
+}
+
+func TestBrokerMemory(t *testing.T) {
+	b, err := InitBrokerE(&BrokerConfig{Type: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect(context.Background())
+
+	received := make(chan *broker.Message, 1)
+	sub, err := b.Subscribe(context.Background(), "orders", func(evt broker.Event) error {
+		received <- evt.Message()
+		return evt.Ack()
+	}, broker.SubscribeGroup("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe(context.Background())
+
+	msg := &broker.Message{Header: metadata.Metadata{"Message-Id": "1"}, Body: []byte(`{"id":"1"}`)}
+	if err = b.Publish(context.Background(), "orders", msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case out := <-received:
+		if id, _ := out.Header.Get("Message-Id"); id != "1" || string(out.Body) != `{"id":"1"}` {
+			t.Fatalf("received %v %s", out.Header, out.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+type testAvroOrder struct {
+	ID   string  `json:"id"`
+	Note *string `json:"note"`
+}
+
+func (o *testAvroOrder) AvroSchema() string {
+	return `{"type":"record","name":"Order","namespace":"shop","fields":[{"name":"id","type":"string"},{"name":"note","type":["null","string"],"default":null}]}`
+}
+
+// testSchemaRegistry starts registry without registered schemas, lookups fail and schemas are auto registered
+func testSchemaRegistry(t *testing.T) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	var schemas []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet:
+			id, _ := strconv.Atoi(path.Base(r.URL.Path))
+			if id < 1 || id > len(schemas) {
+				http.NotFound(w, r)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]string{"schema": schemas[id-1]})
+		case strings.HasSuffix(r.URL.Path, "/versions"):
+			var req struct {
+				Schema string `json:"schema"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			schemas = append(schemas, req.Schema)
+			_ = json.NewEncoder(w).Encode(map[string]int{"id": len(schemas)})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestBrokerSchemaRegistry(t *testing.T) {
+	srv := testSchemaRegistry(t)
+
+	cfg := &BrokerConfig{Type: "memory", Codec: BrokerCodecSchemaRegistry}
+	cfg.SchemaRegistry.URL, cfg.SchemaRegistry.AutoRegister = srv.URL, true
+	b, err := InitBrokerE(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var copts client.Options
+	for _, opt := range BrokerClientOptions(b) {
+		opt(&copts)
+	}
+	var sopts server.Options
+	for _, opt := range BrokerServerOptions(b) {
+		opt(&sopts)
+	}
+	if copts.Broker != b || sopts.Broker != b || copts.Codecs[registry.ContentType] == nil {
+		t.Fatalf("schema registry codec not registered: %+v %+v", copts, sopts)
+	}
+
+	received := make(chan *testAvroOrder, 1)
+	_, err = b.Subscribe(context.Background(), "orders", func(evt broker.Event) error {
+		msg := evt.Message()
+		if len(msg.Body) < 5 || msg.Body[0] != 0 {
+			return fmt.Errorf("body not in wire format: %q", msg.Body)
+		}
+		// server picks codec by content type of message
+		ct, _ := msg.Header.Get(metadata.HeaderContentType)
+		c, ok := sopts.Codecs[ct]
+		if !ok {
+			return fmt.Errorf("no codec for content type %q", ct)
+		}
+		out := &testAvroOrder{}
+		if err := c.Unmarshal(msg.Body, out); err != nil {
+			return err
+		}
+		received <- out
+		return nil
+	}, broker.SubscribeErrorHandler(func(evt broker.Event) error {
+		t.Errorf("subscriber: %v", evt.Error())
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	note := "leave at the door"
+	for _, in := range []*testAvroOrder{{ID: "1"}, {ID: "2", Note: &note}} {
+		// client encodes payload by codec of message content type
+		body, err := copts.Codecs[registry.ContentType].Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := &broker.Message{Header: metadata.Metadata{metadata.HeaderContentType: registry.ContentType}, Body: body}
+		if err = b.Publish(context.Background(), "orders", msg); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case out := <-received:
+			if !reflect.DeepEqual(out, in) {
+				t.Fatalf("received %+v, expected %+v", out, in)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("order %s not received", in.ID)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.unistack.org/micro/v3/broker"
+)
+
+// ErrNotControllable is returned by NewKafkaController for brokers not consumed by pool,
+// kafka broker is controllable with workers > 1 or reader.control enabled
+var ErrNotControllable = errors.New("kafka control: broker subscribers are not controllable")
+
+// ErrNoSubscribers is returned when this instance has no subscribers for topic
+var ErrNoSubscribers = errors.New("kafka control: no subscribers")
+
+// ErrNotOwned is returned by seek of partitions not assigned to this instance
+var ErrNotOwned = errors.New("kafka control: partitions not assigned to this instance")
+
+// KafkaSubscription describes subscriber of this instance
+type KafkaSubscription struct {
+	Topic  string `json:"topic"`
+	Group  string `json:"group"`
+	Paused bool   `json:"paused"`
+	// partitions assigned to this instance
+	Partitions []int32 `json:"partitions"`
+}
+
+// KafkaController pauses, resumes and seeks subscribers of broker created by InitBroker.
+// Pause and seek affect only partitions assigned to this instance, other instances of the group
+// are controlled through their own endpoints.
+type KafkaController struct {
+	broker *kafkaPoolBroker
+}
+
+func NewKafkaController(b broker.Broker) (*KafkaController, error) {
+	for {
+		switch w := b.(type) {
+		case *kafkaPoolBroker:
+			return &KafkaController{broker: w}, nil
+		case *kafkaLagBroker:
+			b = w.Broker
+		default:
+			return nil, ErrNotControllable
+		}
+	}
+}
+
+func (c *KafkaController) Subscriptions() []KafkaSubscription {
+	pools := c.pools("")
+	subs := make([]KafkaSubscription, 0, len(pools))
+	for _, p := range pools {
+		p.mu.Lock()
+		held := p.held
+		p.mu.Unlock()
+		subs = append(subs, KafkaSubscription{
+			Topic:      p.topic,
+			Group:      p.options.Group,
+			Paused:     held,
+			Partitions: p.ownedPartitions(),
+		})
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Topic < subs[j].Topic })
+	return subs
+}
+
+// Pause stops fetching topic, messages already fetched are processed
+func (c *KafkaController) Pause(topic string) error {
+	return c.each(topic, func(p *kafkaPool) error {
+		p.hold(true)
+		return nil
+	})
+}
+
+func (c *KafkaController) Resume(topic string) error {
+	return c.each(topic, func(p *kafkaPool) error {
+		p.hold(false)
+		return nil
+	})
+}
+
+// Seek moves partition of topic to offset, partition -1 means all partitions assigned to this instance.
+// Offset -2 is the first and -1 is the last offset of partition, ErrNotOwned is returned
+// if partition is not assigned to this instance.
+func (c *KafkaController) Seek(ctx context.Context, topic string, partition int32, offset int64) error {
+	return c.each(topic, func(p *kafkaPool) error {
+		partitions := []int32{partition}
+		if partition < 0 {
+			partitions = p.ownedPartitions()
+		}
+		offsets, err := listOffsets(ctx, p.client, topic, partitions, offset, time.Time{})
+		if err != nil {
+			return err
+		}
+		return p.seek(ctx, offsets)
+	})
+}
+
+// SeekTime moves all partitions of topic assigned to this instance to the first offset produced at or after t
+func (c *KafkaController) SeekTime(ctx context.Context, topic string, t time.Time) error {
+	return c.each(topic, func(p *kafkaPool) error {
+		offsets, err := listOffsets(ctx, p.client, topic, p.ownedPartitions(), 0, t)
+		if err != nil {
+			return err
+		}
+		return p.seek(ctx, offsets)
+	})
+}
+
+// ResetOffsets commits offset (-2 first, -1 last or exact) or offset of time t for all partitions of topic.
+// Kafka accepts it only from outside of the group, so group must have no active members.
+func (c *KafkaController) ResetOffsets(ctx context.Context, topic string, offset int64, t time.Time) error {
+	group := kafkaGroup(c.broker.cfg)
+	if group == "" {
+		return fmt.Errorf("kafka control: group required to reset offsets")
+	}
+
+	cl := KafkaClient(c.broker)
+	if cl == nil {
+		return broker.ErrNotConnected
+	}
+
+	mreq := kmsg.NewPtrMetadataRequest()
+	mt := kmsg.NewMetadataRequestTopic()
+	mt.Topic = kmsg.StringPtr(topic)
+	mreq.Topics = append(mreq.Topics, mt)
+	mresp, err := mreq.RequestWith(ctx, cl)
+	if err != nil {
+		return err
+	}
+	var partitions []int32
+	for _, t := range mresp.Topics {
+		if err = kerr.ErrorForCode(t.ErrorCode); err != nil {
+			return fmt.Errorf("kafka control: topic %s: %w", topic, err)
+		}
+		for _, p := range t.Partitions {
+			partitions = append(partitions, p.Partition)
+		}
+	}
+
+	offsets, err := listOffsets(ctx, cl, topic, partitions, offset, t)
+	if err != nil {
+		return err
+	}
+
+	req := kmsg.NewPtrOffsetCommitRequest()
+	req.Group = group
+	// commit from outside of the group
+	req.Generation = -1
+	rt := kmsg.NewOffsetCommitRequestTopic()
+	rt.Topic = topic
+	for partition, offset := range offsets {
+		rp := kmsg.NewOffsetCommitRequestTopicPartition()
+		rp.Partition, rp.Offset = partition, offset
+		rt.Partitions = append(rt.Partitions, rp)
+	}
+	req.Topics = append(req.Topics, rt)
+
+	resp, err := req.RequestWith(ctx, cl)
+	if err != nil {
+		return err
+	}
+	for _, t := range resp.Topics {
+		for _, p := range t.Partitions {
+			if err = kerr.ErrorForCode(p.ErrorCode); err != nil {
+				if errors.Is(err, kerr.UnknownMemberID) || errors.Is(err, kerr.IllegalGeneration) {
+					return fmt.Errorf("kafka control: group %s has active members, stop subscribers first: %w", group, err)
+				}
+				return fmt.Errorf("kafka control: commit %s/%d: %w", topic, p.Partition, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *KafkaController) pools(topic string) []*kafkaPool {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+
+	pools := make([]*kafkaPool, 0, len(c.broker.subs))
+	for p := range c.broker.subs {
+		if topic == "" || p.topic == topic {
+			pools = append(pools, p)
+		}
+	}
+	return pools
+}
+
+func (c *KafkaController) each(topic string, fn func(p *kafkaPool) error) error {
+	pools := c.pools(topic)
+	if len(pools) == 0 {
+		return fmt.Errorf("%w for topic %s", ErrNoSubscribers, topic)
+	}
+	for _, p := range pools {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listOffsets resolves offset (-2 first, -1 last or exact) or time t to exact offsets of partitions
+func listOffsets(ctx context.Context, cl kafkaRequester, topic string, partitions []int32, offset int64, t time.Time) (map[int32]int64, error) {
+	offsets := make(map[int32]int64, len(partitions))
+	if t.IsZero() && offset >= 0 {
+		for _, partition := range partitions {
+			offsets[partition] = offset
+		}
+		return offsets, nil
+	}
+	if len(partitions) == 0 {
+		return offsets, nil
+	}
+
+	timestamp := offset
+	if !t.IsZero() {
+		timestamp = t.UnixNano() / int64(time.Millisecond)
+	}
+
+	req := kmsg.NewPtrListOffsetsRequest()
+	rt := kmsg.NewListOffsetsRequestTopic()
+	rt.Topic = topic
+	for _, partition := range partitions {
+		rp := kmsg.NewListOffsetsRequestTopicPartition()
+		rp.Partition, rp.Timestamp = partition, timestamp
+		rt.Partitions = append(rt.Partitions, rp)
+	}
+	req.Topics = append(req.Topics, rt)
+
+	resp, err := req.RequestWith(ctx, cl)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range resp.Topics {
+		for _, p := range t.Partitions {
+			if err = kerr.ErrorForCode(p.ErrorCode); err != nil {
+				return nil, fmt.Errorf("kafka control: list offsets %s/%d: %w", topic, p.Partition, err)
+			}
+			offsets[p.Partition] = p.Offset
+		}
+	}
+	return offsets, nil
+}
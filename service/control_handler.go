@@ -0,0 +1,164 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/presnalex/go-micro/v3/rest"
+	"go.unistack.org/micro/v3/api"
+)
+
+// DefaultKafkaControlPrefix is path prefix of kafka control endpoints
+var DefaultKafkaControlPrefix = "/admin/kafka"
+
+// KafkaControlHandler exposes KafkaController over http, endpoints are listed by KafkaControlEndpoints
+type KafkaControlHandler struct {
+	c *KafkaController
+}
+
+// KafkaSeekRequest is body of seek and reset requests, time takes precedence over offset,
+// offset -2 is the first and -1 is the last offset
+type KafkaSeekRequest struct {
+	// seek only, all partitions assigned to this instance if empty
+	Partition *int32    `json:"partition,omitempty"`
+	Offset    int64     `json:"offset"`
+	Time      time.Time `json:"time"`
+}
+
+func NewKafkaControlHandler(c *KafkaController) *KafkaControlHandler {
+	return &KafkaControlHandler{c: c}
+}
+
+func KafkaControlEndpoints(prefix string) []*api.Endpoint {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return []*api.Endpoint{
+		{Name: "KafkaControl.Subscriptions", Method: []string{http.MethodGet}, Path: []string{prefix + "/subscribers"}},
+		{Name: "KafkaControl.Pause", Method: []string{http.MethodPost}, Path: []string{prefix + "/subscribers/{topic}/pause"}},
+		{Name: "KafkaControl.Resume", Method: []string{http.MethodPost}, Path: []string{prefix + "/subscribers/{topic}/resume"}},
+		{Name: "KafkaControl.Seek", Method: []string{http.MethodPost}, Path: []string{prefix + "/subscribers/{topic}/seek"}},
+		{Name: "KafkaControl.Reset", Method: []string{http.MethodPost}, Path: []string{prefix + "/subscribers/{topic}/reset"}},
+	}
+}
+
+type KafkaControlOptions struct {
+	// Middleware wraps control endpoints only, e.g. to authorize requests
+	Middleware []mux.MiddlewareFunc
+}
+
+type KafkaControlOption func(*KafkaControlOptions)
+
+// KafkaControlMiddleware adds middleware applied to control endpoints
+func KafkaControlMiddleware(mw ...mux.MiddlewareFunc) KafkaControlOption {
+	return func(o *KafkaControlOptions) {
+		o.Middleware = append(o.Middleware, mw...)
+	}
+}
+
+// KafkaControlBasicAuth allows only requests with given credentials
+func KafkaControlBasicAuth(username, password string) KafkaControlOption {
+	return KafkaControlMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, p, ok := r.BasicAuth()
+			if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(username)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="kafka control"`)
+				writeKafkaControl(w, http.StatusUnauthorized, map[string]string{"error": "kafka control: unauthorized"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+// RegisterKafkaControl registers control endpoints of broker subscribers under prefix,
+// DefaultKafkaControlPrefix is used if prefix is empty. Endpoints change consumer offsets,
+// so they must be protected by KafkaControlBasicAuth or KafkaControlMiddleware.
+func RegisterKafkaControl(r *mux.Router, c *KafkaController, prefix string, opts ...KafkaControlOption) error {
+	if prefix == "" {
+		prefix = DefaultKafkaControlPrefix
+	}
+	var options KafkaControlOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if len(options.Middleware) == 0 {
+		return fmt.Errorf("kafka control: endpoints under %s require KafkaControlBasicAuth or KafkaControlMiddleware", prefix)
+	}
+
+	// middleware of subrouter is applied to control endpoints only
+	sr := r.PathPrefix(strings.TrimSuffix(prefix, "/")).Subrouter()
+	sr.Use(options.Middleware...)
+	return rest.Register(sr, NewKafkaControlHandler(c), KafkaControlEndpoints(""))
+}
+
+func (h *KafkaControlHandler) Subscriptions(w http.ResponseWriter, r *http.Request) {
+	writeKafkaControl(w, http.StatusOK, h.c.Subscriptions())
+}
+
+func (h *KafkaControlHandler) Pause(w http.ResponseWriter, r *http.Request) {
+	h.reply(w, h.c.Pause(mux.Vars(r)["topic"]))
+}
+
+func (h *KafkaControlHandler) Resume(w http.ResponseWriter, r *http.Request) {
+	h.reply(w, h.c.Resume(mux.Vars(r)["topic"]))
+}
+
+func (h *KafkaControlHandler) Seek(w http.ResponseWriter, r *http.Request) {
+	req, ok := readKafkaSeek(w, r)
+	if !ok {
+		return
+	}
+	topic := mux.Vars(r)["topic"]
+
+	if !req.Time.IsZero() {
+		h.reply(w, h.c.SeekTime(r.Context(), topic, req.Time))
+		return
+	}
+	partition := int32(-1)
+	if req.Partition != nil {
+		partition = *req.Partition
+	}
+	h.reply(w, h.c.Seek(r.Context(), topic, partition, req.Offset))
+}
+
+func (h *KafkaControlHandler) Reset(w http.ResponseWriter, r *http.Request) {
+	req, ok := readKafkaSeek(w, r)
+	if !ok {
+		return
+	}
+	h.reply(w, h.c.ResetOffsets(r.Context(), mux.Vars(r)["topic"], req.Offset, req.Time))
+}
+
+func (h *KafkaControlHandler) reply(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		writeKafkaControl(w, http.StatusOK, h.c.Subscriptions())
+	case errors.Is(err, ErrNoSubscribers):
+		writeKafkaControl(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrNotOwned):
+		writeKafkaControl(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		writeKafkaControl(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+}
+
+func readKafkaSeek(w http.ResponseWriter, r *http.Request) (*KafkaSeekRequest, bool) {
+	req := &KafkaSeekRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeKafkaControl(w, http.StatusBadRequest, map[string]string{"error": "kafka control: invalid request: " + err.Error()})
+		return nil, false
+	}
+	return req, true
+}
+
+func writeKafkaControl(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
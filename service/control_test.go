@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.unistack.org/micro/v3/broker"
+)
+
+func testController(t *testing.T) (*KafkaController, *kafkaPool, *testPoolClient) {
+	t.Helper()
+	cfg := &BrokerConfig{Workers: 1}
+	cfg.Reader.Control = true
+
+	p, cl := testPool(t, cfg, func(evt broker.Event) error { return nil }, nil)
+	p.options.Group = "group"
+	p.assigned(context.Background(), nil, map[string][]int32{"topic": {0, 1}})
+	t.Cleanup(func() { _ = p.Unsubscribe(context.Background()) })
+
+	pb := &kafkaPoolBroker{Broker: broker.NewBroker(), cfg: cfg, subs: map[*kafkaPool]struct{}{p: {}}}
+	c, err := NewKafkaController(newKafkaLagBroker(pb, cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, p, cl
+}
+
+func TestKafkaController(t *testing.T) {
+	if _, err := NewKafkaController(broker.NewBroker()); err != ErrNotControllable {
+		t.Fatalf("expected ErrNotControllable, got %v", err)
+	}
+
+	c, p, cl := testController(t)
+
+	if err := c.Pause("topic"); err != nil {
+		t.Fatal(err)
+	}
+	subs := c.Subscriptions()
+	if len(subs) != 1 || !subs[0].Paused || subs[0].Group != "group" || len(subs[0].Partitions) != 2 {
+		t.Fatalf("unexpected subscriptions %+v", subs)
+	}
+	if p.free() != 0 {
+		t.Fatal("paused pool must not fetch")
+	}
+	if err := c.Resume("topic"); err != nil {
+		t.Fatal(err)
+	}
+	if p.free() == 0 {
+		t.Fatal("resumed pool must fetch")
+	}
+
+	// partition 2 is not assigned to this instance
+	p.assigned(context.Background(), nil, nil)
+	if err := c.Seek(context.Background(), "topic", -1, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.seek(context.Background(), map[int32]int64{1: 7, 2: 7}); !errors.Is(err, ErrNotOwned) {
+		t.Fatalf("expected ErrNotOwned, got %v", err)
+	}
+	p.commit(context.Background())
+	if cl.seeks[0] != 5 || cl.seeks[1] != 5 || cl.commits[0] != 5 || cl.commits[1] != 5 {
+		t.Fatalf("seeks %v, commits %v, expected offset 5 of both partitions", cl.seeks, cl.commits)
+	}
+	if _, ok := cl.seeks[2]; ok {
+		t.Fatal("partition 2 is not owned")
+	}
+	if err := c.Seek(context.Background(), "topic", 2, 7); !errors.Is(err, ErrNotOwned) {
+		t.Fatalf("expected ErrNotOwned, got %v", err)
+	}
+
+	if err := c.Pause("unknown"); err == nil {
+		t.Fatal("expected error for unknown topic")
+	}
+}
+
+func TestKafkaControlHandler(t *testing.T) {
+	c, _, cl := testController(t)
+
+	r := mux.NewRouter()
+	if err := RegisterKafkaControl(r, c, ""); err == nil {
+		t.Fatal("expected error for endpoints without auth")
+	}
+	if err := RegisterKafkaControl(r, c, "", KafkaControlBasicAuth("admin", "secret")); err != nil {
+		t.Fatal(err)
+	}
+	for _, ep := range KafkaControlEndpoints(DefaultKafkaControlPrefix) {
+		if r.Get(ep.Name) == nil {
+			t.Fatalf("route not registered for %s", ep.Name)
+		}
+	}
+	for password, code := range map[string]int{"secret": http.StatusOK, "wrong": http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, DefaultKafkaControlPrefix+"/subscribers", nil)
+		req.SetBasicAuth("admin", password)
+		r.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Fatalf("password %s: %d %s, expected %d", password, w.Code, w.Body.String(), code)
+		}
+	}
+
+	h := NewKafkaControlHandler(c)
+	do := func(fn http.HandlerFunc, topic string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		fn(w, mux.SetURLVars(req, map[string]string{"topic": topic}))
+		return w
+	}
+
+	w := do(h.Pause, "topic", "")
+	var subs []KafkaSubscription
+	if err := json.Unmarshal(w.Body.Bytes(), &subs); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("pause: %d %s", w.Code, w.Body.String())
+	}
+	if len(subs) != 1 || !subs[0].Paused {
+		t.Fatalf("unexpected subscriptions %+v", subs)
+	}
+
+	if w = do(h.Seek, "topic", `{"partition":1,"offset":3}`); w.Code != http.StatusOK {
+		t.Fatalf("seek: %d %s", w.Code, w.Body.String())
+	}
+	if cl.seeks[1] != 3 {
+		t.Fatalf("seeks %v, expected offset 3 of partition 1", cl.seeks)
+	}
+
+	if w = do(h.Seek, "topic", `{"partition":2,"offset":3}`); w.Code != http.StatusConflict {
+		t.Fatalf("seek of unassigned partition: %d %s", w.Code, w.Body.String())
+	}
+	if w = do(h.Resume, "unknown", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("resume of unknown topic: %d %s", w.Code, w.Body.String())
+	}
+	if w = do(h.Seek, "topic", `{`); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid seek: %d %s", w.Code, w.Body.String())
+	}
+}
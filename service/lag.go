@@ -0,0 +1,296 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/logger"
+)
+
+// kafkaLagBroker reports consumer group lag every BrokerConfig.Reader.ReadLagInterval while connected,
+// rebalances are counted by pool subscribers on partitions assignment, so only with workers > 1 or reader control
+type kafkaLagBroker struct {
+	broker.Broker
+	cfg *BrokerConfig
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newKafkaLagBroker(b broker.Broker, cfg *BrokerConfig) *kafkaLagBroker {
+	return &kafkaLagBroker{Broker: b, cfg: cfg}
+}
+
+func (b *kafkaLagBroker) Connect(ctx context.Context) error {
+	if err := b.Broker.Connect(ctx); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cancel != nil {
+		return nil
+	}
+
+	cl := KafkaClient(b.Broker)
+	if cl == nil {
+		return broker.ErrNotConnected
+	}
+	c := newKafkaLagCollector(cl, kafkaGroup(b.cfg))
+
+	cctx, cancel := context.WithCancel(context.Background())
+	b.cancel, b.done = cancel, make(chan struct{})
+	go func(done chan struct{}) {
+		defer close(done)
+		c.run(cctx, b.cfg.Reader.ReadLagInterval.Duration)
+	}(b.done)
+
+	return nil
+}
+
+func (b *kafkaLagBroker) Disconnect(ctx context.Context) error {
+	b.mu.Lock()
+	if b.cancel != nil {
+		b.cancel()
+		<-b.done
+		b.cancel, b.done = nil, nil
+	}
+	b.mu.Unlock()
+
+	return b.Broker.Disconnect(ctx)
+}
+
+// kafkaGroup returns consumer group used by subscribers
+func kafkaGroup(cfg *BrokerConfig) string {
+	if cfg.Reader.Group != "" {
+		return cfg.Reader.Group
+	}
+	return cfg.Group
+}
+
+// kafkaRequester is the part of kgo client used by lag collector
+type kafkaRequester interface {
+	Request(ctx context.Context, req kmsg.Request) (kmsg.Response, error)
+}
+
+var _ kafkaRequester = (*kgo.Client)(nil)
+
+type kafkaLagCollector struct {
+	client kafkaRequester
+	group  string
+
+	// label values reported on previous collect, removed if partition or topic disappears
+	partitions map[[2]string]struct{}
+	topics     map[string]struct{}
+}
+
+func newKafkaLagCollector(cl kafkaRequester, group string) *kafkaLagCollector {
+	registerMetrics()
+
+	return &kafkaLagCollector{
+		client:     cl,
+		group:      group,
+		partitions: make(map[[2]string]struct{}),
+		topics:     make(map[string]struct{}),
+	}
+}
+
+func (c *kafkaLagCollector) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.collect(ctx); err != nil && ctx.Err() == nil {
+			logger.Errorf(ctx, "kafka lag: group %s: %v", c.group, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *kafkaLagCollector) collect(ctx context.Context) error {
+	committed, err := c.committed(ctx)
+	if err != nil {
+		return fmt.Errorf("fetch committed offsets: %w", err)
+	}
+	watermarks, err := c.watermarks(ctx, committed)
+	if err != nil {
+		return fmt.Errorf("list offsets: %w", err)
+	}
+	assigned, err := c.assigned(ctx)
+	if err != nil {
+		return fmt.Errorf("describe group: %w", err)
+	}
+
+	partitions := make(map[[2]string]struct{})
+	for topic, offsets := range committed {
+		for partition, offset := range offsets {
+			hw, ok := watermarks[topic][partition]
+			if !ok {
+				continue
+			}
+			lag := hw - offset
+			if lag < 0 {
+				lag = 0
+			}
+			key := [2]string{topic, strconv.Itoa(int(partition))}
+			partitions[key] = struct{}{}
+			kafkaCommittedGauge.WithLabelValues(c.group, key[0], key[1]).Set(float64(offset))
+			kafkaHighWatermarkGauge.WithLabelValues(c.group, key[0], key[1]).Set(float64(hw))
+			kafkaLagGauge.WithLabelValues(c.group, key[0], key[1]).Set(float64(lag))
+		}
+	}
+	for key := range c.partitions {
+		if _, ok := partitions[key]; !ok {
+			kafkaCommittedGauge.DeleteLabelValues(c.group, key[0], key[1])
+			kafkaHighWatermarkGauge.DeleteLabelValues(c.group, key[0], key[1])
+			kafkaLagGauge.DeleteLabelValues(c.group, key[0], key[1])
+		}
+	}
+	c.partitions = partitions
+
+	topics := make(map[string]struct{}, len(assigned))
+	for topic, n := range assigned {
+		topics[topic] = struct{}{}
+		kafkaAssignedGauge.WithLabelValues(c.group, topic).Set(float64(n))
+	}
+	for topic := range c.topics {
+		if _, ok := topics[topic]; !ok {
+			kafkaAssignedGauge.DeleteLabelValues(c.group, topic)
+		}
+	}
+	c.topics = topics
+
+	return nil
+}
+
+// committed returns offsets committed by group for all topics
+func (c *kafkaLagCollector) committed(ctx context.Context) (map[string]map[int32]int64, error) {
+	req := kmsg.NewPtrOffsetFetchRequest()
+	req.Group = c.group
+	resp, err := req.RequestWith(ctx, c.client)
+	if err != nil {
+		return nil, err
+	}
+
+	committed := make(map[string]map[int32]int64)
+	add := func(topic string, partition int32, offset int64, code int16) {
+		if code != 0 || offset < 0 {
+			return
+		}
+		if committed[topic] == nil {
+			committed[topic] = make(map[int32]int64)
+		}
+		committed[topic][partition] = offset
+	}
+
+	if err = kerr.ErrorForCode(resp.ErrorCode); err != nil {
+		return nil, err
+	}
+	for _, t := range resp.Topics {
+		for _, p := range t.Partitions {
+			add(t.Topic, p.Partition, p.Offset, p.ErrorCode)
+		}
+	}
+	// v8+ response
+	for _, g := range resp.Groups {
+		if g.Group != c.group {
+			continue
+		}
+		if err = kerr.ErrorForCode(g.ErrorCode); err != nil {
+			return nil, err
+		}
+		for _, t := range g.Topics {
+			for _, p := range t.Partitions {
+				add(t.Topic, p.Partition, p.Offset, p.ErrorCode)
+			}
+		}
+	}
+
+	return committed, nil
+}
+
+// watermarks returns high watermarks of partitions with committed offsets
+func (c *kafkaLagCollector) watermarks(ctx context.Context, committed map[string]map[int32]int64) (map[string]map[int32]int64, error) {
+	watermarks := make(map[string]map[int32]int64, len(committed))
+	if len(committed) == 0 {
+		return watermarks, nil
+	}
+
+	req := kmsg.NewPtrListOffsetsRequest()
+	for topic, offsets := range committed {
+		rt := kmsg.NewListOffsetsRequestTopic()
+		rt.Topic = topic
+		for partition := range offsets {
+			rp := kmsg.NewListOffsetsRequestTopicPartition()
+			rp.Partition = partition
+			// latest offset
+			rp.Timestamp = -1
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		req.Topics = append(req.Topics, rt)
+	}
+	resp, err := req.RequestWith(ctx, c.client)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range resp.Topics {
+		for _, p := range t.Partitions {
+			if err = kerr.ErrorForCode(p.ErrorCode); err != nil {
+				logger.Errorf(ctx, "kafka lag: list offsets %s/%d: %v", t.Topic, p.Partition, err)
+				continue
+			}
+			if watermarks[t.Topic] == nil {
+				watermarks[t.Topic] = make(map[int32]int64, len(t.Partitions))
+			}
+			watermarks[t.Topic][p.Partition] = p.Offset
+		}
+	}
+	return watermarks, nil
+}
+
+// assigned returns number of partitions assigned to group members by topic
+func (c *kafkaLagCollector) assigned(ctx context.Context) (map[string]int, error) {
+	req := kmsg.NewPtrDescribeGroupsRequest()
+	req.Groups = []string{c.group}
+	resp, err := req.RequestWith(ctx, c.client)
+	if err != nil {
+		return nil, err
+	}
+
+	assigned := make(map[string]int)
+	for _, g := range resp.Groups {
+		if g.Group != c.group {
+			continue
+		}
+		if err = kerr.ErrorForCode(g.ErrorCode); err != nil {
+			return nil, err
+		}
+		for _, m := range g.Members {
+			var ma kmsg.ConsumerMemberAssignment
+			if len(m.MemberAssignment) == 0 {
+				continue
+			}
+			if err = ma.ReadFrom(m.MemberAssignment); err != nil {
+				return nil, fmt.Errorf("member %s assignment: %w", m.MemberID, err)
+			}
+			for _, t := range ma.Topics {
+				assigned[t.Topic] += len(t.Partitions)
+			}
+		}
+	}
+
+	return assigned, nil
+}
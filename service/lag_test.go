@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+type testRequester struct {
+	committed  map[int32]int64
+	watermarks map[int32]int64
+	members    map[string][]int32
+}
+
+func (r *testRequester) Request(ctx context.Context, req kmsg.Request) (kmsg.Response, error) {
+	switch req.(type) {
+	case *kmsg.OffsetFetchRequest:
+		resp := kmsg.NewPtrOffsetFetchResponse()
+		rt := kmsg.NewOffsetFetchResponseTopic()
+		rt.Topic = "orders"
+		for partition, offset := range r.committed {
+			rp := kmsg.NewOffsetFetchResponseTopicPartition()
+			rp.Partition, rp.Offset = partition, offset
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		resp.Topics = append(resp.Topics, rt)
+		return resp, nil
+	case *kmsg.ListOffsetsRequest:
+		resp := kmsg.NewPtrListOffsetsResponse()
+		rt := kmsg.NewListOffsetsResponseTopic()
+		rt.Topic = "orders"
+		for partition, offset := range r.watermarks {
+			rp := kmsg.NewListOffsetsResponseTopicPartition()
+			rp.Partition, rp.Offset = partition, offset
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		resp.Topics = append(resp.Topics, rt)
+		return resp, nil
+	case *kmsg.DescribeGroupsRequest:
+		resp := kmsg.NewPtrDescribeGroupsResponse()
+		g := kmsg.NewDescribeGroupsResponseGroup()
+		g.Group = "app"
+		for member, partitions := range r.members {
+			var ma kmsg.ConsumerMemberAssignment
+			ma.Topics = []kmsg.ConsumerMemberAssignmentTopic{{Topic: "orders", Partitions: partitions}}
+			m := kmsg.NewDescribeGroupsResponseGroupMember()
+			m.MemberID, m.MemberAssignment = member, ma.AppendTo(nil)
+			g.Members = append(g.Members, m)
+		}
+		resp.Groups = append(resp.Groups, g)
+		return resp, nil
+	}
+	return nil, fmt.Errorf("unexpected request %T", req)
+}
+
+func TestKafkaLagCollector(t *testing.T) {
+	r := &testRequester{
+		committed:  map[int32]int64{0: 10, 1: 5},
+		watermarks: map[int32]int64{0: 15, 1: 5},
+		members:    map[string][]int32{"a": {0, 1}},
+	}
+	c := newKafkaLagCollector(r, "app")
+
+	if err := c.collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(kafkaLagGauge.WithLabelValues("app", "orders", "0")); v != 5 {
+		t.Fatalf("partition 0 lag %v, expected 5", v)
+	}
+	if v := testutil.ToFloat64(kafkaLagGauge.WithLabelValues("app", "orders", "1")); v != 0 {
+		t.Fatalf("partition 1 lag %v, expected 0", v)
+	}
+	if v := testutil.ToFloat64(kafkaCommittedGauge.WithLabelValues("app", "orders", "0")); v != 10 {
+		t.Fatalf("partition 0 committed %v, expected 10", v)
+	}
+	if v := testutil.ToFloat64(kafkaHighWatermarkGauge.WithLabelValues("app", "orders", "0")); v != 15 {
+		t.Fatalf("partition 0 high watermark %v, expected 15", v)
+	}
+	if v := testutil.ToFloat64(kafkaAssignedGauge.WithLabelValues("app", "orders")); v != 2 {
+		t.Fatalf("assigned %v, expected 2", v)
+	}
+}
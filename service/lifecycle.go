@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.unistack.org/micro/v3/logger"
+	"go.unistack.org/micro/v3/server"
+)
+
+// inflight counts handlers and subscribers being processed by server
+type inflight struct {
+	mu sync.Mutex
+	n  int
+	// closed while nothing is processed
+	idle chan struct{}
+}
+
+func newInflight() *inflight {
+	idle := make(chan struct{})
+	close(idle)
+	return &inflight{idle: idle}
+}
+
+func (f *inflight) add() {
+	f.mu.Lock()
+	if f.n == 0 {
+		f.idle = make(chan struct{})
+	}
+	f.n++
+	f.mu.Unlock()
+}
+
+func (f *inflight) done() {
+	f.mu.Lock()
+	f.n--
+	if f.n == 0 {
+		close(f.idle)
+	}
+	f.mu.Unlock()
+}
+
+// wait waits until all handlers return or ctx is done
+func (f *inflight) wait(ctx context.Context) error {
+	f.mu.Lock()
+	idle, n := f.idle, f.n
+	f.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d handlers still running: %w", n, ctx.Err())
+	}
+}
+
+func (f *inflight) handlerWrapper() server.HandlerWrapper {
+	return func(fn server.HandlerFunc) server.HandlerFunc {
+		return func(ctx context.Context, req server.Request, rsp interface{}) error {
+			f.add()
+			defer f.done()
+			return fn(ctx, req, rsp)
+		}
+	}
+}
+
+func (f *inflight) subscriberWrapper() server.SubscriberWrapper {
+	return func(fn server.SubscriberFunc) server.SubscriberFunc {
+		return func(ctx context.Context, msg server.Message) error {
+			f.add()
+			defer f.done()
+			return fn(ctx, msg)
+		}
+	}
+}
+
+// Ready reports if app is started and not shutting down, it is used by readiness probe
+func (a *App) Ready() bool {
+	return atomic.LoadInt32(&a.ready) == 1
+}
+
+// Start starts components in order, if one fails already started ones are stopped
+func (a *App) Start(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for a.started < len(a.components) {
+		c := a.components[a.started]
+		if c.Start != nil {
+			if err := c.Start(ctx); err != nil {
+				_ = a.stop(ctx)
+				return fmt.Errorf("app: start %s: %w", c.Name, err)
+			}
+		}
+		a.started++
+	}
+	atomic.StoreInt32(&a.ready, 1)
+	return nil
+}
+
+// Stop stops started components in reverse order without drain period:
+// server, running handlers, AppOptions.Components, broker flushing producer, databases and metrics.
+// Each component is given AppOptions.StopTimeout, all of them are stopped even if some fail.
+func (a *App) Stop(ctx context.Context) error {
+	atomic.StoreInt32(&a.ready, 0)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stop(ctx)
+}
+
+// Shutdown makes app not ready, waits AppOptions.DrainPeriod for load balancers to notice it and stops app
+func (a *App) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&a.ready, 0)
+
+	logger.Infof(ctx, "app: drain for %s", a.options.DrainPeriod)
+	select {
+	case <-time.After(a.options.DrainPeriod):
+	case <-ctx.Done():
+	}
+
+	return a.Stop(ctx)
+}
+
+func (a *App) stop(ctx context.Context) error {
+	var errs []string
+	for ; a.started > 0; a.started-- {
+		c := a.components[a.started-1]
+		if c.Stop == nil {
+			continue
+		}
+		if err := a.stopComponent(ctx, c); err != nil {
+			logger.Errorf(ctx, "app: stop %s: %v", c.Name, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", c.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("app: stop %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (a *App) stopComponent(ctx context.Context, c AppComponent) error {
+	if a.options.StopTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.options.StopTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	logger.Infof(ctx, "app: stopping %s", c.Name)
+	if err := c.Stop(ctx); err != nil {
+		return err
+	}
+	logger.Infof(ctx, "app: %s stopped in %s", c.Name, time.Since(start))
+	return nil
+}
+
+// Run starts app and shuts it down on AppOptions.Signals or when ctx is done,
+// so process may exit when Run returns
+func (a *App) Run(ctx context.Context) error {
+	if err := a.Start(ctx); err != nil {
+		return err
+	}
+
+	ch := make(chan os.Signal, 1)
+	if len(a.options.Signals) > 0 {
+		signal.Notify(ch, a.options.Signals...)
+		defer signal.Stop(ch)
+	}
+	select {
+	case sig := <-ch:
+		logger.Infof(ctx, "app: received %s, shutting down", sig)
+	case <-ctx.Done():
+		logger.Infof(ctx, "app: shutting down")
+	}
+
+	return a.Shutdown(context.Background())
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.unistack.org/micro/v3/logger"
+)
+
+var (
+	// default metric prefix
+	DefaultMetricPrefix = "micro_"
+	// default label prefix
+	DefaultLabelPrefix = "micro_"
+
+	errorHandlerPublishCounter *prometheus.CounterVec
+	errorHandlerAckCounter     *prometheus.CounterVec
+
+	kafkaLagGauge           *prometheus.GaugeVec
+	kafkaCommittedGauge     *prometheus.GaugeVec
+	kafkaHighWatermarkGauge *prometheus.GaugeVec
+	kafkaAssignedGauge      *prometheus.GaugeVec
+	kafkaRebalanceCounter   *prometheus.CounterVec
+
+	mu sync.Mutex
+)
+
+func registerMetrics() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if errorHandlerPublishCounter == nil {
+		errorHandlerPublishCounter = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("%sbroker_error_publish_total", DefaultMetricPrefix),
+				Help: "How many broken messages published to retry and error topics, partitioned by topic and status",
+			},
+			[]string{
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "topic"),
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "status"),
+			},
+		)
+	}
+
+	if errorHandlerAckCounter == nil {
+		errorHandlerAckCounter = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("%sbroker_error_ack_total", DefaultMetricPrefix),
+				Help: "How many broken messages acked by error handler, partitioned by topic and status",
+			},
+			[]string{
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "topic"),
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "status"),
+			},
+		)
+	}
+
+	if kafkaLagGauge == nil {
+		kafkaLagGauge = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%sbroker_kafka_lag", DefaultMetricPrefix),
+				Help: "Number of messages not consumed by group yet, partitioned by group, topic and partition",
+			},
+			[]string{
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "group"),
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "topic"),
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "partition"),
+			},
+		)
+	}
+
+	if kafkaCommittedGauge == nil {
+		kafkaCommittedGauge = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%sbroker_kafka_committed_offset", DefaultMetricPrefix),
+				Help: "Offset committed by group, partitioned by group, topic and partition",
+			},
+			[]string{
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "group"),
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "topic"),
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "partition"),
+			},
+		)
+	}
+
+	if kafkaHighWatermarkGauge == nil {
+		kafkaHighWatermarkGauge = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%sbroker_kafka_high_watermark", DefaultMetricPrefix),
+				Help: "Offset of the next message produced to partition, partitioned by group, topic and partition",
+			},
+			[]string{
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "group"),
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "topic"),
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "partition"),
+			},
+		)
+	}
+
+	if kafkaAssignedGauge == nil {
+		kafkaAssignedGauge = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: fmt.Sprintf("%sbroker_kafka_assigned_partitions", DefaultMetricPrefix),
+				Help: "Number of partitions assigned to group members, partitioned by group and topic",
+			},
+			[]string{
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "group"),
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "topic"),
+			},
+		)
+	}
+
+	if kafkaRebalanceCounter == nil {
+		kafkaRebalanceCounter = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("%sbroker_kafka_rebalance_total", DefaultMetricPrefix),
+				Help: "How many times partitions were assigned to pool subscribers of this instance, partitioned by group",
+			},
+			[]string{
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "group"),
+			},
+		)
+	}
+
+	for _, collector := range []prometheus.Collector{
+		errorHandlerPublishCounter,
+		errorHandlerAckCounter,
+		kafkaLagGauge,
+		kafkaCommittedGauge,
+		kafkaHighWatermarkGauge,
+		kafkaAssignedGauge,
+		kafkaRebalanceCounter,
+	} {
+		if err := prometheus.DefaultRegisterer.Register(collector); err != nil {
+			// if already registered, skip fatal
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				logger.Fatal(context.Background(), err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.unistack.org/micro/v3/logger"
+)
+
+// DefaultMetricsReadHeaderTimeout limits time to read request headers of metrics server
+var DefaultMetricsReadHeaderTimeout = 10 * time.Second
+
+type MetricsServerOptions struct {
+	// prometheus.DefaultGatherer by default, it has metrics of database/wrapper, promwrapper and this module
+	Gatherer prometheus.Gatherer
+	// additional handlers, like health endpoints
+	Handlers map[string]http.Handler
+}
+
+type MetricsServerOption func(*MetricsServerOptions)
+
+func MetricsGatherer(g prometheus.Gatherer) MetricsServerOption {
+	return func(opts *MetricsServerOptions) {
+		opts.Gatherer = g
+	}
+}
+
+func MetricsHandle(path string, h http.Handler) MetricsServerOption {
+	return func(opts *MetricsServerOptions) {
+		if opts.Handlers == nil {
+			opts.Handlers = make(map[string]http.Handler)
+		}
+		opts.Handlers[path] = h
+	}
+}
+
+// MetricsServer serves /metrics on MetricConfig.Addr, with CoreConfig.Profile it also serves
+// pprof at /debug/pprof/ and runtime and GC stats at /debug/runtime.
+// Server has its own mux, so handlers of http.DefaultServeMux are not served on MetricConfig.Addr.
+type MetricsServer struct {
+	addr string
+	srv  *http.Server
+
+	mu sync.Mutex
+	ln net.Listener
+}
+
+func NewMetricsServer(mcfg *MetricConfig, ccfg *CoreConfig, opts ...MetricsServerOption) *MetricsServer {
+	options := MetricsServerOptions{
+		Gatherer: prometheus.DefaultGatherer,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(options.Gatherer, promhttp.HandlerOpts{}))
+	if ccfg != nil && ccfg.Profile {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.HandleFunc("/debug/runtime", runtimeStats)
+	}
+	for path, h := range options.Handlers {
+		mux.Handle(path, h)
+	}
+
+	return &MetricsServer{
+		addr: mcfg.Addr,
+		srv:  &http.Server{Addr: mcfg.Addr, Handler: mux, ReadHeaderTimeout: DefaultMetricsReadHeaderTimeout},
+	}
+}
+
+// Start listens on address and serves in background
+func (s *MetricsServer) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf(context.Background(), "metrics server: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Stop waits for running requests until ctx is done
+func (s *MetricsServer) Stop(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// Addr returns address server listens on, useful with port 0
+func (s *MetricsServer) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return s.addr
+	}
+	return s.ln.Addr().String()
+}
+
+type runtimeStatsInfo struct {
+	Goroutines  int       `json:"goroutines"`
+	HeapAlloc   uint64    `json:"heap_alloc"`
+	HeapInuse   uint64    `json:"heap_inuse"`
+	HeapObjects uint64    `json:"heap_objects"`
+	Sys         uint64    `json:"sys"`
+	NumGC       int64     `json:"num_gc"`
+	LastGC      time.Time `json:"last_gc"`
+	PauseTotal  string    `json:"pause_total"`
+	NextGC      uint64    `json:"next_gc"`
+}
+
+func runtimeStats(w http.ResponseWriter, r *http.Request) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(runtimeStatsInfo{
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   ms.HeapAlloc,
+		HeapInuse:   ms.HeapInuse,
+		HeapObjects: ms.HeapObjects,
+		Sys:         ms.Sys,
+		NumGC:       gc.NumGC,
+		LastGC:      gc.LastGC,
+		PauseTotal:  gc.PauseTotal.String(),
+		NextGC:      ms.NextGC,
+	})
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestMetricsServer(t *testing.T) {
+	for _, profile := range []bool{false, true} {
+		s := NewMetricsServer(&MetricConfig{Addr: "127.0.0.1:0"}, &CoreConfig{Profile: profile},
+			MetricsHandle("/live", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})),
+		)
+		if err := s.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]int{
+			"/metrics": http.StatusOK, "/live": http.StatusOK, "/debug/pprof/": http.StatusNotFound,
+			"/debug/pprof/heap": http.StatusNotFound, "/debug/runtime": http.StatusNotFound,
+		}
+		if profile {
+			expected["/debug/pprof/"], expected["/debug/pprof/heap"], expected["/debug/runtime"] = http.StatusOK, http.StatusOK, http.StatusOK
+			expected["/debug/pprof/cmdline"], expected["/debug/pprof/trace?seconds=1"] = http.StatusOK, http.StatusOK
+			expected["/debug/pprof/symbol"], expected["/debug/pprof/profile?seconds=1"] = http.StatusOK, http.StatusOK
+			expected["/debug/pprof/unknown"] = http.StatusNotFound
+		}
+		for path, code := range expected {
+			rsp, err := http.Get("http://" + s.Addr() + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rsp.Body.Close()
+			if rsp.StatusCode != code {
+				t.Fatalf("profile %v: %s returned %d, expected %d", profile, path, rsp.StatusCode, code)
+			}
+		}
+
+		if err := s.Stop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
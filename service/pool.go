@@ -0,0 +1,853 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/wrapper/retry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/codec"
+	"go.unistack.org/micro/v3/logger"
+	"go.unistack.org/micro/v3/metadata"
+)
+
+const (
+	// messages of the same partition processed one by one
+	KafkaOrderingPartition = "partition"
+	// messages with the same key processed one by one, messages without key fall back to partition
+	KafkaOrderingKey = "key"
+)
+
+// kafkaPoolBroker processes subscribed messages by BrokerConfig.Workers goroutines,
+// everything except Subscribe is done by wrapped micro broker
+type kafkaPoolBroker struct {
+	broker.Broker
+	cfg   *BrokerConfig
+	kopts []kgo.Opt
+
+	mu   sync.Mutex
+	subs map[*kafkaPool]struct{}
+}
+
+func newKafkaPoolBroker(b broker.Broker, cfg *BrokerConfig) (*kafkaPoolBroker, error) {
+	kopts, _, err := newKafkaReaderOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	kopts = append(kopts, kgo.SeedBrokers(cfg.Addr...))
+
+	return &kafkaPoolBroker{
+		Broker: b,
+		cfg:    cfg,
+		kopts:  kopts,
+		subs:   make(map[*kafkaPool]struct{}),
+	}, nil
+}
+
+func (b *kafkaPoolBroker) Subscribe(ctx context.Context, topic string, h broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	options := broker.NewSubscribeOptions(opts...)
+	if options.Group == "" {
+		options.Group = b.cfg.Reader.Group
+	}
+	if options.Group == "" {
+		options.Group = b.cfg.Group
+	}
+	if options.Group == "" {
+		// offsets are committed manually, so consumer group is mandatory
+		return nil, fmt.Errorf("kafka pool: subscriber group required for topic %s", topic)
+	}
+
+	bopts := b.Broker.Options()
+	if options.ErrorHandler == nil {
+		options.ErrorHandler = bopts.ErrorHandler
+	}
+
+	p := newKafkaPool(topic, h, options, bopts.Codec, b.cfg)
+
+	kopts := make([]kgo.Opt, 0, len(b.kopts)+5)
+	kopts = append(kopts, b.kopts...)
+	kopts = append(kopts,
+		kgo.ConsumerGroup(options.Group),
+		kgo.ConsumeTopics(topic),
+		kgo.DisableAutoCommit(),
+		// records of polled fetch are dispatched before partitions can be revoked
+		kgo.BlockRebalanceOnPoll(),
+		kgo.OnPartitionsAssigned(p.assigned),
+		kgo.OnPartitionsRevoked(p.revoked),
+		kgo.OnPartitionsLost(p.lost),
+	)
+	cl, err := kgo.NewClient(kopts...)
+	if err != nil {
+		return nil, err
+	}
+	p.client = cl
+	p.unsubscribe = func() {
+		b.mu.Lock()
+		delete(b.subs, p)
+		b.mu.Unlock()
+	}
+
+	b.mu.Lock()
+	b.subs[p] = struct{}{}
+	b.mu.Unlock()
+
+	p.start()
+
+	return p, nil
+}
+
+func (b *kafkaPoolBroker) Disconnect(ctx context.Context) error {
+	b.mu.Lock()
+	subs := make([]*kafkaPool, 0, len(b.subs))
+	for p := range b.subs {
+		subs = append(subs, p)
+	}
+	b.mu.Unlock()
+
+	for _, p := range subs {
+		if err := p.Unsubscribe(ctx); err != nil {
+			logger.Errorf(ctx, "kafka pool: unsubscribe from %s: %v", p.topic, err)
+		}
+	}
+
+	return b.Broker.Disconnect(ctx)
+}
+
+// kafkaPoolClient is the part of kgo client used by pool
+type kafkaPoolClient interface {
+	PollRecords(ctx context.Context, maxPollRecords int) kgo.Fetches
+	AllowRebalance()
+	PauseFetchTopics(topics ...string) []string
+	ResumeFetchTopics(topics ...string)
+	CommitOffsetsSync(ctx context.Context, uncommitted map[string]map[int32]kgo.EpochOffset, onDone func(*kgo.Client, *kmsg.OffsetCommitRequest, *kmsg.OffsetCommitResponse, error))
+	SetOffsets(offsets map[string]map[int32]kgo.EpochOffset)
+	Request(ctx context.Context, req kmsg.Request) (kmsg.Response, error)
+	Close()
+}
+
+// kafkaPool reads topic and dispatches records to workers, records of the same partition
+// (or key) always go to the same worker to keep ordering.
+// Number of records being processed is limited by queue capacity, when it is reached fetching is paused.
+// Record left unacked by handler and error handler is redelivered with backoff, commits of its partition
+// are held at its offset until it is acked or partition is revoked.
+// Record of retry topic is delivered after its retry delay.
+type kafkaPool struct {
+	topic          string
+	handler        broker.Handler
+	options        broker.SubscribeOptions
+	codec          codec.Codec
+	byKey          bool
+	capacity       int
+	commitInterval time.Duration
+	revokeTimeout  time.Duration
+	backoff        func(int) time.Duration
+
+	client      kafkaPoolClient
+	unsubscribe func()
+	// counts partitions assignments of consumer group, set if lag metrics are enabled
+	rebalances prometheus.Counter
+
+	workers []chan *kafkaPoolEvent
+	freed   chan struct{}
+	cancel  context.CancelFunc
+	stop    <-chan struct{}
+	polling sync.WaitGroup
+	working sync.WaitGroup
+	stopped sync.Once
+
+	mu       sync.Mutex
+	inflight int
+	paused   bool
+	// paused by KafkaController, fetching is not resumed until Resume
+	held       bool
+	owned      map[int32]struct{}
+	partitions map[int32]*kafkaPartitionOffsets
+	// seeks are applied by poll goroutine between polls, so records fetched before seek
+	// are never dispatched after it
+	seeks      []*kafkaPoolSeek
+	pollCancel context.CancelFunc
+}
+
+type kafkaPoolSeek struct {
+	ctx     context.Context
+	offsets map[int32]int64
+	done    chan error
+}
+
+func newKafkaPool(topic string, h broker.Handler, options broker.SubscribeOptions, c codec.Codec, cfg *BrokerConfig) *kafkaPool {
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	capacity := cfg.Reader.QueueCapacity
+	if capacity == 0 {
+		capacity = defaultKafkaQueueCapacity
+	}
+	if capacity < workers {
+		// otherwise some workers are always idle
+		capacity = workers
+	}
+	commitInterval := time.Second
+	if cfg.Reader.CommitInterval.Duration > 0 {
+		commitInterval = cfg.Reader.CommitInterval.Duration
+	}
+	revokeTimeout := defaultKafkaRebalanceTimeout
+	if cfg.Reader.RebalanceTimeout.Duration > 0 {
+		revokeTimeout = cfg.Reader.RebalanceTimeout.Duration
+	}
+	backoffMin, backoffMax := cfg.Reader.ReadBackoffMin.Duration, cfg.Reader.ReadBackoffMax.Duration
+	if backoffMin <= 0 {
+		backoffMin = defaultKafkaBackoffMin
+	}
+	if backoffMax <= 0 {
+		backoffMax = defaultKafkaBackoffMax
+	}
+	if backoffMax < backoffMin {
+		backoffMax = backoffMin
+	}
+
+	p := &kafkaPool{
+		topic:          topic,
+		handler:        h,
+		options:        options,
+		codec:          c,
+		byKey:          cfg.Reader.Ordering == KafkaOrderingKey,
+		capacity:       capacity,
+		commitInterval: commitInterval,
+		revokeTimeout:  revokeTimeout,
+		backoff:        newKafkaBackoff(backoffMin, backoffMax),
+		workers:        make([]chan *kafkaPoolEvent, workers),
+		freed:          make(chan struct{}, 1),
+		owned:          make(map[int32]struct{}),
+		partitions:     make(map[int32]*kafkaPartitionOffsets),
+	}
+	for i := range p.workers {
+		// in-flight records never exceed capacity, so dispatch does not block
+		p.workers[i] = make(chan *kafkaPoolEvent, capacity)
+	}
+	if cfg.Reader.ReadLagInterval.Duration > 0 {
+		registerMetrics()
+		p.rebalances = kafkaRebalanceCounter.WithLabelValues(options.Group)
+	}
+
+	return p
+}
+
+func (p *kafkaPool) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel, p.stop = cancel, ctx.Done()
+
+	for _, ch := range p.workers {
+		p.working.Add(1)
+		go p.work(ch)
+	}
+
+	p.polling.Add(2)
+	go p.poll(ctx)
+	go p.commitLoop(ctx)
+}
+
+func (p *kafkaPool) Options() broker.SubscribeOptions {
+	return p.options
+}
+
+func (p *kafkaPool) Topic() string {
+	return p.topic
+}
+
+// Unsubscribe stops fetching, waits for dispatched records and commits their offsets
+func (p *kafkaPool) Unsubscribe(ctx context.Context) error {
+	p.stopped.Do(func() {
+		p.cancel()
+		p.polling.Wait()
+		for _, ch := range p.workers {
+			close(ch)
+		}
+		p.working.Wait()
+		p.commit(ctx)
+		p.client.Close()
+		if p.unsubscribe != nil {
+			p.unsubscribe()
+		}
+	})
+	return nil
+}
+
+func (p *kafkaPool) poll(ctx context.Context) {
+	defer p.polling.Done()
+
+	for {
+		p.applySeeks(ctx)
+
+		free := p.free()
+		if free == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.freed:
+				continue
+			}
+		}
+
+		pctx, cancel := context.WithCancel(ctx)
+		p.mu.Lock()
+		p.pollCancel = cancel
+		if len(p.seeks) > 0 {
+			cancel()
+		}
+		p.mu.Unlock()
+
+		fetches := p.client.PollRecords(pctx, free)
+
+		p.mu.Lock()
+		p.pollCancel = nil
+		p.mu.Unlock()
+		cancel()
+
+		if fetches.IsClientClosed() || ctx.Err() != nil {
+			p.client.AllowRebalance()
+			return
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			if !errors.Is(err, context.Canceled) {
+				logger.Errorf(ctx, "kafka pool: fetch %s/%d: %v", topic, partition, err)
+			}
+		})
+		fetches.EachRecord(p.dispatch)
+		p.client.AllowRebalance()
+	}
+}
+
+// free returns how many records may be dispatched, pausing or resuming fetches accordingly
+func (p *kafkaPool) free() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	free := p.capacity - p.inflight
+	if p.held {
+		free = 0
+	}
+	switch {
+	case free <= 0 && !p.paused:
+		p.client.PauseFetchTopics(p.topic)
+		p.paused = true
+	case free > 0 && p.paused:
+		p.client.ResumeFetchTopics(p.topic)
+		p.paused = false
+	}
+	if free < 0 {
+		free = 0
+	}
+
+	return free
+}
+
+func (p *kafkaPool) dispatch(rec *kgo.Record) {
+	p.mu.Lock()
+	if _, ok := p.owned[rec.Partition]; !ok {
+		// partition is revoked, its records are fetched again by new owner from committed offset
+		p.mu.Unlock()
+		return
+	}
+	part, ok := p.partitions[rec.Partition]
+	if !ok {
+		part = newKafkaPartitionOffsets()
+		p.partitions[rec.Partition] = part
+	}
+	part.add(rec.Offset, rec.LeaderEpoch)
+	p.inflight++
+	p.mu.Unlock()
+
+	evt := p.newEvent(rec)
+	evt.partition = part
+
+	idx := uint32(rec.Partition)
+	if p.byKey && len(rec.Key) > 0 {
+		h := fnv.New32a()
+		_, _ = h.Write(rec.Key)
+		idx = h.Sum32()
+	}
+	p.workers[idx%uint32(len(p.workers))] <- evt
+}
+
+func (p *kafkaPool) newEvent(rec *kgo.Record) *kafkaPoolEvent {
+	evt := &kafkaPoolEvent{
+		ctx:    context.Background(),
+		topic:  rec.Topic,
+		offset: rec.Offset,
+		msg:    &broker.Message{},
+		rec:    rec,
+	}
+	if p.options.Context != nil {
+		evt.ctx = p.options.Context
+	}
+
+	if p.options.BodyOnly {
+		evt.msg.Body = rec.Value
+	} else if err := p.codec.Unmarshal(rec.Value, evt.msg); err != nil {
+		evt.err = err
+		evt.msg.Body = rec.Value
+	}
+	if evt.msg.Header == nil {
+		evt.msg.Header = metadata.New(len(rec.Headers))
+	}
+	for _, hdr := range rec.Headers {
+		if _, ok := evt.msg.Header.Get(hdr.Key); !ok {
+			evt.msg.Header.Set(hdr.Key, string(hdr.Value))
+		}
+	}
+
+	return evt
+}
+
+func (p *kafkaPool) work(ch chan *kafkaPoolEvent) {
+	defer p.working.Done()
+
+	for evt := range ch {
+		p.process(evt)
+	}
+}
+
+// process delivers record until it is acked, later records of the same worker wait for it
+func (p *kafkaPool) process(evt *kafkaPoolEvent) {
+	deliver, acked := true, false
+	if t, ok := retry.NotBefore(evt.msg.Header); ok {
+		// message of retry topic waits for its delay here, polling goes on, so consumer stays in group
+		deliver = p.wait(evt, time.Until(t))
+	}
+	for attempt := 1; deliver; attempt++ {
+		if acked = p.deliver(evt); acked {
+			break
+		}
+		logger.Errorf(evt.ctx, "kafka pool: message %s/%d not acked, redelivering: %v", evt.topic, evt.offset, evt.err)
+		if deliver = p.wait(evt, p.backoff(attempt)); deliver {
+			part := evt.partition
+			evt = p.newEvent(evt.rec)
+			evt.partition = part
+		}
+	}
+
+	p.mu.Lock()
+	if acked {
+		evt.partition.done(evt.offset)
+	} else {
+		// record is fetched again from committed offset
+		evt.partition.inflight--
+	}
+	p.inflight--
+	p.mu.Unlock()
+
+	select {
+	case p.freed <- struct{}{}:
+	default:
+	}
+}
+
+// deliver runs handler and error handler, reporting whether record is acked
+func (p *kafkaPool) deliver(evt *kafkaPoolEvent) bool {
+	err := evt.err
+	if err == nil {
+		err = p.handler(evt)
+		if err == nil && p.options.AutoAck {
+			evt.ack = true
+		}
+	}
+	if err != nil {
+		evt.SetError(err)
+		if p.options.ErrorHandler != nil {
+			if eerr := p.options.ErrorHandler(evt); eerr != nil {
+				logger.Errorf(evt.ctx, "kafka pool: error handler %s/%d: %v", evt.topic, evt.offset, eerr)
+			}
+		}
+	}
+	return evt.ack
+}
+
+// wait sleeps before delivery of record, false means record must not be delivered
+// because pool is stopped or partition is revoked
+func (p *kafkaPool) wait(evt *kafkaPoolEvent, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-p.stop:
+		return false
+	case <-evt.partition.dropped:
+		return false
+	case <-timer.C:
+	}
+
+	select {
+	case <-evt.partition.dropped:
+		return false
+	default:
+		return true
+	}
+}
+
+func (p *kafkaPool) commitLoop(ctx context.Context) {
+	defer p.polling.Done()
+
+	ticker := time.NewTicker(p.commitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.commit(ctx)
+		}
+	}
+}
+
+// commit commits offsets of contiguous processed records for all owned partitions
+func (p *kafkaPool) commit(ctx context.Context) {
+	p.mu.Lock()
+	offsets := make(map[int32]kgo.EpochOffset)
+	for partition, part := range p.partitions {
+		if eo, ok := part.uncommitted(); ok {
+			offsets[partition] = eo
+		}
+	}
+	p.mu.Unlock()
+
+	p.commitOffsets(ctx, offsets)
+}
+
+func (p *kafkaPool) commitOffsets(ctx context.Context, offsets map[int32]kgo.EpochOffset) {
+	if len(offsets) == 0 {
+		return
+	}
+
+	p.client.CommitOffsetsSync(ctx, map[string]map[int32]kgo.EpochOffset{p.topic: offsets},
+		func(_ *kgo.Client, _ *kmsg.OffsetCommitRequest, _ *kmsg.OffsetCommitResponse, err error) {
+			if err != nil {
+				logger.Errorf(ctx, "kafka pool: commit %s offsets: %v", p.topic, err)
+				return
+			}
+			p.mu.Lock()
+			for partition, eo := range offsets {
+				if part, ok := p.partitions[partition]; ok {
+					part.committed(eo.Offset)
+				}
+			}
+			p.mu.Unlock()
+		},
+	)
+}
+
+func (p *kafkaPool) assigned(_ context.Context, _ *kgo.Client, assigned map[string][]int32) {
+	if p.rebalances != nil {
+		p.rebalances.Inc()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, partition := range assigned[p.topic] {
+		p.owned[partition] = struct{}{}
+	}
+}
+
+// revoked waits for records of revoked partitions and commits them before partitions move to other consumer
+func (p *kafkaPool) revoked(ctx context.Context, _ *kgo.Client, revoked map[string][]int32) {
+	ctx, cancel := context.WithTimeout(ctx, p.revokeTimeout)
+	defer cancel()
+
+	p.drop(revoked[p.topic])
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !p.drained(revoked[p.topic]) {
+		select {
+		case <-ctx.Done():
+			logger.Errorf(ctx, "kafka pool: %s revoked partitions not drained: %v", p.topic, ctx.Err())
+			p.forget(revoked[p.topic])
+			return
+		case <-ticker.C:
+		}
+	}
+
+	p.mu.Lock()
+	offsets := make(map[int32]kgo.EpochOffset)
+	for _, partition := range revoked[p.topic] {
+		if part, ok := p.partitions[partition]; ok {
+			if eo, ok := part.uncommitted(); ok {
+				offsets[partition] = eo
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	p.commitOffsets(ctx, offsets)
+	p.forget(revoked[p.topic])
+}
+
+// lost drops partitions without commit, they are already owned by other consumer
+func (p *kafkaPool) lost(_ context.Context, _ *kgo.Client, lost map[string][]int32) {
+	p.forget(lost[p.topic])
+}
+
+func (p *kafkaPool) drained(partitions []int32) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, partition := range partitions {
+		if part, ok := p.partitions[partition]; ok && part.inflight > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// drop stops waiting records of partitions, they are not delivered again
+func (p *kafkaPool) drop(partitions []int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, partition := range partitions {
+		if part, ok := p.partitions[partition]; ok {
+			part.drop()
+		}
+	}
+}
+
+func (p *kafkaPool) forget(partitions []int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, partition := range partitions {
+		if part, ok := p.partitions[partition]; ok {
+			part.drop()
+		}
+		delete(p.owned, partition)
+		delete(p.partitions, partition)
+	}
+}
+
+// hold stops or restarts fetching, records already dispatched are processed
+func (p *kafkaPool) hold(held bool) {
+	p.mu.Lock()
+	p.held = held
+	p.mu.Unlock()
+
+	select {
+	case p.freed <- struct{}{}:
+	default:
+	}
+}
+
+// seek moves owned partitions to offsets and waits until it is applied by poll goroutine,
+// new offsets are committed on next commit even if no record is processed after seek
+func (p *kafkaPool) seek(ctx context.Context, offsets map[int32]int64) error {
+	s := &kafkaPoolSeek{ctx: ctx, offsets: offsets, done: make(chan error, 1)}
+
+	p.mu.Lock()
+	p.seeks = append(p.seeks, s)
+	if p.pollCancel != nil {
+		// records of current poll are dispatched before seek
+		p.pollCancel()
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.freed <- struct{}{}:
+	default:
+	}
+
+	select {
+	case err := <-s.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.stop:
+		return fmt.Errorf("kafka pool: %s unsubscribed", p.topic)
+	}
+}
+
+func (p *kafkaPool) applySeeks(ctx context.Context) {
+	p.mu.Lock()
+	seeks := p.seeks
+	p.seeks = nil
+	p.mu.Unlock()
+
+	for _, s := range seeks {
+		s.done <- p.applySeek(ctx, s)
+	}
+}
+
+// applySeek waits for dispatched records of partitions (unacked ones until they are acked),
+// so they are not tracked after seek, and replaces offsets of partitions,
+// nothing is seeked if some of them are not owned by pool
+func (p *kafkaPool) applySeek(ctx context.Context, s *kafkaPoolSeek) error {
+	partitions := make([]int32, 0, len(s.offsets))
+	for partition := range s.offsets {
+		partitions = append(partitions, partition)
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !p.drained(partitions) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	p.mu.Lock()
+	var unowned []int32
+	for _, partition := range partitions {
+		if _, ok := p.owned[partition]; !ok {
+			unowned = append(unowned, partition)
+		}
+	}
+	if len(unowned) > 0 {
+		p.mu.Unlock()
+		sort.Slice(unowned, func(i, j int) bool { return unowned[i] < unowned[j] })
+		return fmt.Errorf("%w: %s %v", ErrNotOwned, p.topic, unowned)
+	}
+	eos := make(map[int32]kgo.EpochOffset, len(s.offsets))
+	for partition, offset := range s.offsets {
+		eos[partition] = kgo.EpochOffset{Epoch: -1, Offset: offset}
+		part := newKafkaPartitionOffsets()
+		part.next, part.nextEpoch = offset, -1
+		p.partitions[partition] = part
+	}
+	p.mu.Unlock()
+
+	if len(eos) > 0 {
+		// kgo drops records of these partitions buffered before
+		p.client.SetOffsets(map[string]map[int32]kgo.EpochOffset{p.topic: eos})
+	}
+	return nil
+}
+
+func (p *kafkaPool) ownedPartitions() []int32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	partitions := make([]int32, 0, len(p.owned))
+	for partition := range p.owned {
+		partitions = append(partitions, partition)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	return partitions
+}
+
+// kafkaPartitionOffsets tracks dispatched records of single partition,
+// commit offset moves forward only over processed records without gaps
+type kafkaPartitionOffsets struct {
+	// dispatched and not yet committable offsets in fetch order
+	pending []int64
+	epochs  map[int64]int32
+	handled map[int64]bool
+	// records dispatched to workers and not processed yet
+	inflight int
+	// next offset to commit and its epoch
+	next      int64
+	nextEpoch int32
+	// last successfully committed offset
+	commit int64
+	// closed when partition is revoked, so waiting records are not delivered
+	dropped chan struct{}
+}
+
+func newKafkaPartitionOffsets() *kafkaPartitionOffsets {
+	return &kafkaPartitionOffsets{
+		epochs:  make(map[int64]int32),
+		handled: make(map[int64]bool),
+		dropped: make(chan struct{}),
+		next:    -1,
+		commit:  -1,
+	}
+}
+
+func (o *kafkaPartitionOffsets) add(offset int64, epoch int32) {
+	o.pending = append(o.pending, offset)
+	o.epochs[offset] = epoch
+	o.inflight++
+}
+
+func (o *kafkaPartitionOffsets) done(offset int64) {
+	o.inflight--
+	o.handled[offset] = true
+
+	for len(o.pending) > 0 && o.handled[o.pending[0]] {
+		head := o.pending[0]
+		o.next, o.nextEpoch = head+1, o.epochs[head]
+		delete(o.handled, head)
+		delete(o.epochs, head)
+		o.pending = o.pending[1:]
+	}
+}
+
+func (o *kafkaPartitionOffsets) drop() {
+	select {
+	case <-o.dropped:
+	default:
+		close(o.dropped)
+	}
+}
+
+func (o *kafkaPartitionOffsets) uncommitted() (kgo.EpochOffset, bool) {
+	if o.next <= o.commit {
+		return kgo.EpochOffset{}, false
+	}
+	return kgo.EpochOffset{Epoch: o.nextEpoch, Offset: o.next}, true
+}
+
+func (o *kafkaPartitionOffsets) committed(offset int64) {
+	if offset > o.commit {
+		o.commit = offset
+	}
+}
+
+type kafkaPoolEvent struct {
+	ctx       context.Context
+	topic     string
+	offset    int64
+	msg       *broker.Message
+	err       error
+	ack       bool
+	rec       *kgo.Record
+	partition *kafkaPartitionOffsets
+}
+
+func (e *kafkaPoolEvent) Context() context.Context {
+	return e.ctx
+}
+
+func (e *kafkaPoolEvent) Topic() string {
+	return e.topic
+}
+
+func (e *kafkaPoolEvent) Message() *broker.Message {
+	return e.msg
+}
+
+func (e *kafkaPoolEvent) Ack() error {
+	e.ack = true
+	return nil
+}
+
+func (e *kafkaPoolEvent) Error() error {
+	return e.err
+}
+
+func (e *kafkaPoolEvent) SetError(err error) {
+	e.err = err
+}
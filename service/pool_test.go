@@ -0,0 +1,564 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/codec/rawjson"
+	"github.com/presnalex/go-micro/v3/wrapper/retry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/metadata"
+)
+
+type testPoolClient struct {
+	mu      sync.Mutex
+	recs    []*kgo.Record
+	paused  bool
+	commits map[int32]int64
+	seeks   map[int32]int64
+}
+
+func (c *testPoolClient) PollRecords(ctx context.Context, max int) kgo.Fetches {
+	c.mu.Lock()
+	if c.paused || len(c.recs) == 0 {
+		c.mu.Unlock()
+		<-ctx.Done()
+		return nil
+	}
+	if max > len(c.recs) {
+		max = len(c.recs)
+	}
+	var fetches kgo.Fetches
+	for _, rec := range c.recs[:max] {
+		fetches = append(fetches, kgo.Fetch{Topics: []kgo.FetchTopic{{
+			Topic:      rec.Topic,
+			Partitions: []kgo.FetchPartition{{Partition: rec.Partition, Records: []*kgo.Record{rec}}},
+		}}})
+	}
+	c.recs = c.recs[max:]
+	c.mu.Unlock()
+	return fetches
+}
+
+func (c *testPoolClient) AllowRebalance() {}
+
+func (c *testPoolClient) PauseFetchTopics(topics ...string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = true
+	return topics
+}
+
+func (c *testPoolClient) ResumeFetchTopics(topics ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = false
+}
+
+func (c *testPoolClient) CommitOffsetsSync(ctx context.Context, offsets map[string]map[int32]kgo.EpochOffset, onDone func(*kgo.Client, *kmsg.OffsetCommitRequest, *kmsg.OffsetCommitResponse, error)) {
+	c.mu.Lock()
+	for _, partitions := range offsets {
+		for partition, eo := range partitions {
+			c.commits[partition] = eo.Offset
+		}
+	}
+	c.mu.Unlock()
+	onDone(nil, nil, nil, nil)
+}
+
+func (c *testPoolClient) SetOffsets(offsets map[string]map[int32]kgo.EpochOffset) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, partitions := range offsets {
+		for partition, eo := range partitions {
+			c.seeks[partition] = eo.Offset
+		}
+	}
+}
+
+func (c *testPoolClient) Request(ctx context.Context, req kmsg.Request) (kmsg.Response, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *testPoolClient) Close() {}
+
+func testPool(t *testing.T, cfg *BrokerConfig, h broker.Handler, recs []*kgo.Record, opts ...broker.SubscribeOption) (*kafkaPool, *testPoolClient) {
+	t.Helper()
+	encodeRecords(t, recs)
+	cl := &testPoolClient{recs: recs, commits: make(map[int32]int64), seeks: make(map[int32]int64)}
+	p := newKafkaPool("topic", h, broker.NewSubscribeOptions(opts...), rawjson.NewCodec(), cfg)
+	p.client = cl
+	for _, rec := range recs {
+		p.owned[rec.Partition] = struct{}{}
+	}
+	p.start()
+	return p, cl
+}
+
+func encodeRecords(t *testing.T, recs []*kgo.Record) {
+	t.Helper()
+	for _, rec := range recs {
+		value, err := rawjson.NewCodec().Marshal(&broker.Message{
+			Header: metadata.Metadata{"Content-Type": "application/json"},
+			Body:   rec.Value,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Topic, rec.Value = "topic", value
+	}
+}
+
+func TestKafkaPartitionOffsets(t *testing.T) {
+	o := newKafkaPartitionOffsets()
+	for offset := int64(10); offset < 15; offset++ {
+		o.add(offset, 1)
+	}
+
+	o.done(11)
+	o.done(12)
+	if _, ok := o.uncommitted(); ok {
+		t.Fatal("offset committed over in-flight record 10")
+	}
+
+	o.done(10)
+	if eo, ok := o.uncommitted(); !ok || eo.Offset != 13 || eo.Epoch != 1 {
+		t.Fatalf("uncommitted %v %v, expected offset 13", eo, ok)
+	}
+	o.committed(13)
+	if _, ok := o.uncommitted(); ok {
+		t.Fatal("offset 13 reported after commit")
+	}
+
+	o.done(14)
+	o.done(13)
+	if eo, ok := o.uncommitted(); !ok || eo.Offset != 15 {
+		t.Fatalf("uncommitted %v %v, expected offset 15", eo, ok)
+	}
+	if o.inflight != 0 || len(o.pending) != 0 || len(o.epochs) != 0 || len(o.handled) != 0 {
+		t.Fatalf("processed records still tracked: %+v", o)
+	}
+}
+
+func TestKafkaPoolOrdering(t *testing.T) {
+	cfg := &BrokerConfig{Workers: 4}
+	cfg.Reader.QueueCapacity = 8
+
+	var recs []*kgo.Record
+	for offset := int64(0); offset < 20; offset++ {
+		for partition := int32(0); partition < 3; partition++ {
+			recs = append(recs, &kgo.Record{
+				Partition: partition,
+				Offset:    offset,
+				Value:     []byte(fmt.Sprintf(`{"partition":%d,"offset":%d}`, partition, offset)),
+			})
+		}
+	}
+
+	var mu sync.Mutex
+	seen := make(map[int64][]int64)
+	p, cl := testPool(t, cfg, func(evt broker.Event) error {
+		var body struct {
+			Partition int64
+			Offset    int64
+		}
+		if err := json.Unmarshal(evt.Message().Body, &body); err != nil {
+			return err
+		}
+		time.Sleep(time.Duration(body.Offset%3) * time.Millisecond)
+		mu.Lock()
+		seen[body.Partition] = append(seen[body.Partition], body.Offset)
+		mu.Unlock()
+		return nil
+	}, recs)
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(seen[0])+len(seen[1])+len(seen[2]) == len(recs)
+	})
+	if err := p.Unsubscribe(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for partition, offsets := range seen {
+		for i, offset := range offsets {
+			if offset != int64(i) {
+				t.Fatalf("partition %d processed out of order: %v", partition, offsets)
+			}
+		}
+		if cl.commits[int32(partition)] != 20 {
+			t.Fatalf("partition %d commit %d, expected 20", partition, cl.commits[int32(partition)])
+		}
+	}
+}
+
+func TestKafkaPoolBackpressure(t *testing.T) {
+	cfg := &BrokerConfig{Workers: 2}
+	cfg.Reader.QueueCapacity = 2
+
+	recs := []*kgo.Record{
+		{Partition: 0, Offset: 0, Value: []byte(`{}`)},
+		{Partition: 1, Offset: 0, Value: []byte(`{}`)},
+		{Partition: 0, Offset: 1, Value: []byte(`{}`)},
+		{Partition: 1, Offset: 1, Value: []byte(`{}`)},
+	}
+
+	release := make(chan struct{})
+	p, cl := testPool(t, cfg, func(evt broker.Event) error {
+		<-release
+		return nil
+	}, recs)
+
+	waitFor(t, func() bool {
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		return cl.paused
+	})
+	p.mu.Lock()
+	inflight := p.inflight
+	p.mu.Unlock()
+	if inflight != 2 {
+		t.Fatalf("inflight %d, expected queue capacity 2", inflight)
+	}
+
+	close(release)
+	waitFor(t, func() bool {
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		return len(cl.recs) == 0
+	})
+	if err := p.Unsubscribe(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if cl.commits[0] != 2 || cl.commits[1] != 2 {
+		t.Fatalf("commits %v, expected offset 2 for both partitions", cl.commits)
+	}
+}
+
+func TestKafkaPoolUnacked(t *testing.T) {
+	cfg := &BrokerConfig{Workers: 2}
+	cfg.Reader.ReadBackoffMin.Duration = time.Millisecond
+	cfg.Reader.ReadBackoffMax.Duration = time.Millisecond
+
+	var recs []*kgo.Record
+	for offset := int64(0); offset < 5; offset++ {
+		recs = append(recs, &kgo.Record{Partition: 0, Offset: offset, Value: []byte(`{}`)})
+	}
+
+	var mu sync.Mutex
+	broken := true
+	deliveries := make(map[int64]int)
+	p, cl := testPool(t, cfg, func(evt broker.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		offset := evt.(*kafkaPoolEvent).offset
+		deliveries[offset]++
+		if offset == 2 && broken {
+			return errors.New("broken")
+		}
+		return nil
+	}, recs)
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return deliveries[2] > 3
+	})
+	p.commit(context.Background())
+	cl.mu.Lock()
+	commit := cl.commits[0]
+	cl.mu.Unlock()
+	// unacked message holds commit of partition and later messages wait for it
+	if commit != 2 {
+		t.Fatalf("commit %d, expected offset 2 of unacked message", commit)
+	}
+	mu.Lock()
+	if deliveries[3] != 0 {
+		t.Fatalf("message 3 delivered before unacked message 2: %v", deliveries)
+	}
+	broken = false
+	mu.Unlock()
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return deliveries[4] == 1
+	})
+	if err := p.Unsubscribe(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if cl.commits[0] != 5 {
+		t.Fatalf("commit %d, expected offset 5 after message is acked", cl.commits[0])
+	}
+	if part := p.partitions[0]; len(part.pending) != 0 || len(part.handled) != 0 {
+		t.Fatalf("processed records still tracked: %+v", part)
+	}
+}
+
+func TestKafkaPoolUnackedRevoked(t *testing.T) {
+	cfg := &BrokerConfig{Workers: 1}
+	cfg.Reader.ReadBackoffMin.Duration = time.Millisecond
+	cfg.Reader.ReadBackoffMax.Duration = time.Millisecond
+
+	recs := []*kgo.Record{
+		{Partition: 0, Offset: 0, Value: []byte(`{}`)},
+		{Partition: 0, Offset: 1, Value: []byte(`{}`)},
+	}
+	var mu sync.Mutex
+	var delivered int
+	p, cl := testPool(t, cfg, func(evt broker.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered++
+		if evt.(*kafkaPoolEvent).offset == 0 {
+			return errors.New("broken")
+		}
+		return nil
+	}, recs)
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return delivered > 1
+	})
+
+	// revoked partition stops redelivery and is committed up to unacked message
+	p.revoked(context.Background(), nil, map[string][]int32{"topic": {0}})
+	if err := p.Unsubscribe(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if commit, ok := cl.commits[0]; ok {
+		t.Fatalf("commit %d over unacked message of revoked partition", commit)
+	}
+}
+
+func TestKafkaPoolRetryDelay(t *testing.T) {
+	notBefore := func(d time.Duration) []kgo.RecordHeader {
+		return []kgo.RecordHeader{{Key: retry.HeaderNotBefore, Value: []byte(time.Now().Add(d).Format(time.RFC3339Nano))}}
+	}
+	recs := []*kgo.Record{
+		{Partition: 0, Offset: 0, Value: []byte(`{}`), Headers: notBefore(time.Hour)},
+		{Partition: 1, Offset: 0, Value: []byte(`{}`), Headers: notBefore(50 * time.Millisecond)},
+	}
+
+	var mu sync.Mutex
+	delivered := make(map[int32]time.Time)
+	start := time.Now()
+	p, cl := testPool(t, &BrokerConfig{Workers: 2}, func(evt broker.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[evt.(*kafkaPoolEvent).rec.Partition] = time.Now()
+		return nil
+	}, recs)
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return !delivered[1].IsZero()
+	})
+	if d := delivered[1].Sub(start); d < 50*time.Millisecond {
+		t.Fatalf("message delivered after %s, before its retry delay", d)
+	}
+
+	// revoked partition does not wait for delay of its message
+	revoked := make(chan struct{})
+	go func() {
+		p.revoked(context.Background(), nil, map[string][]int32{"topic": {0}})
+		close(revoked)
+	}()
+	select {
+	case <-revoked:
+	case <-time.After(time.Second):
+		t.Fatal("revoke waits for delayed message")
+	}
+	if err := p.Unsubscribe(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := delivered[0]; ok {
+		t.Fatal("delayed message of revoked partition delivered")
+	}
+	if _, ok := cl.commits[0]; ok || cl.commits[1] != 1 {
+		t.Fatalf("commits %v, expected only partition 1", cl.commits)
+	}
+}
+
+func TestKafkaPoolErrorPolicy(t *testing.T) {
+	for _, policy := range []ErrorPolicy{ErrorPolicyRetry, ErrorPolicySkip} {
+		cfg := &BrokerConfig{Workers: 1}
+		cfg.Reader.ReadBackoffMin.Duration = time.Millisecond
+		cfg.Reader.ReadBackoffMax.Duration = time.Millisecond
+
+		c := &testClient{err: errors.New("publish failed")}
+		var mu sync.Mutex
+		var unrecoverable int
+		eh := NewErrorHandler("errors", "app", c,
+			ErrorHandlerPolicy(policy),
+			ErrorHandlerPublishRetry(2, time.Millisecond, time.Millisecond),
+			ErrorHandlerUnrecoverable(func(evt broker.Event, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				unrecoverable++
+			}),
+		)
+
+		recs := []*kgo.Record{
+			{Partition: 0, Offset: 0, Value: []byte(`{}`)},
+			{Partition: 0, Offset: 1, Value: []byte(`{}`)},
+		}
+		p, cl := testPool(t, cfg, func(evt broker.Event) error {
+			if evt.(*kafkaPoolEvent).offset == 0 {
+				return errors.New("broken")
+			}
+			return nil
+		}, recs, broker.SubscribeErrorHandler(eh))
+
+		// message left unacked by policy is redelivered instead of being committed
+		waitFor(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return unrecoverable > 1
+		})
+		p.commit(context.Background())
+		cl.mu.Lock()
+		_, committed := cl.commits[0]
+		cl.mu.Unlock()
+		if committed {
+			t.Fatalf("policy %d: unacked message committed", policy)
+		}
+
+		c.mu.Lock()
+		c.err = nil
+		c.mu.Unlock()
+		waitFor(t, func() bool {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return p.inflight == 0
+		})
+		if err := p.Unsubscribe(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if cl.commits[0] != 2 {
+			t.Fatalf("policy %d: commit %d, expected offset 2 after message is moved to error topic", policy, cl.commits[0])
+		}
+		if c.published[0] != "errors" {
+			t.Fatalf("policy %d: published to %v, expected error topic", policy, c.published)
+		}
+	}
+}
+
+func TestKafkaPoolRevoked(t *testing.T) {
+	recs := []*kgo.Record{
+		{Partition: 0, Offset: 0, Value: []byte(`{"partition":0}`)},
+		{Partition: 1, Offset: 0, Value: []byte(`{"partition":1}`)},
+	}
+	encodeRecords(t, recs)
+
+	var mu sync.Mutex
+	var handled []string
+	p, cl := testPool(t, &BrokerConfig{Workers: 1}, func(evt broker.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, string(evt.Message().Body))
+		return nil
+	}, nil)
+	// partition 1 is revoked after records are polled
+	p.assigned(context.Background(), nil, map[string][]int32{"topic": {0}})
+	for _, rec := range recs {
+		p.dispatch(rec)
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == 1
+	})
+	if err := p.Unsubscribe(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if handled[0] != `{"partition":0}` {
+		t.Fatalf("handled %q, expected only record of owned partition 0", handled)
+	}
+	if _, ok := cl.commits[1]; ok {
+		t.Fatalf("revoked partition committed: %v", cl.commits)
+	}
+}
+
+func TestKafkaPoolSeek(t *testing.T) {
+	recs := []*kgo.Record{
+		{Partition: 0, Offset: 20, Value: []byte(`{}`)},
+		{Partition: 0, Offset: 21, Value: []byte(`{}`)},
+	}
+	release := make(chan struct{})
+	p, cl := testPool(t, &BrokerConfig{Workers: 1}, func(evt broker.Event) error {
+		<-release
+		return nil
+	}, recs)
+	waitFor(t, func() bool { return !p.drained([]int32{0}) })
+
+	seeked := make(chan error, 1)
+	go func() { seeked <- p.seek(context.Background(), map[int32]int64{0: 5}) }()
+	select {
+	case err := <-seeked:
+		t.Fatalf("seek applied while records are in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-seeked; err != nil {
+		t.Fatal(err)
+	}
+	p.commit(context.Background())
+	if err := p.Unsubscribe(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// records dispatched before seek do not move commit over seek offset
+	if cl.seeks[0] != 5 || cl.commits[0] != 5 {
+		t.Fatalf("seeks %v, commits %v, expected offset 5", cl.seeks, cl.commits)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.seek(ctx, map[int32]int64{0: 1}); err == nil {
+		t.Fatal("seek of unsubscribed pool must fail")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKafkaPoolRebalances(t *testing.T) {
+	cfg := &BrokerConfig{}
+	cfg.Reader.ReadLagInterval.Duration = time.Second
+	options := broker.NewSubscribeOptions(broker.SubscribeGroup("rebalances"))
+	p := newKafkaPool("topic", nil, options, rawjson.NewCodec(), cfg)
+
+	p.assigned(context.Background(), nil, map[string][]int32{"topic": {0, 1}})
+	p.revoked(context.Background(), nil, map[string][]int32{"topic": {1}})
+	p.assigned(context.Background(), nil, map[string][]int32{"topic": {2}})
+	if v := testutil.ToFloat64(kafkaRebalanceCounter.WithLabelValues("rebalances")); v != 2 {
+		t.Fatalf("rebalances %v, expected 2", v)
+	}
+
+	// without lag metrics rebalances are not counted
+	p = newKafkaPool("topic", nil, options, rawjson.NewCodec(), &BrokerConfig{})
+	p.assigned(context.Background(), nil, map[string][]int32{"topic": {0}})
+	if v := testutil.ToFloat64(kafkaRebalanceCounter.WithLabelValues("rebalances")); v != 2 {
+		t.Fatalf("rebalances %v, expected 2", v)
+	}
+}
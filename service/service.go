@@ -1,26 +1,32 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
+	amqpbroker "github.com/presnalex/go-micro/v3/broker/amqp"
+	natsbroker "github.com/presnalex/go-micro/v3/broker/nats"
 	"github.com/presnalex/go-micro/v3/codec/rawjson"
 	logwrapper "github.com/presnalex/go-micro/v3/wrapper/logwrapper"
+	"github.com/presnalex/go-micro/v3/wrapper/recovery"
 	idwrapper "github.com/presnalex/go-micro/v3/wrapper/requestid"
 	promwrapper "github.com/presnalex/micro-wrapper-metrics-prometheus"
 	kbroker "go.unistack.org/micro-broker-kgo/v3"
 	cp "go.unistack.org/micro-codec-proto/v3"
 	"go.unistack.org/micro/v3/broker"
 	"go.unistack.org/micro/v3/client"
+	"go.unistack.org/micro/v3/logger"
 	"go.unistack.org/micro/v3/server"
 )
 
 type MetricConfig struct {
-	Addr string `json:"addr" env:"METRIC_ADDRESS"`
+	Addr string `json:"addr" env:"METRIC_ADDRESS" validate:"hostport"`
 }
 
 type ConsulConfig struct {
-	Addr          string `json:"addr" env:"consul_host"`
+	Addr          string `json:"addr" env:"consul_host" validate:"required,addr"`
 	Token         string `json:"token" env:"consul_config_acl_token"`
 	AppPath       string `json:"path" env:"consul_app_path"`
 	NamespacePath string `json:"config_path" env:"consul_config_path"`
@@ -29,7 +35,7 @@ type ConsulConfig struct {
 }
 
 type VaultConfig struct {
-	Uri           string `json:"uri" env:"vault_uri"`
+	Uri           string `json:"uri" env:"vault_uri" validate:"required,url"`
 	NamespacePath string `json:"path" env:"vault_config_path"`
 	AppPath       string `json:"apppath" env:"vault_app_path"`
 	Token         string `json:"token" env:"vault_token"`
@@ -38,33 +44,33 @@ type VaultConfig struct {
 }
 
 type PostgresConfig struct {
-	Addr            string `json:"addr"`
-	Login           string `json:"login"`
+	Addr            string `json:"addr" validate:"required"`
+	Login           string `json:"login" validate:"required"`
 	Passw           string `json:"passw"`
-	DBName          string `json:"dbname"`
+	DBName          string `json:"dbname" validate:"required"`
 	AppName         string `json:"appname"`
-	ConnMax         int    `json:"conn_max"`
-	ConnMaxIdle     int    `json:"conn_max_idle"`
-	ConnLifetime    int    `json:"conn_lifetime"`
-	ConnMaxIdleTime int    `json:"conn_maxidletime"`
+	ConnMax         int    `json:"conn_max" validate:"min=0"`
+	ConnMaxIdle     int    `json:"conn_max_idle" validate:"min=0"`
+	ConnLifetime    int    `json:"conn_lifetime" validate:"min=0"`
+	ConnMaxIdleTime int    `json:"conn_maxidletime" validate:"min=0"`
 }
 
 type OracleConfig struct {
-	Addr            string `json:"addr"`
-	Login           string `json:"login"`
+	Addr            string `json:"addr" validate:"required"`
+	Login           string `json:"login" validate:"required"`
 	Passw           string `json:"passw"`
-	DBName          string `json:"dbname"`
-	ConnMax         int    `json:"conn_max"`
-	ConnMaxIdle     int    `json:"conn_max_idle"`
-	ConnLifetime    int    `json:"conn_lifetime"`
-	ConnMaxIdleTime int    `json:"conn_maxidletime"`
+	DBName          string `json:"dbname" validate:"required"`
+	ConnMax         int    `json:"conn_max" validate:"min=0"`
+	ConnMaxIdle     int    `json:"conn_max_idle" validate:"min=0"`
+	ConnLifetime    int    `json:"conn_lifetime" validate:"min=0"`
+	ConnMaxIdleTime int    `json:"conn_maxidletime" validate:"min=0"`
 }
 
 type ServerConfig struct {
-	Name    string `json:"name" env:"SERVER_NAME"`
+	Name    string `json:"name" env:"SERVER_NAME" validate:"required"`
 	ID      string `json:"id" env:"SERVER_ID"`
 	Version string `json:"version" env:"SERVER_VERSION"`
-	Addr    string `json:"addr" env:"SERVER_ADDRESS"`
+	Addr    string `json:"addr" env:"SERVER_ADDRESS" validate:"required,hostport"`
 }
 
 type CoreConfig struct {
@@ -73,15 +79,17 @@ type CoreConfig struct {
 }
 
 type ClientConfig struct {
-	ClientRetries        int `json:"client_retries"`
-	ClientRequestTimeout int `json:"client_request_timeout"`
-	ClientPoolSize       int `json:"client_pool_size"`
-	ClientDialTimeout    int `json:"client_dial_timeout"`
-	ClientPoolTTL        int `json:"client_pool_ttl"`
-	TransportTimeout     int `json:"transport_timeout"`
+	ClientRetries        int `json:"client_retries" validate:"min=0"`
+	ClientRequestTimeout int `json:"client_request_timeout" validate:"min=0"`
+	ClientPoolSize       int `json:"client_pool_size" validate:"min=0"`
+	ClientDialTimeout    int `json:"client_dial_timeout" validate:"min=0"`
+	ClientPoolTTL        int `json:"client_pool_ttl" validate:"min=0"`
+	TransportTimeout     int `json:"transport_timeout" validate:"min=0"`
 }
 
-func ClientOptions(ccfg *ClientConfig) ([]client.Option, error) {
+// ClientTuningOptions returns retries, timeouts and pool options of ccfg with defaults for zero values,
+// they can be applied to running client by Init
+func ClientTuningOptions(ccfg *ClientConfig) []client.Option {
 	clientRetries := ccfg.ClientRetries
 	clientPoolSize := ccfg.ClientPoolSize
 
@@ -98,9 +106,6 @@ func ClientOptions(ccfg *ClientConfig) ([]client.Option, error) {
 	if ccfg.ClientRequestTimeout == 0 {
 		clientRequestTimeout = defaultClientRequestTimeout
 	}
-	if ccfg.ClientRequestTimeout == 0 {
-		clientRequestTimeout = defaultClientRequestTimeout
-	}
 	if ccfg.ClientPoolTTL == 0 {
 		clientPoolTTL = defaultClientPoolTTL
 	}
@@ -108,20 +113,28 @@ func ClientOptions(ccfg *ClientConfig) ([]client.Option, error) {
 		clientDialTimeout = defaultClientDialTimeout
 	}
 
-	opts := []client.Option{
-		client.Codec("application/grpc+proto", cp.NewCodec()),
-		client.Codec("application/json", rawjson.NewCodec()),
-		// grpc.AuthTLS(&tls.Config{InsecureSkipVerify: true}),
-		client.Broker(broker.DefaultBroker),
+	return []client.Option{
 		client.Retries(clientRetries),
 		client.RequestTimeout(clientRequestTimeout),
 		client.PoolSize(clientPoolSize),
 		client.PoolTTL(clientPoolTTL),
 		client.DialTimeout(clientDialTimeout),
+	}
+}
+
+func ClientOptions(ccfg *ClientConfig) ([]client.Option, error) {
+	opts := []client.Option{
+		client.Codec("application/grpc+proto", cp.NewCodec()),
+		client.Codec("application/json", rawjson.NewCodec()),
+		// grpc.AuthTLS(&tls.Config{InsecureSkipVerify: true}),
+		client.Broker(broker.DefaultBroker),
+	}
+	opts = append(opts, ClientTuningOptions(ccfg)...)
+	opts = append(opts,
 		client.Wrap(promwrapper.NewClientWrapper()),
 		client.Wrap(idwrapper.NewClientWrapper()),
 		client.Wrap(logwrapper.NewClientWrapper()),
-	}
+	)
 
 	return opts, nil
 }
@@ -157,6 +170,7 @@ func ServerOptions(scfg *ServerConfig) ([]server.Option, error) {
 		),
 		server.WrapHandler(idwrapper.NewServerHandlerWrapper()),
 		server.WrapHandler(logwrapper.NewServerHandlerWrapper()),
+		server.WrapHandler(recovery.NewServerHandlerWrapper()),
 		server.WrapSubscriber(
 			promwrapper.NewSubscriberWrapper(
 				promwrapper.ServiceName(scfg.Name),
@@ -166,30 +180,112 @@ func ServerOptions(scfg *ServerConfig) ([]server.Option, error) {
 		),
 		server.WrapSubscriber(idwrapper.NewServerSubscriberWrapper()),
 		server.WrapSubscriber(logwrapper.NewServerSubscriberWrapper()),
+		server.WrapSubscriber(recovery.NewServerSubscriberWrapper()),
 	}
 
 	return opts, nil
 }
 
+func SubscriberOptions(cfg *BrokerConfig) []server.SubscriberOption {
+	var opts []server.SubscriberOption
+
+	group := cfg.Reader.Group
+	if group == "" {
+		group = cfg.Group
+	}
+	if group != "" {
+		opts = append(opts, server.SubscriberQueue(group))
+	}
+
+	return opts
+}
+
+// InitBroker creates broker by cfg.Type, nil config or empty type means broker is not used
+// and broker.DefaultBroker is returned. Process exits on unknown type or invalid config,
+// use InitBrokerE to get the error
 func InitBroker(cfg *BrokerConfig) broker.Broker {
-	if cfg == nil {
-		return broker.DefaultBroker
+	b, err := InitBrokerE(cfg)
+	if err != nil {
+		logger.Fatalf(context.Background(), "init broker: %v", err)
+	}
+	return b
+}
+
+// InitBrokerE is InitBroker returning config errors
+func InitBrokerE(cfg *BrokerConfig) (broker.Broker, error) {
+	if cfg == nil || cfg.Type == "" {
+		return broker.DefaultBroker, nil
+	}
+
+	c, err := NewBrokerCodec(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	switch cfg.Type {
 	case "kafka":
+		opts := []broker.Option{broker.Codec(c), broker.Addrs(cfg.Addr...)}
+		ropts, err := NewKafkaReaderConfigE(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, ropts...)
+		wopts, err := NewKafkaWriterConfigE(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, wopts...)
 
-		opts := []broker.Option{broker.Codec(rawjson.NewCodec()), broker.Addrs(cfg.Addr...)}
-		opts = append(opts, NewKafkaReaderConfig(cfg)...)
-		opts = append(opts, NewKafkaWriterConfig(cfg)...)
+		// micro broker gives no control over record keys, client of writer is shared by other wrappers
+		var b broker.Broker
+		if b, err = newKafkaWriterBroker(kbroker.NewBroker(opts...), cfg); err != nil {
+			return nil, err
+		}
+		if len(cfg.Topics) > 0 {
+			if err = validateKafkaTopics(cfg.Topics); err != nil {
+				return nil, err
+			}
+			b = newKafkaTopicsBroker(b, cfg)
+		}
+		if cfg.Workers > 1 || cfg.Reader.Control {
+			// default broker processes messages of each partition sequentially in single goroutine
+			// and gives no control over fetching, offsets and rebalance hooks
+			if b, err = newKafkaPoolBroker(b, cfg); err != nil {
+				return nil, err
+			}
+		}
+		if cfg.Reader.ReadLagInterval.Duration > 0 {
+			b = newKafkaLagBroker(b, cfg)
+		}
+
+		return b, nil
+	case "nats":
+		opts := []broker.Option{broker.Codec(c), broker.Addrs(cfg.Addr...)}
+		nopts, err := NewNatsConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nopts...)
+
+		return natsbroker.NewBroker(opts...), nil
+	case "amqp", "rabbitmq":
+		opts := []broker.Option{broker.Codec(c), broker.Addrs(cfg.Addr...)}
+		aopts, err := NewAMQPConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, aopts...)
 
-		return kbroker.NewBroker(opts...)
+		return amqpbroker.NewBroker(opts...), nil
+	case "memory":
+		// in process broker, useful for tests
+		return broker.NewBroker(broker.Codec(c)), nil
 	// case "kubemq":
 	//	return kubemqbroker.NewBroker(
 	//		broker.Addrs(cfg.Addr...),
 	//		broker.Codec(rawjson.Marshaler{}),
 	//	)
 	default:
-		return broker.DefaultBroker
+		return nil, fmt.Errorf("unknown broker type %q, must be kafka, nats, amqp or memory", cfg.Type)
 	}
 }
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/presnalex/go-micro/v3/codec/registry"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/codec"
+	"go.unistack.org/micro/v3/metadata"
+)
+
+// KafkaTxProducer publishes several messages atomically using kafka transactions.
+// Messages are encoded the same way as broker created by InitBroker does,
+// so subscribers can't tell the difference.
+type KafkaTxProducer struct {
+	mu     sync.Mutex
+	client kafkaTxClient
+	codec  codec.Codec
+	// schema registry messages are not wrapped, headers are sent as record headers
+	bodyOnly bool
+}
+
+// kafkaTxClient is the part of kgo client used by KafkaTxProducer
+type kafkaTxClient interface {
+	BeginTransaction() error
+	ProduceSync(ctx context.Context, rs ...*kgo.Record) kgo.ProduceResults
+	EndTransaction(ctx context.Context, commit kgo.TransactionEndTry) error
+	AbortBufferedRecords(ctx context.Context) error
+	Close()
+}
+
+// KafkaTx collects messages published inside KafkaTxProducer.Transaction
+type KafkaTx struct {
+	codec    codec.Codec
+	bodyOnly bool
+	records  []*kgo.Record
+}
+
+func NewKafkaTxProducer(cfg *BrokerConfig) (*KafkaTxProducer, error) {
+	if cfg.Writer.TransactionalID == "" {
+		return nil, fmt.Errorf("kafka writer: transactional_id required for transactional producer")
+	}
+	if acks := cfg.Writer.RequiredAcks; acks != nil && *acks != -1 {
+		return nil, fmt.Errorf("kafka writer: transactional producing requires required_acks -1 (all)")
+	}
+
+	c, err := NewBrokerCodec(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// transactions require idempotent producer
+	wcfg := *cfg
+	wcfg.Writer.Idempotent = true
+
+	kopts, err := newKafkaWriterOptions(&wcfg)
+	if err != nil {
+		return nil, err
+	}
+	kopts = append(kopts,
+		kgo.SeedBrokers(cfg.Addr...),
+		kgo.TransactionalID(cfg.Writer.TransactionalID),
+	)
+	if cfg.Writer.TransactionTimeout.Duration > 0 {
+		kopts = append(kopts, kgo.TransactionTimeout(cfg.Writer.TransactionTimeout.Duration))
+	}
+
+	cl, err := kgo.NewClient(kopts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KafkaTxProducer{client: cl, codec: c, bodyOnly: cfg.Codec == BrokerCodecSchemaRegistry}, nil
+}
+
+// Transaction calls fn and commits all messages published by it in single kafka transaction.
+// If fn returns error or any message can't be produced, transaction is aborted and none of messages
+// become visible to read_committed consumers. Returned error wraps the cause, so it can be checked by errors.Is.
+func (p *KafkaTxProducer) Transaction(ctx context.Context, fn func(tx *KafkaTx) error) error {
+	tx := &KafkaTx{codec: p.codec, bodyOnly: p.bodyOnly}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.records) == 0 {
+		return nil
+	}
+
+	// kgo client does not allow concurrent transactions
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.client.BeginTransaction(); err != nil {
+		return err
+	}
+
+	if err := p.client.ProduceSync(ctx, tx.records...).FirstErr(); err != nil {
+		return p.abort(ctx, err)
+	}
+
+	if err := p.client.EndTransaction(ctx, kgo.TryCommit); err != nil {
+		return p.abort(ctx, err)
+	}
+
+	return nil
+}
+
+// abort rolls back transaction, error of rollback is added to the cause message
+func (p *KafkaTxProducer) abort(ctx context.Context, cause error) error {
+	if err := p.client.AbortBufferedRecords(ctx); err != nil {
+		return fmt.Errorf("%w: abort buffered records: %v", cause, err)
+	}
+	if err := p.client.EndTransaction(ctx, kgo.TryAbort); err != nil {
+		return fmt.Errorf("%w: abort transaction: %v", cause, err)
+	}
+	return cause
+}
+
+func (p *KafkaTxProducer) Close() {
+	p.client.Close()
+}
+
+// Publish adds message to transaction, message headers are taken from outgoing context metadata
+func (tx *KafkaTx) Publish(ctx context.Context, topic string, msg interface{}) error {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = metadata.Copy(md)
+	} else {
+		md = metadata.New(2)
+	}
+	if tx.bodyOnly {
+		md.Set("Content-Type", registry.ContentType)
+	} else {
+		md.Set("Content-Type", "application/json")
+	}
+	md.Set("Micro-Topic", topic)
+
+	body, err := tx.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	rec := &kgo.Record{Topic: topic}
+	if tx.bodyOnly {
+		rec.Value = body
+		for k, v := range md {
+			rec.Headers = append(rec.Headers, kgo.RecordHeader{Key: k, Value: []byte(v)})
+		}
+	} else if rec.Value, err = tx.codec.Marshal(&broker.Message{Header: md, Body: body}); err != nil {
+		return err
+	}
+	if key, ok := md.Get(KafkaHeaderKey); ok && key != "" {
+		rec.Key = []byte(key)
+	}
+	tx.records = append(tx.records, rec)
+
+	return nil
+}
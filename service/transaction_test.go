@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/presnalex/go-micro/v3/codec/rawjson"
+	"github.com/presnalex/go-micro/v3/codec/registry"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+type testTxClient struct {
+	began      int
+	produced   []*kgo.Record
+	ends       []kgo.TransactionEndTry
+	produceErr error
+	commitErr  error
+	abortErr   error
+}
+
+func (c *testTxClient) BeginTransaction() error {
+	c.began++
+	return nil
+}
+
+func (c *testTxClient) ProduceSync(ctx context.Context, rs ...*kgo.Record) kgo.ProduceResults {
+	results := make(kgo.ProduceResults, 0, len(rs))
+	for _, r := range rs {
+		if c.produceErr == nil {
+			c.produced = append(c.produced, r)
+		}
+		results = append(results, kgo.ProduceResult{Record: r, Err: c.produceErr})
+	}
+	return results
+}
+
+func (c *testTxClient) EndTransaction(ctx context.Context, commit kgo.TransactionEndTry) error {
+	c.ends = append(c.ends, commit)
+	if commit == kgo.TryCommit {
+		return c.commitErr
+	}
+	return c.abortErr
+}
+
+func (c *testTxClient) AbortBufferedRecords(ctx context.Context) error {
+	return nil
+}
+
+func (c *testTxClient) Close() {}
+
+func TestKafkaTxProducer(t *testing.T) {
+	publish := func(tx *KafkaTx) error {
+		if err := tx.Publish(context.Background(), "orders", map[string]int{"id": 1}); err != nil {
+			return err
+		}
+		return tx.Publish(context.Background(), "payments", map[string]int{"id": 2})
+	}
+	errProduce, errCommit, errAbort, errHandler := errors.New("produce"), errors.New("commit"), errors.New("abort"), errors.New("handler")
+
+	tests := []struct {
+		name   string
+		client *testTxClient
+		fn     func(tx *KafkaTx) error
+		err    error
+		ends   []kgo.TransactionEndTry
+	}{
+		{"commit", &testTxClient{}, publish, nil, []kgo.TransactionEndTry{kgo.TryCommit}},
+		{"produce_failure", &testTxClient{produceErr: errProduce}, publish, errProduce, []kgo.TransactionEndTry{kgo.TryAbort}},
+		{"commit_failure", &testTxClient{commitErr: errCommit}, publish, errCommit, []kgo.TransactionEndTry{kgo.TryCommit, kgo.TryAbort}},
+		{"abort_failure", &testTxClient{produceErr: errProduce, abortErr: errAbort}, publish, errProduce, []kgo.TransactionEndTry{kgo.TryAbort}},
+		{"handler_failure", &testTxClient{}, func(tx *KafkaTx) error {
+			if err := publish(tx); err != nil {
+				return err
+			}
+			return errHandler
+		}, errHandler, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &KafkaTxProducer{client: tt.client, codec: rawjson.NewCodec()}
+			err := p.Transaction(context.Background(), tt.fn)
+			switch {
+			case tt.err == nil && err != nil:
+				t.Fatal(err)
+			case tt.err != nil && !errors.Is(err, tt.err):
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			case len(tt.client.ends) != len(tt.ends):
+				t.Fatalf("transaction ends %v, expected %v", tt.client.ends, tt.ends)
+			}
+			for i := range tt.ends {
+				if tt.client.ends[i] != tt.ends[i] {
+					t.Fatalf("transaction ends %v, expected %v", tt.client.ends, tt.ends)
+				}
+			}
+			if tt.ends == nil && tt.client.began != 0 {
+				t.Fatal("transaction began although handler failed")
+			}
+		})
+	}
+
+	cl := &testTxClient{}
+	p := &KafkaTxProducer{client: cl, codec: rawjson.NewCodec()}
+	if err := p.Transaction(context.Background(), publish); err != nil {
+		t.Fatal(err)
+	}
+	if len(cl.produced) != 2 || cl.produced[0].Topic != "orders" || cl.produced[1].Topic != "payments" {
+		t.Fatalf("unexpected produced records %v", cl.produced)
+	}
+}
+
+func TestKafkaTxProducerCodec(t *testing.T) {
+	srv := testSchemaRegistry(t)
+
+	cfg := &BrokerConfig{Addr: []string{"127.0.0.1:1"}, Codec: BrokerCodecSchemaRegistry}
+	cfg.Writer.TransactionalID = "orders"
+	cfg.SchemaRegistry.URL, cfg.SchemaRegistry.AutoRegister = srv.URL, true
+	p, err := NewKafkaTxProducer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.client.Close()
+
+	// messages are encoded like by broker with schema registry codec
+	cl := &testTxClient{}
+	p.client = cl
+	if err = p.Transaction(context.Background(), func(tx *KafkaTx) error {
+		return tx.Publish(context.Background(), "orders", &testAvroOrder{ID: "1"})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rec := cl.produced[0]
+	if len(rec.Value) < 5 || rec.Value[0] != 0 {
+		t.Fatalf("value not in wire format: %q", rec.Value)
+	}
+	headers := make(map[string]string)
+	for _, h := range rec.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	if headers["Content-Type"] != registry.ContentType || headers["Micro-Topic"] != "orders" {
+		t.Fatalf("unexpected headers %v", headers)
+	}
+
+	cfg.Codec = "avro"
+	if _, err = NewKafkaTxProducer(cfg); err == nil {
+		t.Fatal("expected error for unknown codec")
+	}
+}
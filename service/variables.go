@@ -13,4 +13,16 @@ var (
 	defaultClientPoolTTL        = 60 * time.Second
 
 	defaultTransportTimeout = 15 * time.Second
+
+	defaultKafkaBackoffMin = 100 * time.Millisecond
+	defaultKafkaBackoffMax = 10 * time.Second
+
+	defaultKafkaQueueCapacity = 100
+	// kgo default rebalance timeout
+	defaultKafkaRebalanceTimeout = 60 * time.Second
+
+	defaultErrorHandlerPublishAttempts = 5
+
+	defaultAppDrainPeriod = 5 * time.Second
+	defaultAppStopTimeout = 10 * time.Second
 )
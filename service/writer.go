@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/textproto"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/logger"
+)
+
+const (
+	// records without key go to the same partition until batch is full, keys are ignored
+	KafkaPartitionerSticky = "sticky"
+	// records are spread over partitions one by one, keys are ignored
+	KafkaPartitionerRoundRobin = "round-robin"
+	// records with the same key go to the same partition as with java client, records without key are sticky
+	KafkaPartitionerMurmur2 = "murmur2"
+)
+
+// KafkaHeaderKey holds record key, it is usually set in outgoing metadata before client.Publish
+var KafkaHeaderKey = textproto.CanonicalMIMEHeaderKey("Micro-Key")
+
+type kafkaPublishKey struct{}
+
+// KafkaPublishKey sets record key when publishing by broker directly, it takes precedence over
+// key from context and Micro-Key header
+func KafkaPublishKey(key []byte) broker.PublishOption {
+	return func(o *broker.PublishOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, kafkaPublishKey{}, key)
+	}
+}
+
+// NewKafkaKeyContext returns ctx with record key, client.Publish passes ctx to broker,
+// so unlike KafkaPublishKey it works for messages published by micro client
+func NewKafkaKeyContext(ctx context.Context, key []byte) context.Context {
+	return context.WithValue(ctx, kafkaPublishKey{}, key)
+}
+
+// KafkaClient returns kgo client of connected broker created by InitBroker, it is shared by
+// publishing, lag collecting, topics creation and offsets reset, so helpers do not open own connections.
+// Nil is returned for other brokers. Client is closed by broker Disconnect.
+func KafkaClient(b broker.Broker) *kgo.Client {
+	for {
+		switch w := b.(type) {
+		case *kafkaWriterBroker:
+			w.mu.RLock()
+			cl, _ := w.producer.(*kgo.Client)
+			w.mu.RUnlock()
+			return cl
+		case *kafkaTopicsBroker:
+			b = w.Broker
+		case *kafkaPoolBroker:
+			b = w.Broker
+		case *kafkaLagBroker:
+			b = w.Broker
+		default:
+			return nil
+		}
+	}
+}
+
+// kafkaProducer is the part of kgo client used by writer
+type kafkaProducer interface {
+	ProduceSync(ctx context.Context, rs ...*kgo.Record) kgo.ProduceResults
+	Flush(ctx context.Context) error
+	Close()
+}
+
+// kafkaWriterBroker publishes records with keys taken from publish options, context or Micro-Key header,
+// everything except publishing is done by wrapped micro broker. Its client is shared, see KafkaClient.
+type kafkaWriterBroker struct {
+	broker.Broker
+	kopts []kgo.Opt
+	// headers are sent as record headers, used with codecs that do not keep headers in body
+	bodyOnly bool
+
+	mu       sync.RWMutex
+	producer kafkaProducer
+}
+
+func newKafkaWriterBroker(b broker.Broker, cfg *BrokerConfig) (*kafkaWriterBroker, error) {
+	kopts, err := newKafkaWriterOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	kopts = append(kopts, kgo.SeedBrokers(cfg.Addr...))
+
+	return &kafkaWriterBroker{
+		Broker:   b,
+		kopts:    kopts,
+		bodyOnly: cfg.Codec == BrokerCodecSchemaRegistry,
+	}, nil
+}
+
+func (b *kafkaWriterBroker) Connect(ctx context.Context) error {
+	if err := b.Broker.Connect(ctx); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.producer != nil {
+		return nil
+	}
+	cl, err := kgo.NewClient(b.kopts...)
+	if err != nil {
+		return err
+	}
+	b.producer = cl
+
+	return nil
+}
+
+// Disconnect waits for records being published until ctx is done and closes producer
+func (b *kafkaWriterBroker) Disconnect(ctx context.Context) error {
+	b.mu.RLock()
+	producer := b.producer
+	b.mu.RUnlock()
+	if producer != nil {
+		// records are produced synchronously, only concurrent publishes are in buffer
+		if err := producer.Flush(ctx); err != nil {
+			logger.Errorf(ctx, "kafka writer: flush: %v", err)
+		}
+	}
+
+	b.mu.Lock()
+	if b.producer != nil {
+		b.producer.Close()
+		b.producer = nil
+	}
+	b.mu.Unlock()
+
+	return b.Broker.Disconnect(ctx)
+}
+
+func (b *kafkaWriterBroker) Publish(ctx context.Context, topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	rec, err := b.record(ctx, topic, msg, broker.NewPublishOptions(opts...))
+	if err != nil {
+		return err
+	}
+	return b.produce(ctx, rec)
+}
+
+// BatchPublish publishes messages to topics from Micro-Topic header
+func (b *kafkaWriterBroker) BatchPublish(ctx context.Context, msgs []*broker.Message, opts ...broker.PublishOption) error {
+	options := broker.NewPublishOptions(opts...)
+
+	recs := make([]*kgo.Record, 0, len(msgs))
+	for _, msg := range msgs {
+		topic, ok := msg.Header.Get("Micro-Topic")
+		if !ok {
+			return fmt.Errorf("kafka writer: message without Micro-Topic header")
+		}
+		rec, err := b.record(ctx, topic, msg, options)
+		if err != nil {
+			return err
+		}
+		recs = append(recs, rec)
+	}
+
+	return b.produce(ctx, recs...)
+}
+
+func (b *kafkaWriterBroker) produce(ctx context.Context, recs ...*kgo.Record) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.producer == nil {
+		return broker.ErrNotConnected
+	}
+	return b.producer.ProduceSync(ctx, recs...).FirstErr()
+}
+
+func (b *kafkaWriterBroker) record(ctx context.Context, topic string, msg *broker.Message, options broker.PublishOptions) (*kgo.Record, error) {
+	rec := &kgo.Record{Topic: topic}
+
+	if options.Context != nil {
+		rec.Key, _ = options.Context.Value(kafkaPublishKey{}).([]byte)
+	}
+	if rec.Key == nil {
+		rec.Key, _ = ctx.Value(kafkaPublishKey{}).([]byte)
+	}
+	if rec.Key == nil {
+		if key, ok := msg.Header.Get(KafkaHeaderKey); ok && key != "" {
+			rec.Key = []byte(key)
+		}
+	}
+
+	if options.BodyOnly || b.bodyOnly {
+		rec.Value = msg.Body
+		for k, v := range msg.Header {
+			rec.Headers = append(rec.Headers, kgo.RecordHeader{Key: k, Value: []byte(v)})
+		}
+		return rec, nil
+	}
+
+	var err error
+	if rec.Value, err = b.Broker.Options().Codec.Marshal(msg); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func newKafkaPartitioner(name string) (kgo.Partitioner, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case KafkaPartitionerSticky:
+		return kgo.StickyPartitioner(), nil
+	case KafkaPartitionerRoundRobin:
+		return kgo.RoundRobinPartitioner(), nil
+	case KafkaPartitionerMurmur2:
+		return kgo.StickyKeyPartitioner(nil), nil
+	default:
+		return nil, fmt.Errorf("kafka writer: unsupported partitioner %q, must be %q, %q or %q",
+			name, KafkaPartitionerSticky, KafkaPartitionerRoundRobin, KafkaPartitionerMurmur2)
+	}
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/presnalex/go-micro/v3/codec/rawjson"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/metadata"
+)
+
+type testProducer struct {
+	recs []*kgo.Record
+}
+
+func (p *testProducer) ProduceSync(ctx context.Context, rs ...*kgo.Record) kgo.ProduceResults {
+	p.recs = append(p.recs, rs...)
+	results := make(kgo.ProduceResults, 0, len(rs))
+	for _, r := range rs {
+		results = append(results, kgo.ProduceResult{Record: r})
+	}
+	return results
+}
+
+func (p *testProducer) Flush(ctx context.Context) error { return nil }
+
+func (p *testProducer) Close() {}
+
+func TestKafkaWriterKey(t *testing.T) {
+	cfg := &BrokerConfig{}
+	cfg.Writer.Partitioner = KafkaPartitionerMurmur2
+	b, err := newKafkaWriterBroker(broker.NewBroker(broker.Codec(rawjson.NewCodec())), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProducer{}
+	b.producer = p
+
+	msg := func(key string) *broker.Message {
+		md := metadata.Metadata{"Content-Type": "application/json", "Micro-Topic": "orders"}
+		if key != "" {
+			md.Set(KafkaHeaderKey, key)
+		}
+		return &broker.Message{Header: md, Body: []byte(`{}`)}
+	}
+
+	ctx := context.Background()
+	if err = b.Publish(ctx, "orders", msg("customer-1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Publish(ctx, "orders", msg("customer-1"), KafkaPublishKey([]byte("customer-2"))); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.BatchPublish(ctx, []*broker.Message{msg(""), msg("customer-3")}, broker.PublishBodyOnly(true)); err != nil {
+		t.Fatal(err)
+	}
+	// client.Publish passes ctx, but not broker options
+	if err = b.Publish(NewKafkaKeyContext(ctx, []byte("customer-4")), "orders", msg("customer-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range []string{"customer-1", "customer-2", "", "customer-3", "customer-4"} {
+		if string(p.recs[i].Key) != key {
+			t.Fatalf("record %d key %q, expected %q", i, p.recs[i].Key, key)
+		}
+	}
+	if string(p.recs[3].Value) != `{}` || len(p.recs[3].Headers) != 3 {
+		t.Fatalf("body only record %s with headers %v", p.recs[3].Value, p.recs[3].Headers)
+	}
+	if string(p.recs[0].Value) == `{}` {
+		t.Fatal("record must be encoded with headers by codec")
+	}
+}
+
+func TestKafkaClient(t *testing.T) {
+	cfg := &BrokerConfig{}
+	w, err := newKafkaWriterBroker(broker.NewBroker(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl, err := kgo.NewClient(kgo.SeedBrokers("127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	w.producer = cl
+
+	b := newKafkaLagBroker(&kafkaPoolBroker{Broker: newKafkaTopicsBroker(w, cfg)}, cfg)
+	if KafkaClient(b) != cl {
+		t.Fatal("wrappers must share client of writer")
+	}
+	if KafkaClient(broker.NewBroker()) != nil {
+		t.Fatal("client of non kafka broker")
+	}
+}
@@ -0,0 +1,199 @@
+// Package inbox skips messages that were already processed, like kafka redeliveries after rebalance.
+// Messages are identified by Message-Id header, messages without it are always processed.
+//
+// Id is claimed for lease before handler runs and marked processed when handler succeeds.
+// Id of failed handler is released, id of crashed process is claimed again when lease expires,
+// so redelivered message is processed again in both cases.
+package inbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/logger"
+	"go.unistack.org/micro/v3/metadata"
+	"go.unistack.org/micro/v3/server"
+)
+
+var (
+	// message id header
+	DefaultKey = textproto.CanonicalMIMEHeaderKey("message-id")
+	// how long processed message id is remembered
+	DefaultWindow = 24 * time.Hour
+	// how long message id is claimed by handler, it must be longer than handler runs
+	DefaultLease = 5 * time.Minute
+	// default metric prefix
+	DefaultMetricPrefix = "micro_inbox_"
+	// default label prefix
+	DefaultLabelPrefix = "micro_"
+
+	duplicateCounter *prometheus.CounterVec
+
+	mu sync.Mutex
+)
+
+// ErrProcessing is returned for message which id is claimed by other handler with unexpired lease,
+// message must not be acked as it is lost if that handler fails
+var ErrProcessing = errors.New("inbox: message is being processed")
+
+// State of message id in store
+type State int
+
+const (
+	// id is claimed by caller
+	StateClaimed State = iota
+	// message is processed within window
+	StateProcessed
+	// id is claimed by other handler and lease is not expired
+	StateProcessing
+)
+
+// Store records processed message ids
+type Store interface {
+	// Claim claims id for lease unless it is processed within window or claimed by other handler
+	Claim(ctx context.Context, id string, lease time.Duration, window time.Duration) (State, error)
+	// Done marks claimed id processed
+	Done(ctx context.Context, id string) error
+	// Release forgets id, so failed message is processed again on redelivery
+	Release(ctx context.Context, id string) error
+}
+
+type Options struct {
+	Store  Store
+	Window time.Duration
+	Lease  time.Duration
+	// Key header holds message id
+	Key string
+}
+
+type Option func(*Options)
+
+func WithStore(s Store) Option {
+	return func(opts *Options) {
+		opts.Store = s
+	}
+}
+
+func Window(td time.Duration) Option {
+	return func(opts *Options) {
+		opts.Window = td
+	}
+}
+
+func Lease(td time.Duration) Option {
+	return func(opts *Options) {
+		opts.Lease = td
+	}
+}
+
+func Key(key string) Option {
+	return func(opts *Options) {
+		opts.Key = textproto.CanonicalMIMEHeaderKey(key)
+	}
+}
+
+func newOptions(opts ...Option) Options {
+	options := Options{
+		Window: DefaultWindow,
+		Lease:  DefaultLease,
+		Key:    DefaultKey,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.Store == nil {
+		options.Store = NewMemoryStore(DefaultMemorySize)
+	}
+	return options
+}
+
+// NewServerSubscriberWrapper skips duplicate messages of micro server subscribers
+func NewServerSubscriberWrapper(opts ...Option) server.SubscriberWrapper {
+	options := newOptions(opts...)
+	registerMetrics()
+
+	return func(fn server.SubscriberFunc) server.SubscriberFunc {
+		return func(ctx context.Context, msg server.Message) error {
+			return options.process(ctx, msg.Topic(), msg.Header(), func() error {
+				return fn(ctx, msg)
+			})
+		}
+	}
+}
+
+// NewHandler skips duplicate messages of broker subscribers, like ones subscribed to service.InitBroker broker
+func NewHandler(h broker.Handler, opts ...Option) broker.Handler {
+	options := newOptions(opts...)
+	registerMetrics()
+
+	return func(evt broker.Event) error {
+		return options.process(evt.Context(), evt.Topic(), evt.Message().Header, func() error {
+			return h(evt)
+		})
+	}
+}
+
+func (o Options) process(ctx context.Context, topic string, md metadata.Metadata, fn func() error) error {
+	id, ok := md.Get(o.Key)
+	if !ok || id == "" {
+		return fn()
+	}
+	// the same id may be used by unrelated messages in different topics
+	key := topic + "/" + id
+
+	state, err := o.Store.Claim(ctx, key, o.Lease, o.Window)
+	if err != nil {
+		return fmt.Errorf("inbox: claim %s: %w", key, err)
+	}
+	switch state {
+	case StateProcessed:
+		duplicateCounter.WithLabelValues(topic).Inc()
+		return nil
+	case StateProcessing:
+		return fmt.Errorf("%w: %s", ErrProcessing, key)
+	}
+
+	if err = fn(); err != nil {
+		if rerr := o.Store.Release(ctx, key); rerr != nil {
+			logger.Errorf(ctx, "inbox: release %s: %v", key, rerr)
+		}
+		return err
+	}
+
+	if err = o.Store.Done(ctx, key); err != nil {
+		// message is processed, it is processed again only if redelivered after lease
+		logger.Errorf(ctx, "inbox: done %s: %v", key, err)
+	}
+
+	return nil
+}
+
+func registerMetrics() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if duplicateCounter == nil {
+		duplicateCounter = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("%sduplicates_total", DefaultMetricPrefix),
+				Help: "How many duplicate messages dropped, partitioned by topic",
+			},
+			[]string{
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "topic"),
+			},
+		)
+	}
+
+	if err := prometheus.DefaultRegisterer.Register(duplicateCounter); err != nil {
+		// if already registered, skip fatal
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			logger.Fatal(context.Background(), err.Error())
+		}
+	}
+}
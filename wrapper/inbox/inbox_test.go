@@ -0,0 +1,126 @@
+package inbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.unistack.org/micro/v3/broker"
+	"go.unistack.org/micro/v3/metadata"
+)
+
+type testEvent struct {
+	broker.Event
+	topic string
+	msg   *broker.Message
+}
+
+func (e *testEvent) Context() context.Context {
+	return context.Background()
+}
+
+func (e *testEvent) Topic() string {
+	return e.topic
+}
+
+func (e *testEvent) Message() *broker.Message {
+	return e.msg
+}
+
+func TestHandler(t *testing.T) {
+	var handled int
+	fail := true
+	h := NewHandler(func(evt broker.Event) error {
+		handled++
+		if fail {
+			fail = false
+			return errors.New("broken")
+		}
+		return nil
+	}, WithStore(NewMemoryStore(10)))
+
+	evt := func(topic, id string) broker.Event {
+		return &testEvent{topic: topic, msg: &broker.Message{Header: metadata.Metadata{DefaultKey: id}}}
+	}
+
+	if err := h(evt("orders", "1")); err == nil {
+		t.Fatal("expected handler error")
+	}
+	// failed message is processed again
+	for i := 0; i < 3; i++ {
+		if err := h(evt("orders", "1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if handled != 2 {
+		t.Fatalf("handled %d, expected 2", handled)
+	}
+
+	if err := h(evt("payments", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h(&testEvent{topic: "orders", msg: &broker.Message{Header: metadata.New(0)}}); err != nil {
+		t.Fatal(err)
+	}
+	if handled != 4 {
+		t.Fatalf("handled %d, expected messages from other topic and without id", handled)
+	}
+}
+
+func TestHandlerRedelivery(t *testing.T) {
+	store := NewMemoryStore(10)
+	evt := &testEvent{topic: "orders", msg: &broker.Message{Header: metadata.Metadata{DefaultKey: "1"}}}
+
+	// process crashed while handling message, its claim is left in store
+	if state, _ := store.Claim(context.Background(), "orders/1", time.Hour, time.Hour); state != StateClaimed {
+		t.Fatalf("state %d, expected claimed", state)
+	}
+
+	var handled int
+	h := NewHandler(func(evt broker.Event) error {
+		handled++
+		return nil
+	}, WithStore(store), Lease(50*time.Millisecond))
+
+	// message must not be acked while other handler may fail
+	if err := h(evt); !errors.Is(err, ErrProcessing) {
+		t.Fatalf("expected ErrProcessing, got %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	// redelivery after lease is processed
+	if err := h(evt); err != nil {
+		t.Fatal(err)
+	}
+	if err := h(evt); err != nil {
+		t.Fatal(err)
+	}
+	if handled != 1 {
+		t.Fatalf("handled %d, expected redelivery processed once", handled)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore(2)
+
+	for _, id := range []string{"1", "2", "3"} {
+		if state, _ := s.Claim(ctx, id, time.Hour, time.Hour); state != StateClaimed {
+			t.Fatalf("id %s not claimed", id)
+		}
+		_ = s.Done(ctx, id)
+	}
+	// 1 is evicted as least recent
+	if state, _ := s.Claim(ctx, "1", time.Hour, time.Hour); state != StateClaimed {
+		t.Fatal("evicted id 1 not claimed")
+	}
+	if state, _ := s.Claim(ctx, "1", time.Hour, time.Hour); state != StateProcessing {
+		t.Fatal("id 1 claimed twice")
+	}
+	if state, _ := s.Claim(ctx, "3", time.Hour, time.Hour); state != StateProcessed {
+		t.Fatal("duplicate id 3 claimed")
+	}
+	if state, _ := s.Claim(ctx, "3", time.Hour, 0); state != StateClaimed {
+		t.Fatal("id 3 outside of window not claimed")
+	}
+}
@@ -0,0 +1,86 @@
+package inbox
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultMemorySize is number of ids kept by default store
+var DefaultMemorySize = 10000
+
+type memoryEntry struct {
+	id string
+	// claim time, or processing time of processed id
+	at        time.Time
+	processed bool
+}
+
+type memoryStore struct {
+	mu    sync.Mutex
+	size  int
+	ids   map[string]*list.Element
+	order *list.List
+}
+
+// NewMemoryStore keeps up to size most recent ids in process memory.
+// Ids are lost on restart and not shared between instances, so duplicates after rebalance
+// are caught only if partition is assigned back to the same instance.
+func NewMemoryStore(size int) Store {
+	return &memoryStore{
+		size:  size,
+		ids:   make(map[string]*list.Element, size),
+		order: list.New(),
+	}
+}
+
+func (s *memoryStore) Claim(ctx context.Context, id string, lease time.Duration, window time.Duration) (State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if el, ok := s.ids[id]; ok {
+		entry := el.Value.(*memoryEntry)
+		switch {
+		case entry.processed && now.Sub(entry.at) < window:
+			return StateProcessed, nil
+		case !entry.processed && now.Sub(entry.at) < lease:
+			return StateProcessing, nil
+		}
+		entry.at, entry.processed = now, false
+		s.order.MoveToFront(el)
+		return StateClaimed, nil
+	}
+
+	s.ids[id] = s.order.PushFront(&memoryEntry{id: id, at: now})
+	for s.order.Len() > s.size {
+		el := s.order.Back()
+		s.order.Remove(el)
+		delete(s.ids, el.Value.(*memoryEntry).id)
+	}
+
+	return StateClaimed, nil
+}
+
+func (s *memoryStore) Done(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.ids[id]; ok {
+		entry := el.Value.(*memoryEntry)
+		entry.at, entry.processed = time.Now(), true
+	}
+	return nil
+}
+
+func (s *memoryStore) Release(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.ids[id]; ok {
+		s.order.Remove(el)
+		delete(s.ids, id)
+	}
+	return nil
+}
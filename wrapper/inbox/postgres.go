@@ -0,0 +1,83 @@
+package inbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/presnalex/go-micro/v3/database/wrapper"
+)
+
+// DefaultTable is table used by postgres store
+var DefaultTable = "inbox"
+
+var _ Store = (*PostgresStore)(nil)
+
+// PostgresStore keeps ids in postgres table shared by all service instances
+type PostgresStore struct {
+	db    *wrapper.Wrapper
+	table string
+}
+
+// NewPostgresStore creates store on table, empty table means DefaultTable
+func NewPostgresStore(db *wrapper.Wrapper, table string) *PostgresStore {
+	if table == "" {
+		table = DefaultTable
+	}
+	return &PostgresStore{db: db, table: table}
+}
+
+// Schema returns DDL for inbox table, processed_at is added to tables created by previous versions
+func (s *PostgresStore) Schema() string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+	id text PRIMARY KEY,
+	claimed_at timestamptz NOT NULL DEFAULT now(),
+	processed_at timestamptz
+);
+ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS processed_at timestamptz;`, s.table)
+}
+
+// Claim inserts id, existing id is claimed again if its lease or processed window is expired
+func (s *PostgresStore) Claim(ctx context.Context, id string, lease time.Duration, window time.Duration) (State, error) {
+	// select of outer query sees row before insert
+	query := fmt.Sprintf(`WITH claimed AS (
+	INSERT INTO %[1]s (id) VALUES ($1)
+	ON CONFLICT (id) DO UPDATE SET claimed_at = now(), processed_at = NULL
+	WHERE (%[1]s.processed_at IS NULL AND %[1]s.claimed_at < now() - make_interval(secs => $2))
+		OR %[1]s.processed_at < now() - make_interval(secs => $3)
+	RETURNING id
+)
+SELECT EXISTS (SELECT 1 FROM claimed), EXISTS (SELECT 1 FROM %[1]s WHERE id = $1 AND processed_at IS NOT NULL)`, s.table)
+	var claimed, processed bool
+	err := s.db.QueryRowxContext(wrapper.QueryContext(ctx, "inbox_claim"), query, id, lease.Seconds(), window.Seconds()).
+		Scan(&claimed, &processed)
+	switch {
+	case err != nil:
+		return 0, err
+	case claimed:
+		return StateClaimed, nil
+	case processed:
+		return StateProcessed, nil
+	default:
+		return StateProcessing, nil
+	}
+}
+
+func (s *PostgresStore) Done(ctx context.Context, id string) error {
+	query := fmt.Sprintf("UPDATE %s SET processed_at = now() WHERE id = $1", s.table)
+	_, err := s.db.ExecContext(wrapper.QueryContext(ctx, "inbox_done"), query, id)
+	return err
+}
+
+func (s *PostgresStore) Release(ctx context.Context, id string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", s.table)
+	_, err := s.db.ExecContext(wrapper.QueryContext(ctx, "inbox_release"), query, id)
+	return err
+}
+
+// Cleanup deletes ids older than window, it should be called periodically to keep table small
+func (s *PostgresStore) Cleanup(ctx context.Context, window time.Duration) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE coalesce(processed_at, claimed_at) < now() - make_interval(secs => $1)", s.table)
+	_, err := s.db.ExecContext(wrapper.QueryContext(ctx, "inbox_cleanup"), query, window.Seconds())
+	return err
+}
@@ -0,0 +1,46 @@
+package recovery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.unistack.org/micro/v3/logger"
+)
+
+var (
+	// default metric prefix
+	DefaultMetricPrefix = "micro_"
+	// default label prefix
+	DefaultLabelPrefix = "micro_"
+
+	panicCounter *prometheus.CounterVec
+
+	mu sync.Mutex
+)
+
+func registerMetrics() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if panicCounter == nil {
+		panicCounter = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("%spanics_total", DefaultMetricPrefix),
+				Help: "How many panics recovered, partitioned by kind and endpoint",
+			},
+			[]string{
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "kind"),
+				fmt.Sprintf("%s%s", DefaultLabelPrefix, "endpoint"),
+			},
+		)
+	}
+
+	if err := prometheus.DefaultRegisterer.Register(panicCounter); err != nil {
+		// if already registered, skip fatal
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			logger.Fatal(context.Background(), err.Error())
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Package recovery converts panics of handlers, subscribers and http routes into internal errors.
+package recovery
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gorilla/mux"
+	"go.unistack.org/micro/v3/errors"
+	"go.unistack.org/micro/v3/server"
+
+	"github.com/presnalex/go-micro/v3/logger"
+)
+
+// ErrorDetail is returned to callers instead of panic value, which is logged with stack only
+var ErrorDetail = "internal error"
+
+const (
+	KindHandler    = "handler"
+	KindSubscriber = "subscriber"
+	KindHTTP       = "http"
+)
+
+// NewServerHandlerWrapper returns internal server error on panic, must be the last handler wrapper
+// to have request id in context
+func NewServerHandlerWrapper() server.HandlerWrapper {
+	registerMetrics()
+	return func(fn server.HandlerFunc) server.HandlerFunc {
+		return func(ctx context.Context, req server.Request, rsp interface{}) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					report(ctx, KindHandler, req.Endpoint(), r)
+					err = errors.InternalServerError(req.Service(), "%s", ErrorDetail)
+				}
+			}()
+			return fn(ctx, req, rsp)
+		}
+	}
+}
+
+// NewServerSubscriberWrapper returns internal server error on panic, so message is retried like on any error
+func NewServerSubscriberWrapper() server.SubscriberWrapper {
+	registerMetrics()
+	return func(fn server.SubscriberFunc) server.SubscriberFunc {
+		return func(ctx context.Context, msg server.Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					report(ctx, KindSubscriber, msg.Topic(), r)
+					err = errors.InternalServerError(msg.Topic(), "%s", ErrorDetail)
+				}
+			}()
+			return fn(ctx, msg)
+		}
+	}
+}
+
+// Middleware replies 500 on panic, endpoint is name of mux route.
+// http.ErrAbortHandler is passed through as net/http uses it to abort response silently.
+func Middleware(next http.Handler) http.Handler {
+	registerMetrics()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				var endpoint string
+				if route := mux.CurrentRoute(r); route != nil {
+					endpoint = route.GetName()
+				}
+				report(r.Context(), KindHTTP, endpoint, rec)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func report(ctx context.Context, kind string, endpoint string, r interface{}) {
+	panicCounter.WithLabelValues(kind, endpoint).Inc()
+	logger.FromIncomingContext(ctx).Errorf(ctx, "%s %s panic: %v\n%s", kind, endpoint, r, debug.Stack())
+}
@@ -0,0 +1,106 @@
+package recovery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.unistack.org/micro/v3/errors"
+	mlogger "go.unistack.org/micro/v3/logger"
+	"go.unistack.org/micro/v3/server"
+
+	"github.com/presnalex/go-micro/v3/logger"
+)
+
+func TestHandlerWrapper(t *testing.T) {
+	l := &testLogger{}
+	ctx := context.WithValue(context.Background(), logger.LoggerKey{}, mlogger.Logger(l))
+
+	fn := NewServerHandlerWrapper()(func(ctx context.Context, req server.Request, rsp interface{}) error {
+		panic("nil map")
+	})
+	err := fn(ctx, testRequest{}, nil)
+	if merr := errors.FromError(err); merr == nil || merr.Code != http.StatusInternalServerError {
+		t.Fatalf("panic not converted to internal error: %v", err)
+	} else if merr.Detail != ErrorDetail {
+		t.Fatalf("panic value leaked to caller: %q", merr.Detail)
+	}
+	if len(l.errors) != 1 {
+		t.Fatalf("panic not logged: %v", l.errors)
+	}
+	if v := testutil.ToFloat64(panicCounter.WithLabelValues(KindHandler, "Orders.Create")); v != 1 {
+		t.Fatalf("panic counter %v", v)
+	}
+}
+
+func TestSubscriberWrapper(t *testing.T) {
+	l := &testLogger{}
+	ctx := context.WithValue(context.Background(), logger.LoggerKey{}, mlogger.Logger(l))
+	fn := NewServerSubscriberWrapper()(func(ctx context.Context, msg server.Message) error {
+		panic("nil map")
+	})
+	err := fn(ctx, testMessage{})
+	if merr := errors.FromError(err); merr == nil || merr.Code != http.StatusInternalServerError || merr.Detail != ErrorDetail {
+		t.Fatalf("panic not converted to internal error: %v", err)
+	}
+	if len(l.errors) != 1 {
+		t.Fatalf("panic not logged: %v", l.errors)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	l := &testLogger{}
+	r := mux.NewRouter()
+	r.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
+		panic("nil map")
+	}).Name("Orders.List")
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), logger.LoggerKey{}, mlogger.Logger(l))))
+		})
+	}, Middleware)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected code %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "nil map") {
+		t.Fatalf("panic value leaked to client: %q", w.Body.String())
+	}
+	if len(l.errors) != 1 {
+		t.Fatalf("panic not logged: %v", l.errors)
+	}
+	if v := testutil.ToFloat64(panicCounter.WithLabelValues(KindHTTP, "Orders.List")); v != 1 {
+		t.Fatalf("panic counter %v", v)
+	}
+}
+
+type testRequest struct {
+	server.Request
+}
+
+func (r testRequest) Service() string { return "orders" }
+
+func (r testRequest) Endpoint() string { return "Orders.Create" }
+
+type testMessage struct {
+	server.Message
+}
+
+func (m testMessage) Topic() string { return "orders" }
+
+type testLogger struct {
+	mlogger.Logger
+	errors []string
+}
+
+func (l *testLogger) Fields(fields ...interface{}) mlogger.Logger { return l }
+
+func (l *testLogger) Errorf(ctx context.Context, msg string, args ...interface{}) {
+	l.errors = append(l.errors, msg)
+}
@@ -0,0 +1,54 @@
+package retry
+
+import (
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"go.unistack.org/micro/v3/metadata"
+)
+
+var (
+	// number of retries already made for message
+	HeaderAttempt = textproto.CanonicalMIMEHeaderKey("Micro-Retry-Attempt")
+	// message must not be processed before this time, RFC3339Nano
+	HeaderNotBefore = textproto.CanonicalMIMEHeaderKey("Micro-Retry-Not-Before")
+	// topic where message was published originally
+	HeaderSourceTopic = textproto.CanonicalMIMEHeaderKey("Micro-Source-Topic")
+	// error of each processing attempt is stored in Micro-Error-<n> header
+	HeaderErrorPrefix = textproto.CanonicalMIMEHeaderKey("Micro-Error") + "-"
+)
+
+// Topic returns retry topic name for attempt, like orders.retry.1
+func Topic(topic string, attempt int) string {
+	return fmt.Sprintf("%s.retry.%d", topic, attempt)
+}
+
+// Topics returns all retry topics for topic, the same handler must be subscribed to them
+func Topics(topic string, attempts int) []string {
+	topics := make([]string, 0, attempts)
+	for i := 1; i <= attempts; i++ {
+		topics = append(topics, Topic(topic, i))
+	}
+	return topics
+}
+
+// ErrorHeader returns header name that holds error of attempt
+func ErrorHeader(attempt int) string {
+	return HeaderErrorPrefix + strconv.Itoa(attempt)
+}
+
+// NotBefore returns time before which retried message must not be processed,
+// kafka pool subscribers of service package wait for it without blocking consumer group
+func NotBefore(md metadata.Metadata) (time.Time, bool) {
+	v, ok := md.Get(HeaderNotBefore)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,30 @@
+package retry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.unistack.org/micro/v3/metadata"
+)
+
+func TestTopics(t *testing.T) {
+	if topics := Topics("orders", 2); !reflect.DeepEqual(topics, []string{"orders.retry.1", "orders.retry.2"}) {
+		t.Fatalf("unexpected topics %v", topics)
+	}
+	if h := ErrorHeader(2); h != "Micro-Error-2" {
+		t.Fatalf("unexpected error header %s", h)
+	}
+}
+
+func TestNotBefore(t *testing.T) {
+	now := time.Now().Round(0)
+	if nb, ok := NotBefore(metadata.Metadata{HeaderNotBefore: now.Format(time.RFC3339Nano)}); !ok || !nb.Equal(now) {
+		t.Fatalf("not before %v %v, expected %v", nb, ok, now)
+	}
+	for _, md := range []metadata.Metadata{metadata.New(0), {HeaderNotBefore: "soon"}} {
+		if _, ok := NotBefore(md); ok {
+			t.Fatalf("unexpected delay of %v", md)
+		}
+	}
+}